@@ -0,0 +1,27 @@
+#!/bin/sh
+# Diff this fork of archive/tar against upstream Go at a release tag.
+#
+# Usage: ./diff-upstream.sh [go-version-tag]
+#
+# With GOROOT_SRC set to a Go src/ directory, the files are read from there
+# rather than fetched.
+set -e
+
+VERSION=${1:-go1.27.1}
+cd "$(dirname "$0")"
+
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+for f in *.go; do
+	if [ -n "$GOROOT_SRC" ]; then
+		[ -f "$GOROOT_SRC/archive/tar/$f" ] && cp "$GOROOT_SRC/archive/tar/$f" "$tmp/$f"
+	else
+		curl -fsSL -o "$tmp/$f" "https://raw.githubusercontent.com/golang/go/$VERSION/src/archive/tar/$f" || rm -f "$tmp/$f"
+	fi
+	if [ -f "$tmp/$f" ]; then
+		diff -u "$tmp/$f" "$f" --label "$VERSION/$f" --label "fork/$f" || true
+	else
+		echo "Only in fork: $f"
+	fi
+done
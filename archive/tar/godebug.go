@@ -0,0 +1,42 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// godebug returns the value of the named setting in the GODEBUG environment
+// variable, or "" if it is not set. As with the runtime, the last occurrence
+// of a setting wins.
+//
+// Upstream reads settings through internal/godebug, which can not be imported
+// from outside the standard library.
+func godebug(name string) string {
+	var value string
+	for _, kv := range strings.Split(os.Getenv("GODEBUG"), ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok && k == name {
+			value = v
+		}
+	}
+	return value
+}
+
+// isLocal reports whether name, a slash-separated archive path, is local as
+// defined by filepath.IsLocal: it is not empty, not absolute, and does not
+// escape its root directory by way of "..".
+func isLocal(name string) bool {
+	if name == "" || filepath.IsAbs(filepath.FromSlash(name)) || strings.HasPrefix(name, "/") {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(filepath.Clean(filepath.FromSlash(name))), "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
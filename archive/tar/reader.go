@@ -28,6 +28,11 @@ type Reader struct {
 
 	RawAccounting bool          // Whether to enable the access needed to reassemble the tar from raw bytes. Some performance/memory hit for this.
 	rawBytes      *bytes.Buffer // last raw bits
+
+	// MaxRawBytes, when greater than zero, caps how many raw bytes are
+	// buffered for RawBytes while RawAccounting is enabled. Headers, their
+	// extensions and padding beyond it fail with ErrRawTooLong.
+	MaxRawBytes int64
 }
 
 type fileReader interface {
@@ -56,6 +61,53 @@ func (tr *Reader) RawBytes() []byte {
 
 }
 
+// recordRaw accounts b as raw bytes, when RawAccounting is enabled.
+func (tr *Reader) recordRaw(b []byte) error {
+	if !tr.RawAccounting {
+		return nil
+	}
+	if err := tr.checkRaw(int64(len(b))); err != nil {
+		return err
+	}
+	_, err := tr.rawBytes.Write(b)
+	return err
+}
+
+// checkRaw reports ErrRawTooLong if n more raw bytes would exceed MaxRawBytes.
+func (tr *Reader) checkRaw(n int64) error {
+	if tr.RawAccounting && tr.MaxRawBytes > 0 && int64(tr.rawBytes.Len())+n > tr.MaxRawBytes {
+		return ErrRawTooLong
+	}
+	return nil
+}
+
+// SkipPayload skips what is left of the payload of the current file, by
+// seeking the underlying io.Reader past it rather than reading it, such as once
+// the payload has been copied out of the underlying file by other means. The
+// bytes skipped are not raw bytes, as RawAccounting would account them.
+//
+// It returns false, skipping nothing, if the current file is sparse or the
+// underlying io.Reader is not an io.Seeker.
+func (tr *Reader) SkipPayload() (bool, error) {
+	if tr.err != nil {
+		return false, tr.err
+	}
+	fr, ok := tr.curr.(*regFileReader)
+	if !ok {
+		return false, nil
+	}
+	sr, ok := tr.r.(io.Seeker)
+	if !ok {
+		return false, nil
+	}
+	if _, err := sr.Seek(fr.nb, io.SeekCurrent); err != nil {
+		tr.err = err
+		return false, err
+	}
+	fr.nb = 0
+	return true, nil
+}
+
 // NewReader creates a new Reader reading from r.
 func NewReader(r io.Reader) *Reader {
 	return &Reader{r: r, curr: &regFileReader{r, 0}}
@@ -64,14 +116,26 @@ func NewReader(r io.Reader) *Reader {
 // Next advances to the next entry in the tar archive.
 // The Header.Size determines how many bytes can be read for the next file.
 // Any remaining data in the current file is automatically discarded.
+// At the end of the archive, Next returns the error io.EOF.
 //
-// io.EOF is returned at the end of the input.
+// If Next encounters a non-local file name (as defined by filepath.IsLocal)
+// and the GODEBUG environment variable contains `tarinsecurepath=0`,
+// Next returns the header with an ErrInsecurePath error.
+// Only file names are validated, not link targets.
+// A future version of Go may introduce this behavior by default.
+// Programs that want to accept non-local names can ignore
+// the ErrInsecurePath error and use the returned header.
 func (tr *Reader) Next() (*Header, error) {
 	if tr.err != nil {
 		return nil, tr.err
 	}
 	hdr, err := tr.next()
 	tr.err = err
+	if err == nil && !isLocal(hdr.Name) {
+		if godebug("tarinsecurepath") == "0" {
+			err = ErrInsecurePath
+		}
+	}
 	return hdr, err
 }
 
@@ -102,8 +166,8 @@ func (tr *Reader) next() (*Header, error) {
 		if err != nil {
 			return nil, err
 		}
-		if tr.RawAccounting {
-			tr.rawBytes.Write(tr.blk[:n])
+		if err := tr.recordRaw(tr.blk[:n]); err != nil {
+			return nil, err
 		}
 		tr.pad = 0
 
@@ -120,6 +184,9 @@ func (tr *Reader) next() (*Header, error) {
 		switch hdr.Typeflag {
 		case TypeXHeader, TypeXGlobalHeader:
 			format.mayOnlyBe(FormatPAX)
+			if err := tr.checkRaw(hdr.Size); err != nil {
+				return nil, err
+			}
 			paxHdrs, err = parsePAX(tr)
 			if err != nil {
 				return nil, err
@@ -137,13 +204,16 @@ func (tr *Reader) next() (*Header, error) {
 			continue // This is a meta header affecting the next header
 		case TypeGNULongName, TypeGNULongLink:
 			format.mayOnlyBe(FormatGNU)
-			realname, err := io.ReadAll(tr)
+			if err := tr.checkRaw(hdr.Size); err != nil {
+				return nil, err
+			}
+			realname, err := readSpecialFile(tr)
 			if err != nil {
 				return nil, err
 			}
 
-			if tr.RawAccounting {
-				tr.rawBytes.Write(realname)
+			if err := tr.recordRaw(realname); err != nil {
+				return nil, err
 			}
 
 			var p parser
@@ -329,15 +399,15 @@ func mergePAX(hdr *Header, paxHdrs map[string]string) (err error) {
 }
 
 // parsePAX parses PAX headers.
-// If an extended header (type 'x') is invalid, ErrHeader is returned
+// If an extended header (type 'x') is invalid, ErrHeader is returned.
 func parsePAX(r io.Reader) (map[string]string, error) {
-	buf, err := io.ReadAll(r)
+	buf, err := readSpecialFile(r)
 	if err != nil {
 		return nil, err
 	}
 	// leaving this function for io.Reader makes it more testable
-	if tr, ok := r.(*Reader); ok && tr.RawAccounting {
-		if _, err = tr.rawBytes.Write(buf); err != nil {
+	if tr, ok := r.(*Reader); ok {
+		if err := tr.recordRaw(buf); err != nil {
 			return nil, err
 		}
 	}
@@ -386,8 +456,10 @@ func parsePAX(r io.Reader) (map[string]string, error) {
 func (tr *Reader) readHeader() (*Header, *block, error) {
 	// Two blocks of zero bytes marks the end of the archive.
 	n, err := io.ReadFull(tr.r, tr.blk[:])
-	if tr.RawAccounting && (err == nil || err == io.EOF) {
-		tr.rawBytes.Write(tr.blk[:n])
+	if err == nil || err == io.EOF {
+		if err := tr.recordRaw(tr.blk[:n]); err != nil {
+			return nil, nil, err
+		}
 	}
 	if err != nil {
 		return nil, nil, err // EOF is okay here; exactly 0 bytes read
@@ -395,8 +467,10 @@ func (tr *Reader) readHeader() (*Header, *block, error) {
 
 	if bytes.Equal(tr.blk[:], zeroBlock[:]) {
 		n, err = io.ReadFull(tr.r, tr.blk[:])
-		if tr.RawAccounting && (err == nil || err == io.EOF) {
-			tr.rawBytes.Write(tr.blk[:n])
+		if err == nil || err == io.EOF {
+			if err := tr.recordRaw(tr.blk[:n]); err != nil {
+				return nil, nil, err
+			}
 		}
 		if err != nil {
 			return nil, nil, err // EOF is okay here; exactly 1 block of zeros read
@@ -530,7 +604,8 @@ func (tr *Reader) readOldGNUSparseMap(hdr *Header, blk *block) (sparseDatas, err
 	}
 	s := blk.toGNU().sparse()
 	spd := make(sparseDatas, 0, s.maxEntries())
-	for {
+	totalSize := len(s)
+	for totalSize < maxSpecialFileSize {
 		for i := 0; i < s.maxEntries(); i++ {
 			// This termination condition is identical to GNU and BSD tar.
 			if s.entry(i).offset()[0] == 0x00 {
@@ -541,7 +616,11 @@ func (tr *Reader) readOldGNUSparseMap(hdr *Header, blk *block) (sparseDatas, err
 			if p.err != nil {
 				return nil, p.err
 			}
-			spd = append(spd, sparseEntry{Offset: offset, Length: length})
+			var err error
+			spd, err = appendSparseEntry(spd, sparseEntry{Offset: offset, Length: length})
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		if s.isExtended()[0] > 0 {
@@ -549,14 +628,16 @@ func (tr *Reader) readOldGNUSparseMap(hdr *Header, blk *block) (sparseDatas, err
 			if _, err := mustReadFull(tr.r, blk[:]); err != nil {
 				return nil, err
 			}
-			if tr.RawAccounting {
-				tr.rawBytes.Write(blk[:])
+			if err := tr.recordRaw(blk[:]); err != nil {
+				return nil, err
 			}
 			s = blk.toSparse()
+			totalSize += len(s)
 			continue
 		}
 		return spd, nil // Done
 	}
+	return nil, errSparseTooLong
 }
 
 // readGNUSparseMap1x0 reads the sparse map as stored in GNU's PAX sparse format
@@ -574,12 +655,17 @@ func readGNUSparseMap1x0(r io.Reader) (sparseDatas, error) {
 		cntNewline int64
 		buf        bytes.Buffer
 		blk        block
+		totalSize  int
 	)
 
 	// feedTokens copies data in blocks from r into buf until there are
 	// at least cnt newlines in buf. It will not read more blocks than needed.
 	feedTokens := func(n int64) error {
 		for cntNewline < n {
+			totalSize += len(blk)
+			if totalSize > maxSpecialFileSize {
+				return errSparseTooLong
+			}
 			if _, err := mustReadFull(r, blk[:]); err != nil {
 				return err
 			}
@@ -612,8 +698,8 @@ func readGNUSparseMap1x0(r io.Reader) (sparseDatas, error) {
 	}
 
 	// Parse for all member entries.
-	// numEntries is trusted after this since a potential attacker must have
-	// committed resources proportional to what this library used.
+	// numEntries is trusted after this since feedTokens limits the number of
+	// tokens based on maxSpecialFileSize.
 	if err := feedTokens(2 * numEntries); err != nil {
 		return nil, err
 	}
@@ -624,7 +710,10 @@ func readGNUSparseMap1x0(r io.Reader) (sparseDatas, error) {
 		if err1 != nil || err2 != nil {
 			return nil, ErrHeader
 		}
-		spd = append(spd, sparseEntry{Offset: offset, Length: length})
+		spd, err = appendSparseEntry(spd, sparseEntry{Offset: offset, Length: length})
+		if err != nil {
+			return nil, err
+		}
 	}
 	return spd, nil
 }
@@ -658,12 +747,22 @@ func readGNUSparseMap0x1(paxHdrs map[string]string) (sparseDatas, error) {
 		if err1 != nil || err2 != nil {
 			return nil, ErrHeader
 		}
-		spd = append(spd, sparseEntry{Offset: offset, Length: length})
+		spd, err = appendSparseEntry(spd, sparseEntry{Offset: offset, Length: length})
+		if err != nil {
+			return nil, err
+		}
 		sparseMap = sparseMap[2:]
 	}
 	return spd, nil
 }
 
+func appendSparseEntry(spd sparseDatas, ent sparseEntry) (sparseDatas, error) {
+	if len(spd) >= maxSparseFileEntries {
+		return nil, errSparseTooLong
+	}
+	return append(spd, ent), nil
+}
+
 // Read reads from the current file in the tar archive.
 // It returns (0, io.EOF) when it reaches the end of that file,
 // until Next is called to advance to the next file.
@@ -739,7 +838,7 @@ func (fr regFileReader) logicalRemaining() int64 {
 	return fr.nb
 }
 
-// logicalRemaining implements fileState.physicalRemaining.
+// physicalRemaining implements fileState.physicalRemaining.
 func (fr regFileReader) physicalRemaining() int64 {
 	return fr.nb
 }
@@ -884,12 +983,25 @@ func tryReadFull(r io.Reader, b []byte) (n int, err error) {
 	return n, err
 }
 
+// readSpecialFile is like io.ReadAll except it returns
+// ErrFieldTooLong if more than maxSpecialFileSize is read.
+func readSpecialFile(r io.Reader) ([]byte, error) {
+	buf, err := io.ReadAll(io.LimitReader(r, maxSpecialFileSize+1))
+	if len(buf) > maxSpecialFileSize {
+		return nil, ErrFieldTooLong
+	}
+	return buf, err
+}
+
 // discard skips n bytes in r, reporting an error if unable to do so.
 func discard(tr *Reader, n int64) error {
 	var seekSkipped, copySkipped int64
 	var err error
 	r := tr.r
 	if tr.RawAccounting {
+		if err := tr.checkRaw(n); err != nil {
+			return err
+		}
 		copySkipped, err = io.CopyN(tr.rawBytes, tr.r, n)
 		goto out
 	}
@@ -6,6 +6,7 @@ package tar
 
 import (
 	"bytes"
+	"compress/bzip2"
 	"crypto/md5"
 	"errors"
 	"fmt"
@@ -243,6 +244,9 @@ func TestReader(t *testing.T) {
 	}, {
 		file: "testdata/pax-bad-hdr-file.tar",
 		err:  ErrHeader,
+	}, {
+		file: "testdata/pax-bad-hdr-large.tar.bz2",
+		err:  ErrFieldTooLong,
 	}, {
 		file: "testdata/pax-bad-mtime-file.tar",
 		err:  ErrHeader,
@@ -615,6 +619,11 @@ func TestReader(t *testing.T) {
 			},
 			Format: FormatPAX,
 		}},
+	}, {
+		// Small compressed file that uncompresses to
+		// a file with a very large GNU 1.0 sparse map.
+		file: "testdata/gnu-sparse-many-zeros.tar.bz2",
+		err:  errSparseTooLong,
 	}}
 
 	for _, v := range vectors {
@@ -625,9 +634,14 @@ func TestReader(t *testing.T) {
 			}
 			defer f.Close()
 
+			var fr io.Reader = f
+			if strings.HasSuffix(v.file, ".bz2") {
+				fr = bzip2.NewReader(fr)
+			}
+
 			// Capture all headers and checksums.
 			var (
-				tr      = NewReader(f)
+				tr      = NewReader(fr)
 				hdrs    []*Header
 				chksums []string
 				rdbuf   = make([]byte, 8)
@@ -1119,6 +1133,17 @@ func TestReadOldGNUSparseMap(t *testing.T) {
 		input: makeInput(FormatGNU, "",
 			makeSparseStrings(sparseDatas{{10 << 30, 512}, {20 << 30, 512}})...),
 		wantMap: sparseDatas{{10 << 30, 512}, {20 << 30, 512}},
+	}, {
+		input: makeInput(FormatGNU, "",
+			makeSparseStrings(func() sparseDatas {
+				var datas sparseDatas
+				// This is more than enough entries to exceed our limit.
+				for i := int64(0); i < 1<<20; i++ {
+					datas = append(datas, sparseEntry{i * 2, (i * 2) + 1})
+				}
+				return datas
+			}())...),
+		wantErr: errSparseTooLong,
 	}}
 
 	for i, v := range vectors {
@@ -1608,3 +1633,154 @@ func TestFileReader(t *testing.T) {
 		}
 	}
 }
+
+func TestInsecurePaths(t *testing.T) {
+	t.Setenv("GODEBUG", "tarinsecurepath=0")
+	for _, path := range []string{
+		"../foo",
+		"/foo",
+		"a/b/../../../c",
+	} {
+		var buf bytes.Buffer
+		tw := NewWriter(&buf)
+		tw.WriteHeader(&Header{
+			Name: path,
+		})
+		const securePath = "secure"
+		tw.WriteHeader(&Header{
+			Name: securePath,
+		})
+		tw.Close()
+
+		tr := NewReader(&buf)
+		h, err := tr.Next()
+		if err != ErrInsecurePath {
+			t.Errorf("tr.Next for file %q: got err %v, want ErrInsecurePath", path, err)
+			continue
+		}
+		if h.Name != path {
+			t.Errorf("tr.Next for file %q: got name %q, want %q", path, h.Name, path)
+		}
+		// Error should not be sticky.
+		h, err = tr.Next()
+		if err != nil {
+			t.Errorf("tr.Next for file %q: got err %v, want nil", securePath, err)
+		}
+		if h.Name != securePath {
+			t.Errorf("tr.Next for file %q: got name %q, want %q", securePath, h.Name, securePath)
+		}
+	}
+}
+
+func TestDisableInsecurePathCheck(t *testing.T) {
+	t.Setenv("GODEBUG", "tarinsecurepath=1")
+	var buf bytes.Buffer
+	tw := NewWriter(&buf)
+	const name = "/foo"
+	tw.WriteHeader(&Header{
+		Name: name,
+	})
+	tw.Close()
+	tr := NewReader(&buf)
+	h, err := tr.Next()
+	if err != nil {
+		t.Fatalf("tr.Next with tarinsecurepath=1: got err %v, want nil", err)
+	}
+	if h.Name != name {
+		t.Fatalf("tr.Next with tarinsecurepath=1: got name %q, want %q", h.Name, name)
+	}
+}
+
+func TestReaderMaxRawBytes(t *testing.T) {
+	var buf bytes.Buffer
+	tw := NewWriter(&buf)
+	if err := tw.WriteHeader(&Header{
+		Name:       "file",
+		Typeflag:   TypeReg,
+		PAXRecords: map[string]string{"GOLANG.pad": strings.Repeat("a", 4096)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vectors := []struct {
+		max     int64
+		wantErr error
+	}{
+		{0, nil},
+		{1 << 20, nil},
+		{2 * blockSize, ErrRawTooLong},
+		{blockSize, ErrRawTooLong},
+	}
+	for _, v := range vectors {
+		tr := NewReader(bytes.NewReader(buf.Bytes()))
+		tr.RawAccounting = true
+		tr.MaxRawBytes = v.max
+		_, err := tr.Next()
+		if err != v.wantErr {
+			t.Errorf("MaxRawBytes %d: got err %v, want %v", v.max, err, v.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if n := int64(len(tr.RawBytes())); v.max > 0 && n > v.max {
+			t.Errorf("MaxRawBytes %d: buffered %d raw bytes", v.max, n)
+		}
+	}
+
+	// the limit only applies with raw accounting
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.MaxRawBytes = blockSize
+	if _, err := tr.Next(); err != nil {
+		t.Errorf("MaxRawBytes without RawAccounting: got err %v, want nil", err)
+	}
+}
+
+func TestReaderSkipPayload(t *testing.T) {
+	var buf bytes.Buffer
+	tw := NewWriter(&buf)
+	for _, name := range []string{"first", "second"} {
+		body := strings.Repeat(name, 200)
+		if err := tw.WriteHeader(&Header{Name: name, Typeflag: TypeReg, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.RawAccounting = true
+	if _, err := tr.Next(); err != nil {
+		t.Fatal(err)
+	}
+	tr.RawBytes()
+	if skipped, err := tr.SkipPayload(); !skipped || err != nil {
+		t.Fatalf("SkipPayload: got %v, %v, want true, nil", skipped, err)
+	}
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "second" {
+		t.Errorf("got name %q, want %q", hdr.Name, "second")
+	}
+	// only the padding of the skipped payload and the next header are raw
+	if n := len(tr.RawBytes()); n != blockSize+blockSize-1000%blockSize {
+		t.Errorf("got %d raw bytes, want %d", n, blockSize+blockSize-1000%blockSize)
+	}
+
+	// without seeking, nothing is skipped
+	tr = NewReader(struct{ io.Reader }{bytes.NewReader(buf.Bytes())})
+	if _, err := tr.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if skipped, err := tr.SkipPayload(); skipped || err != nil {
+		t.Errorf("SkipPayload without io.Seeker: got %v, %v, want false, nil", skipped, err)
+	}
+}
@@ -5,8 +5,11 @@
 package tar
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"path"
 	"sort"
 	"strings"
@@ -27,6 +30,9 @@ type Writer struct {
 	// It is only the responsibility of every exported method of Writer to
 	// ensure that this error is sticky.
 	err error
+
+	RawAccounting bool          // Whether to enable the access needed to account for the raw bytes written. Some performance/memory hit for this.
+	rawBytes      *bytes.Buffer // last raw bits
 }
 
 // NewWriter creates a new Writer writing to w.
@@ -34,6 +40,40 @@ func NewWriter(w io.Writer) *Writer {
 	return &Writer{w: w, curr: &regFileWriter{w, 0}}
 }
 
+// RawBytes accesses the raw bytes written to the archive, apart from the file
+// payload itself. This includes the headers, PAX and GNU extension records,
+// padding and the end-of-archive trailer, as written since the last call.
+// The payload is whatever the caller passed to Write, so it can be accounted
+// for separately.
+//
+// # This call resets the current rawbytes buffer
+//
+// The returned slice is only valid until the next write to the archive.
+// Only when RawAccounting is enabled, otherwise this returns nil
+func (tw *Writer) RawBytes() []byte {
+	if !tw.RawAccounting {
+		return nil
+	}
+	if tw.rawBytes == nil {
+		tw.rawBytes = bytes.NewBuffer(nil)
+	}
+	defer tw.rawBytes.Reset() // if we've read them, then flush them.
+
+	return tw.rawBytes.Bytes()
+}
+
+// writeRaw writes b to the underlying writer, accounting for it as raw bytes.
+func (tw *Writer) writeRaw(b []byte) (int, error) {
+	n, err := tw.w.Write(b)
+	if tw.RawAccounting {
+		if tw.rawBytes == nil {
+			tw.rawBytes = bytes.NewBuffer(nil)
+		}
+		tw.rawBytes.Write(b[:n])
+	}
+	return n, err
+}
+
 type fileWriter interface {
 	io.Writer
 	fileState
@@ -53,7 +93,7 @@ func (tw *Writer) Flush() error {
 	if nb := tw.curr.logicalRemaining(); nb > 0 {
 		return fmt.Errorf("archive/tar: missed writing %d bytes", nb)
 	}
-	if _, tw.err = tw.w.Write(zeroBlock[:tw.pad]); tw.err != nil {
+	if _, tw.err = tw.writeRaw(zeroBlock[:tw.pad]); tw.err != nil {
 		return tw.err
 	}
 	tw.pad = 0
@@ -199,6 +239,9 @@ func (tw *Writer) writePAXHeader(hdr *Header, paxHdrs map[string]string) error {
 			flag = TypeXHeader
 		}
 		data := buf.String()
+		if len(data) > maxSpecialFileSize {
+			return ErrFieldTooLong
+		}
 		if err := tw.writeRawFile(name, data, flag, FormatPAX); err != nil || isGlobal {
 			return err // Global headers return here
 		}
@@ -301,7 +344,7 @@ func (tw *Writer) writeGNUHeader(hdr *Header) error {
 	// Write the extended sparse map and setup the sparse writer if necessary.
 	if len(spd) > 0 {
 		// Use tw.w since the sparse map is not accounted for in hdr.Size.
-		if _, err := tw.w.Write(spb); err != nil {
+		if _, err := tw.writeRaw(spb); err != nil {
 			return err
 		}
 		tw.curr = &sparseFileWriter{tw.curr, spd, 0}
@@ -379,6 +422,10 @@ func (tw *Writer) writeRawFile(name, data string, flag byte, format Format) erro
 		return err
 	}
 	_, err := io.WriteString(tw, data)
+	if err == nil && tw.RawAccounting {
+		// the extension records are part of the raw bytes, not a payload
+		tw.rawBytes.WriteString(data)
+	}
 	return err
 }
 
@@ -389,7 +436,7 @@ func (tw *Writer) writeRawHeader(blk *block, size int64, flag byte) error {
 	if err := tw.Flush(); err != nil {
 		return err
 	}
-	if _, err := tw.w.Write(blk[:]); err != nil {
+	if _, err := tw.writeRaw(blk[:]); err != nil {
 		return err
 	}
 	if isHeaderOnlyType(flag) {
@@ -400,6 +447,63 @@ func (tw *Writer) writeRawHeader(blk *block, size int64, flag byte) error {
 	return nil
 }
 
+// AddFS adds the files from fs.FS to the archive.
+// It walks the directory tree starting at the root of the filesystem
+// adding each file to the tar archive while maintaining the directory structure.
+//
+// Symbolic links are only supported when fsys has a
+// `ReadLink(name string) (string, error)` method, as fs.ReadLinkFS does.
+func (tw *Writer) AddFS(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		linkTarget := ""
+		if typ := d.Type(); typ == fs.ModeSymlink {
+			rl, ok := fsys.(interface {
+				ReadLink(name string) (string, error)
+			})
+			if !ok {
+				return errors.New("tar: cannot add symlink from a filesystem without ReadLink")
+			}
+			linkTarget, err = rl.ReadLink(name)
+			if err != nil {
+				return err
+			}
+		} else if !typ.IsRegular() && typ != fs.ModeDir {
+			return errors.New("tar: cannot add non-regular file")
+		}
+		h, err := FileInfoHeader(info, linkTarget)
+		if err != nil {
+			return err
+		}
+		h.Name = name
+		if d.IsDir() {
+			h.Name += "/"
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
 // splitUSTARPath splits a path according to USTAR prefix and suffix rules.
 // If the path is not splittable, then it will return ("", "", false).
 func splitUSTARPath(name string) (prefix, suffix string, ok bool) {
@@ -474,7 +578,7 @@ func (tw *Writer) Close() error {
 	// Trailer: two zero blocks.
 	err := tw.Flush()
 	for i := 0; i < 2 && err == nil; i++ {
-		_, err = tw.w.Write(zeroBlock[:])
+		_, err = tw.writeRaw(zeroBlock[:])
 	}
 
 	// Ensure all future actions are invalid.
@@ -516,7 +620,7 @@ func (fw regFileWriter) logicalRemaining() int64 {
 	return fw.nb
 }
 
-// logicalRemaining implements fileState.physicalRemaining.
+// physicalRemaining implements fileState.physicalRemaining.
 func (fw regFileWriter) physicalRemaining() int64 {
 	return fw.nb
 }
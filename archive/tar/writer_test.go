@@ -9,12 +9,14 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"io/fs"
 	"os"
 	"path"
 	"reflect"
 	"sort"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"testing/iotest"
 	"time"
 )
@@ -823,6 +825,64 @@ func TestValidTypeflagWithPAXHeader(t *testing.T) {
 	}
 }
 
+func TestWriterRawAccounting(t *testing.T) {
+	var buffer bytes.Buffer
+	tw := NewWriter(&buffer)
+	tw.RawAccounting = true
+
+	files := []struct {
+		hdr  Header
+		data string
+	}{
+		{Header{Name: "short.txt", Mode: 0644, Size: 5}, "hello"},
+		{Header{Name: strings.Repeat("long/", 40) + "pax.txt", Mode: 0644, Size: 3, Format: FormatPAX}, "pax"},
+		{Header{Name: strings.Repeat("long/", 40) + "gnu.txt", Mode: 0644, Size: 3, Format: FormatGNU}, "gnu"},
+		{Header{Name: "dir/", Typeflag: TypeDir, Mode: 0755}, ""},
+	}
+
+	// Every byte written must be in either the raw bytes or a payload.
+	var rebuilt bytes.Buffer
+	for _, f := range files {
+		hdr := f.hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("WriteHeader(%q): %v", hdr.Name, err)
+		}
+		raw := tw.RawBytes()
+		if len(raw) < blockSize {
+			t.Errorf("raw bytes for %q: got %d bytes, want at least a header block", hdr.Name, len(raw))
+		}
+		rebuilt.Write(raw)
+		if _, err := io.WriteString(tw, f.data); err != nil {
+			t.Fatalf("Write(%q): %v", hdr.Name, err)
+		}
+		if raw := tw.RawBytes(); len(raw) != 0 {
+			t.Errorf("payload of %q was accounted as %d raw bytes", hdr.Name, len(raw))
+		}
+		rebuilt.WriteString(f.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw := tw.RawBytes()
+	if len(raw) != 2*blockSize {
+		t.Errorf("trailer: got %d raw bytes, want %d", len(raw), 2*blockSize)
+	}
+	rebuilt.Write(raw)
+
+	if !bytes.Equal(rebuilt.Bytes(), buffer.Bytes()) {
+		t.Errorf("raw bytes and payloads do not rebuild the archive:\n%s", bytediff(rebuilt.Bytes(), buffer.Bytes()))
+	}
+
+	// Without accounting, there is nothing to report.
+	tw = NewWriter(io.Discard)
+	if err := tw.WriteHeader(&Header{Name: "file", Size: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if raw := tw.RawBytes(); raw != nil {
+		t.Errorf("RawBytes without RawAccounting: got %d bytes, want nil", len(raw))
+	}
+}
+
 // failOnceWriter fails exactly once and then always reports success.
 type failOnceWriter bool
 
@@ -1004,6 +1064,33 @@ func TestIssue12594(t *testing.T) {
 	}
 }
 
+func TestWriteLongHeader(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		h    *Header
+	}{{
+		name: "name too long",
+		h:    &Header{Name: strings.Repeat("a", maxSpecialFileSize)},
+	}, {
+		name: "linkname too long",
+		h:    &Header{Linkname: strings.Repeat("a", maxSpecialFileSize)},
+	}, {
+		name: "uname too long",
+		h:    &Header{Uname: strings.Repeat("a", maxSpecialFileSize)},
+	}, {
+		name: "gname too long",
+		h:    &Header{Gname: strings.Repeat("a", maxSpecialFileSize)},
+	}, {
+		name: "PAX header too long",
+		h:    &Header{PAXRecords: map[string]string{"GOLANG.x": strings.Repeat("a", maxSpecialFileSize)}},
+	}} {
+		w := NewWriter(io.Discard)
+		if err := w.WriteHeader(test.h); err != ErrFieldTooLong {
+			t.Errorf("%v: w.WriteHeader() = %v, want ErrFieldTooLong", test.name, err)
+		}
+	}
+}
+
 // testNonEmptyWriter wraps an io.Writer and ensures that
 // Write is never called with an empty buffer.
 type testNonEmptyWriter struct{ io.Writer }
@@ -1306,3 +1393,91 @@ func TestFileWriter(t *testing.T) {
 		}
 	}
 }
+
+func TestWriterAddFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"emptyfolder":          {Mode: 0o755 | os.ModeDir},
+		"file.go":              {Data: []byte("hello")},
+		"subfolder/another.go": {Data: []byte("world")},
+		// Notably missing here is the "subfolder" directory. This makes sure even
+		// if we don't have a subfolder directory listed.
+	}
+	var buf bytes.Buffer
+	tw := NewWriter(&buf)
+	if err := tw.AddFS(fsys); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subfolder into fsys to match what we'll read from the tar.
+	fsys["subfolder"] = &fstest.MapFile{Mode: 0o555 | os.ModeDir}
+
+	// Test that we can get the files back from the archive
+	tr := NewReader(&buf)
+
+	names := make([]string, 0, len(fsys))
+	for name := range fsys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entriesLeft := len(fsys)
+	for _, name := range names {
+		entriesLeft--
+
+		entryInfo, err := fs.Stat(fsys, name)
+		if err != nil {
+			t.Fatalf("getting entry info error: %v", err)
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break // End of archive
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tmpName := name
+		if entryInfo.IsDir() {
+			tmpName += "/"
+		}
+		if hdr.Name != tmpName {
+			t.Errorf("test fs has filename %v; archive header has %v",
+				name, hdr.Name)
+		}
+
+		if entryInfo.Mode() != hdr.FileInfo().Mode() {
+			t.Errorf("%s: test fs has mode %v; archive header has %v",
+				name, entryInfo.Mode(), hdr.FileInfo().Mode())
+		}
+
+		if entryInfo.IsDir() {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		origdata := fsys[name].Data
+		if string(data) != string(origdata) {
+			t.Fatalf("test fs has file content %v; archive header has %v", origdata, data)
+		}
+	}
+	if entriesLeft > 0 {
+		t.Fatalf("not all entries are in the archive")
+	}
+}
+
+func TestWriterAddFSNonRegularFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"device":  {Data: []byte("hello"), Mode: 0755 | fs.ModeDevice},
+		"symlink": {Data: []byte("world"), Mode: 0755 | fs.ModeSymlink},
+	}
+	var buf bytes.Buffer
+	tw := NewWriter(&buf)
+	if err := tw.AddFS(fsys); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"compress/gzip"
 	"io"
 	"os"
+	"os/exec"
+	"strings"
 
 	"github.com/bmoylan/tar-split/tar/asm"
 	"github.com/bmoylan/tar-split/tar/storage"
@@ -16,17 +18,22 @@ func CommandAsm(c *cli.Context) {
 	if len(c.Args()) > 0 {
 		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args()))
 	}
-	if len(c.String("input")) == 0 {
-		logrus.Fatalf("--input filename must be set")
-	}
 	if len(c.String("output")) == 0 {
 		logrus.Fatalf("--output filename must be set ([FILENAME|-])")
 	}
-	if len(c.String("path")) == 0 {
-		logrus.Fatalf("--path must be set")
+	if len(c.String("bundle")) == 0 {
+		if len(c.String("input")) == 0 {
+			logrus.Fatalf("--input filename must be set")
+		}
+		if len(c.String("path")) == 0 && len(c.String("store")) == 0 && len(c.String("tar")) == 0 && len(c.String("url")) == 0 && len(c.String("getter-exec")) == 0 {
+			logrus.Fatalf("--path, --store, --tar, --url or --getter-exec must be set")
+		}
 	}
 
-	var outputStream io.Writer
+	var (
+		outputStream io.Writer
+		outputFile   *os.File
+	)
 	if c.String("output") == "-" {
 		outputStream = os.Stdout
 	} else {
@@ -35,39 +42,156 @@ func CommandAsm(c *cli.Context) {
 			logrus.Fatal(err)
 		}
 		defer safeClose(fh)
-		outputStream = fh
+		outputStream, outputFile = fh, fh
 	}
 
 	if c.Bool("compress") {
 		zipper := gzip.NewWriter(outputStream)
 		defer safeClose(zipper)
-		outputStream = zipper
+		outputStream, outputFile = zipper, nil
 	}
 
-	// Get the tar metadata reader
-	mf, err := os.Open(c.String("input"))
-	if err != nil {
-		logrus.Fatal(err)
+	// Get the tar metadata reader, and where the file payloads are
+	var (
+		metadata   io.Reader
+		fileGetter storage.FileGetter
+		source     string
+	)
+	if len(c.String("bundle")) > 0 {
+		br, closer, err := openBundle(c.String("bundle"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(closer)
+		mr, err := br.Metadata()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(mr)
+		metadata, fileGetter, source = mr, br, c.String("bundle")
+	} else {
+		mf, err := os.Open(c.String("input"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(mf)
+		mfz, err := storage.NewGzipReaderWithLimit(mf, c.Int64("max-ratio"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(mfz)
+		metadata = mfz
+
+		// payloads come from each of the sources given in turn
+		var getters []storage.FileGetter
+		var sources []string
+		if len(c.String("path")) > 0 {
+			// XXX maybe get the absolute path here
+			getters = append(getters, storage.NewPathFileGetter(c.String("path")))
+			sources = append(sources, c.String("path"))
+		}
+		if len(c.String("store")) > 0 {
+			cs, err := storage.NewChecksumStore(c.String("store"))
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			getters = append(getters, cs)
+			sources = append(sources, c.String("store"))
+		}
+		if len(c.String("tar")) > 0 {
+			tf, err := os.Open(c.String("tar"))
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			defer safeClose(tf)
+			tfg, err := storage.NewTarFileGetter(tf)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			getters = append(getters, tfg)
+			sources = append(sources, c.String("tar"))
+		}
+		if len(c.String("url")) > 0 {
+			getters = append(getters, storage.NewHTTPFileGetter(c.String("url")))
+			sources = append(sources, c.String("url"))
+		}
+		if len(c.String("getter-exec")) > 0 {
+			efg, err := storage.NewExecFileGetter(helperCommand(c.String("getter-exec")))
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			defer safeClose(efg)
+			getters = append(getters, efg)
+			sources = append(sources, c.String("getter-exec"))
+		}
+		fileGetter = getters[0]
+		if len(getters) > 1 {
+			chain := storage.NewChainFileGetter(getters...)
+			defer func() {
+				for i, stats := range chain.Stats() {
+					logrus.Debugf("%s: %+v", sources[i], stats)
+				}
+			}()
+			fileGetter = chain
+		}
+		source = strings.Join(sources, ", ") + " and " + c.String("input")
 	}
-	defer safeClose(mf)
-	mfz, err := gzip.NewReader(mf)
-	if err != nil {
-		logrus.Fatal(err)
+	metaUnpacker := storage.NewJSONUnpackerWithLimit(metadata, c.Int64("max-entry-size"))
+
+	var i int64
+	if len(c.StringSlice("include")) > 0 {
+		filter, err := asm.GlobFilter(c.StringSlice("include")...)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			_ = pw.CloseWithError(asm.WriteOutputTarSubset(fileGetter, metaUnpacker, pw, filter))
+		}()
+		defer safeClose(pr)
+		i, err = io.Copy(outputStream, pr)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	} else if outputFile != nil && c.Int("workers") > 1 {
+		size, err := asm.WriteOutputTarAt(fileGetter, metaUnpacker, outputFile, c.Int("workers"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		i = size
+	} else if outputFile != nil {
+		// written straight to the file, payloads can be copied in the kernel
+		if err := asm.WriteOutputTarStream(fileGetter, metaUnpacker, outputFile); err != nil {
+			logrus.Fatal(err)
+		}
+		off, err := outputFile.Seek(0, io.SeekCurrent)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		i = off
+	} else {
+		ots := asm.NewOutputTarStream(fileGetter, metaUnpacker)
+		defer safeClose(ots)
+		var err error
+		i, err = io.Copy(outputStream, ots)
+		if err != nil {
+			logrus.Fatal(err)
+		}
 	}
-	defer safeClose(mfz)
 
-	metaUnpacker := storage.NewJSONUnpacker(mfz)
-	// XXX maybe get the absolute path here
-	fileGetter := storage.NewPathFileGetter(c.String("path"))
+	logrus.Infof("created %s from %s (wrote %d bytes)", c.String("output"), source, i)
+}
 
-	ots := asm.NewOutputTarStream(fileGetter, metaUnpacker)
-	defer safeClose(ots)
-	i, err := io.Copy(outputStream, ots)
-	if err != nil {
-		logrus.Fatal(err)
+// helperCommand returns the command of a payload helper process, given as its
+// arguments separated by spaces.
+func helperCommand(command string) *exec.Cmd {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		logrus.Fatalf("the command of a helper must not be empty")
 	}
-
-	logrus.Infof("created %s from %s and %s (wrote %d bytes)", c.String("output"), c.String("path"), c.String("input"), i)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	return cmd
 }
 
 func safeClose(closer io.Closer) {
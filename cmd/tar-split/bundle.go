@@ -0,0 +1,132 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/bmoylan/tar-split/tar/bundle"
+	"github.com/bmoylan/tar-split/tar/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// CommandBundleCreate provides the bundle create command.
+func CommandBundleCreate(c *cli.Context) {
+	if len(c.Args()) > 0 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args()))
+	}
+	if len(c.String("input")) == 0 {
+		logrus.Fatalf("--input metadata must be set")
+	}
+	if len(c.String("output")) == 0 {
+		logrus.Fatalf("--output filename must be set ([FILENAME|-])")
+	}
+	var fg storage.FileGetter
+	switch {
+	case len(c.String("store")) > 0 && len(c.String("path")) > 0:
+		logrus.Fatalf("only one of --store and --path can be set")
+	case len(c.String("store")) > 0:
+		cs, err := storage.NewChecksumStore(c.String("store"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fg = cs
+	case len(c.String("path")) > 0:
+		fg = storage.NewPathFileGetter(c.String("path"))
+	default:
+		logrus.Fatalf("--store or --path must be set")
+	}
+
+	mf, err := os.Open(c.String("input"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer safeClose(mf)
+	metadata, err := maybeGunzip(mf)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	var out io.Writer
+	if c.String("output") == "-" {
+		out = os.Stdout
+	} else {
+		fh, err := os.Create(c.String("output"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(fh)
+		out = fh
+	}
+	stats, err := bundle.Write(out, metadata, fg)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("created %s from %s (%d payloads, %dk)", c.String("output"), c.String("input"), stats.Payloads, stats.Bytes/1024)
+}
+
+// CommandBundleImport provides the bundle import command.
+func CommandBundleImport(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		logrus.Fatalf("please specify the bundle to import <NAME|->")
+	}
+	if len(c.String("store")) == 0 {
+		logrus.Fatalf("--store directory must be set")
+	}
+	if len(c.String("output")) == 0 {
+		logrus.Fatalf("--output filename must be set")
+	}
+	cs, err := storage.NewChecksumStoreWithOptions(c.String("store"), storage.StoreOptions{
+		Compression: c.String("compress"),
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	var in io.Reader
+	if c.Args()[0] == "-" {
+		in = os.Stdin
+	} else {
+		fh, err := os.Open(c.Args()[0])
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(fh)
+		in = fh
+	}
+
+	mf, err := os.OpenFile(c.String("output"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer safeClose(mf)
+	mfz := gzip.NewWriter(mf)
+	defer safeClose(mfz)
+
+	stats, err := bundle.Import(in, mfz, cs)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("imported %s into %s (%d payloads, %dk)", c.Args()[0], c.String("store"), stats.Payloads, stats.Bytes/1024)
+}
+
+// openBundle returns a reader of the bundle file name, to assemble from in
+// place.
+func openBundle(name string) (*bundle.Reader, io.Closer, error) {
+	fh, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		_ = fh.Close()
+		return nil, nil, err
+	}
+	br, err := bundle.NewReader(fh, fi.Size())
+	if err != nil {
+		_ = fh.Close()
+		return nil, nil, err
+	}
+	return br, fh, nil
+}
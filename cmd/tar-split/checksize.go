@@ -20,6 +20,16 @@ func CommandChecksize(c *cli.Context) {
 	if len(c.Args()) == 0 {
 		logrus.Fatalf("please specify tar archives to check ('-' will check stdin)")
 	}
+	if c.Bool("metadata") {
+		for _, arg := range c.Args() {
+			checkMetadataSize(arg)
+		}
+		return
+	}
+	opts := asm.DisassembleOptions{
+		InlineThreshold: c.Int64("inline-threshold"),
+		HeaderEntries:   c.Bool("header-entries"),
+	}
 	for _, arg := range c.Args() {
 		fh, err := os.Open(arg)
 		if err != nil {
@@ -32,79 +42,234 @@ func CommandChecksize(c *cli.Context) {
 		}
 		fmt.Printf("inspecting %q (size %dk)\n", fh.Name(), fi.Size()/1024)
 
-		packFh, err := os.CreateTemp("", "packed.")
-		if err != nil {
+		// the original packing, as a baseline
+		m := measureMetadata(c, fh, asm.DisassembleOptions{RawPadding: true})
+		fmt.Printf(" -- number of files: %d\n", m.files)
+		fmt.Printf(" -- size of metadata uncompressed: %dk\n", m.size/1024)
+		fmt.Printf(" -- size of gzip compressed metadata: %dk\n", m.gzSize/1024)
+
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
 			log.Fatal(err)
 		}
-		defer safeClose(packFh)
-		if !c.Bool("work") {
-			defer func() { _ = os.Remove(packFh.Name()) }()
-		} else {
-			fmt.Printf(" -- working file preserved: %s\n", packFh.Name())
+		o := measureMetadata(c, fh, opts)
+		fmt.Printf(" -- with zero runs packed as padding entries (%dk):\n", o.paddingSize/1024)
+		if opts.InlineThreshold > 0 {
+			fmt.Printf(" -- with payloads of at most %d bytes inlined:\n", opts.InlineThreshold)
+			fmt.Printf(" ---- files inlined: %d (%dk), left to the file store: %d\n", o.inlined, o.inlinedSize/1024, o.stored)
 		}
-
-		sp := storage.NewJSONPacker(packFh)
-		fp := storage.NewDiscardFilePutter()
-		dissam, err := asm.NewInputTarStream(fh, sp, fp)
-		if err != nil {
-			log.Fatal(err)
+		if opts.HeaderEntries {
+			fmt.Printf(" -- with headers stored as their fields:\n")
+			fmt.Printf(" ---- headers stored as fields: %d, as raw bytes: %d\n", o.headers, o.files-o.headers)
 		}
+		fmt.Printf(" ---- size of metadata uncompressed: %dk (%+dk)\n", o.size/1024, (o.size-m.size)/1024)
+		fmt.Printf(" ---- size of gzip compressed metadata: %dk (%+dk)\n", o.gzSize/1024, (o.gzSize-m.gzSize)/1024)
+	}
+}
 
-		var num int
-		tr := tar.NewReader(dissam)
-		for {
-			_, err = tr.Next()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				log.Fatal(err)
-			}
-			num++
-			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
-				log.Fatal(err)
-			}
-		}
-		fmt.Printf(" -- number of files: %d\n", num)
+// checkMetadataSize reports the size of the metadata file name, as it is and
+// without the payloads inlined at the threshold recorded in it.
+func checkMetadataSize(name string) {
+	fh, err := os.Open(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer safeClose(fh)
+	r, err := maybeGunzip(fh)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("inspecting metadata %q\n", fh.Name())
 
-		if err := packFh.Sync(); err != nil {
-			log.Fatal(err)
-		}
+	threshold, with, without := measureRecorded(r)
+	fmt.Printf(" -- number of files: %d\n", with.files)
+	if threshold > 0 {
+		fmt.Printf(" -- packed with payloads of at most %d bytes inlined:\n", threshold)
+		fmt.Printf(" ---- files inlined: %d (%dk), left to the file store: %d\n", with.inlined, with.inlinedSize/1024, with.stored)
+	} else {
+		fmt.Printf(" -- packed without payloads inlined\n")
+	}
+	fmt.Printf(" -- size of metadata uncompressed: %dk (%+dk inlined)\n", with.size/1024, (with.size-without.size)/1024)
+	fmt.Printf(" -- size of gzip compressed metadata: %dk (%+dk inlined)\n", with.gzSize/1024, (with.gzSize-without.gzSize)/1024)
+}
 
-		fi, err = packFh.Stat()
-		if err != nil {
-			log.Fatal(err)
+// measureRecorded repacks the metadata read from r, as it is and without its
+// inlined payloads, and returns the inline threshold recorded in it along
+// with the size of both.
+func measureRecorded(r io.Reader) (int64, metadataSize, metadataSize) {
+	var (
+		threshold     int64
+		with, without metadataSize
+	)
+	pack := func(m *metadataSize) (storage.Packer, func()) {
+		n, gzN := new(byteCounter), new(byteCounter)
+		gz := gzip.NewWriter(gzN)
+		return countingPacker{Packer: storage.NewJSONPacker(io.MultiWriter(n, gz)), m: m}, func() {
+			safeClose(gz)
+			m.size, m.gzSize = int64(*n), int64(*gzN)
 		}
-		fmt.Printf(" -- size of metadata uncompressed: %dk\n", fi.Size()/1024)
+	}
+	withPacker, closeWith := pack(&with)
+	withoutPacker, closeWithout := pack(&without)
 
-		gzPackFh, err := ioutil.TempFile("", "packed.gz.")
+	up := storage.NewJSONUnpacker(r)
+	for {
+		e, err := up.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer safeClose(gzPackFh)
-		if !c.Bool("work") {
-			defer func() { _ = os.Remove(gzPackFh.Name()) }()
+		switch e.Type {
+		case storage.OptionType:
+			if e.Name == storage.InlineThresholdOption {
+				threshold = e.Size
+			}
+		case storage.FileType:
+			with.files++
+			without.files++
 		}
-
-		gzWrtr := gzip.NewWriter(gzPackFh)
-
-		if _, err := packFh.Seek(0, 0); err != nil {
+		if _, err := withPacker.AddEntry(*e); err != nil {
 			log.Fatal(err)
 		}
-
-		if _, err := io.Copy(gzWrtr, packFh); err != nil {
+		if e.Type == storage.OptionType {
+			continue
+		}
+		e.Inline = nil
+		if _, err := withoutPacker.AddEntry(*e); err != nil {
 			log.Fatal(err)
 		}
-		safeClose(gzWrtr)
+	}
+	closeWith()
+	closeWithout()
+	return threshold, with, without
+}
 
-		if err := gzPackFh.Sync(); err != nil {
-			log.Fatal(err)
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (bc *byteCounter) Write(p []byte) (int, error) {
+	*bc += byteCounter(len(p))
+	return len(p), nil
+}
+
+// metadataSize is what measureMetadata found packing an archive.
+type metadataSize struct {
+	files       int
+	size        int64
+	gzSize      int64
+	inlined     int
+	inlinedSize int64
+	stored      int
+	paddingSize int64
+	headers     int
+}
+
+// countingPacker tallies the FileType, PaddingType and HeaderType entries
+// packed through it.
+type countingPacker struct {
+	storage.Packer
+	m *metadataSize
+}
+
+func (cp countingPacker) AddEntry(e storage.Entry) (int, error) {
+	switch e.Type {
+	case storage.PaddingType:
+		cp.m.paddingSize += e.Size
+	case storage.HeaderType:
+		cp.m.headers++
+	}
+	if e.Type == storage.FileType && e.Size > 0 {
+		if len(e.Inline) > 0 {
+			cp.m.inlined++
+			cp.m.inlinedSize += e.Size
+		} else {
+			cp.m.stored++
 		}
+	}
+	return cp.Packer.AddEntry(e)
+}
+
+// measureMetadata disassembles the archive read from r with opts, and reports
+// the size of the resulting metadata.
+func measureMetadata(c *cli.Context, r io.Reader, opts asm.DisassembleOptions) metadataSize {
+	var m metadataSize
 
-		fi, err = gzPackFh.Stat()
+	packFh, err := os.CreateTemp("", "packed.")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer safeClose(packFh)
+	if !c.Bool("work") {
+		defer func() { _ = os.Remove(packFh.Name()) }()
+	} else {
+		fmt.Printf(" -- working file preserved: %s\n", packFh.Name())
+	}
+
+	sp := countingPacker{Packer: storage.NewJSONPacker(packFh), m: &m}
+	fp := storage.NewDiscardFilePutter()
+	dissam, err := asm.NewInputTarStreamWithOptions(r, sp, fp, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tr := tar.NewReader(dissam)
+	for {
+		_, err = tr.Next()
 		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			log.Fatal(err)
+		}
+		m.files++
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
 			log.Fatal(err)
 		}
-		fmt.Printf(" -- size of gzip compressed metadata: %dk\n", fi.Size()/1024)
 	}
+	// drain the end of the archive, so it is packed as well
+	if _, err := io.Copy(ioutil.Discard, dissam); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := packFh.Sync(); err != nil {
+		log.Fatal(err)
+	}
+
+	fi, err := packFh.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.size = fi.Size()
+
+	gzPackFh, err := ioutil.TempFile("", "packed.gz.")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer safeClose(gzPackFh)
+	if !c.Bool("work") {
+		defer func() { _ = os.Remove(gzPackFh.Name()) }()
+	}
+
+	gzWrtr := gzip.NewWriter(gzPackFh)
+
+	if _, err := packFh.Seek(0, 0); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := io.Copy(gzWrtr, packFh); err != nil {
+		log.Fatal(err)
+	}
+	safeClose(gzWrtr)
+
+	if err := gzPackFh.Sync(); err != nil {
+		log.Fatal(err)
+	}
+
+	fi, err = gzPackFh.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.gzSize = fi.Size()
+	return m
 }
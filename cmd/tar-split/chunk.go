@@ -0,0 +1,163 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bmoylan/tar-split/tar/asm"
+	"github.com/bmoylan/tar-split/tar/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// CommandChunk provides the chunk command.
+func CommandChunk(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		logrus.Fatalf("please specify the tar archive to split <NAME>")
+	}
+	if len(c.String("output")) == 0 {
+		logrus.Fatalf("--output prefix must be set")
+	}
+	maxSize, err := parseSize(c.String("max-size"))
+	if err != nil {
+		logrus.Fatalf("--max-size: %s", err)
+	}
+
+	fh, err := os.Open(c.Args()[0])
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer safeClose(fh)
+	fi, err := fh.Stat()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	prefix := c.String("output")
+	var names []string
+	// the files of the chunk being written, closed once it is done
+	var closers []io.Closer
+	closeChunk := func() error {
+		var err error
+		for _, closer := range closers {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		closers = nil
+		return err
+	}
+	m, err := asm.SplitArchive(fh, fi.Size(), maxSize, func(i int) (io.Writer, storage.Packer, error) {
+		if err := closeChunk(); err != nil {
+			return nil, nil, err
+		}
+		name := fmt.Sprintf("%s.%03d.tar", prefix, i)
+		tf, err := os.Create(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		mf, err := os.OpenFile(strings.TrimSuffix(name, ".tar")+".tar-data.json.gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
+		if err != nil {
+			safeClose(tf)
+			return nil, nil, err
+		}
+		mfz := gzip.NewWriter(mf)
+		closers = append(closers, tf, mfz, mf)
+		names = append(names, filepath.Base(name))
+		return tf, storage.NewJSONPacker(mfz), nil
+	})
+	if cerr := closeChunk(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	for i := range m.Chunks {
+		m.Chunks[i].Name = names[i]
+	}
+
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if err := os.WriteFile(prefix+".manifest.json", append(buf, '\n'), 0o644); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("split %s into %d chunks (manifest %s.manifest.json)", c.Args()[0], len(m.Chunks), prefix)
+}
+
+// CommandJoin provides the join command.
+func CommandJoin(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		logrus.Fatalf("please specify the manifest of the chunks <NAME>")
+	}
+	if len(c.String("output")) == 0 {
+		logrus.Fatalf("--output filename must be set ([FILENAME|-])")
+	}
+	buf, err := os.ReadFile(c.Args()[0])
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	var m asm.SplitManifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		logrus.Fatalf("%s: %s", c.Args()[0], err)
+	}
+
+	var out io.Writer
+	if c.String("output") == "-" {
+		out = os.Stdout
+	} else {
+		fh, err := os.Create(c.String("output"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(fh)
+		out = fh
+	}
+	// chunks are named relative to the manifest
+	dir := filepath.Dir(c.Args()[0])
+	open := func(i int, chunk *asm.SplitChunk) (io.ReadCloser, error) {
+		if len(chunk.Name) == 0 {
+			return nil, fmt.Errorf("chunk %d has no name", i)
+		}
+		return os.Open(filepath.Join(dir, chunk.Name))
+	}
+	if err := asm.JoinArchive(&m, open, out); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// parseSize parses a size in bytes, with an optional K, M, G or T suffix of
+// binary units.
+func parseSize(s string) (int64, error) {
+	shift := 0
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			shift = 10
+		case "M":
+			shift = 20
+		case "G":
+			shift = 30
+		case "T":
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 || size > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("size %s out of range", s)
+	}
+	return size << shift, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/asm"
+	"github.com/bmoylan/tar-split/tar/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// CommandCreate provides the create command.
+func CommandCreate(c *cli.Context) {
+	if len(c.Args()) > 0 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args()))
+	}
+	if len(c.String("directory")) == 0 {
+		logrus.Fatalf("--directory must be set")
+	}
+	if len(c.String("output-tar")) == 0 {
+		logrus.Fatalf("--output-tar filename must be set ([FILENAME|-])")
+	}
+	if len(c.String("output")) == 0 {
+		logrus.Fatalf("--output filename must be set")
+	}
+
+	opts := asm.CreateOptions{
+		Sort:        c.Bool("sort"),
+		AccessTimes: c.Bool("access-times"),
+		ZeroOwner:   c.Bool("zero-owner"),
+	}
+	switch c.String("format") {
+	case "":
+	case "ustar":
+		opts.Format = tar.FormatUSTAR
+	case "pax":
+		opts.Format = tar.FormatPAX
+	case "gnu":
+		opts.Format = tar.FormatGNU
+	default:
+		logrus.Fatalf("--format must be one of ustar, pax or gnu")
+	}
+	if epoch := c.String("source-date-epoch"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			logrus.Fatalf("invalid SOURCE_DATE_EPOCH %q: %s", epoch, err)
+		}
+		opts.ClampTime = time.Unix(sec, 0)
+	}
+
+	var outputStream io.Writer
+	if c.String("output-tar") == "-" {
+		outputStream = os.Stdout
+	} else {
+		fh, err := os.Create(c.String("output-tar"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(fh)
+		outputStream = fh
+	}
+
+	// Set up the metadata storage
+	mf, err := os.OpenFile(c.String("output"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer safeClose(mf)
+	mfz := gzip.NewWriter(mf)
+	defer safeClose(mfz)
+	metaPacker := storage.NewJSONPacker(mfz)
+
+	if err := asm.WriteTarFromDir(c.String("directory"), outputStream, metaPacker, nil, opts); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("created %s and %s from %s", c.String("output-tar"), c.String("output"), c.String("directory"))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/asm"
+	"github.com/bmoylan/tar-split/tar/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// CommandDiff provides the diff command. As diff(1) does, it exits 1 if the
+// archives differ, and 2 if they could not be compared.
+func CommandDiff(c *cli.Context) {
+	logrus.StandardLogger().ExitFunc = func(int) { os.Exit(2) }
+	if len(c.Args()) != 2 {
+		logrus.Fatalf("please specify the metadata of the archives to compare <OLD> <NEW>")
+	}
+	var unpackers [2]storage.Unpacker
+	for i, name := range c.Args() {
+		fh, err := os.Open(name)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(fh)
+		r, err := maybeGunzip(fh)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		unpackers[i] = storage.NewJSONUnpacker(r)
+	}
+	diff, err := asm.DiffArchives(unpackers[0], unpackers[1])
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	for _, change := range diff.Changes {
+		name := change.Name
+		if name == "" {
+			name = "."
+		}
+		switch {
+		case change.Global:
+			name = fmt.Sprintf("global header %d", change.Index+1)
+		case change.Index > 0:
+			name = fmt.Sprintf("%s (member %d of the name)", name, change.Index+1)
+		}
+		fmt.Printf("%-9s %s", change.Kind, name)
+		if details := changeDetails(change); len(details) > 0 {
+			fmt.Printf(" (%s)", strings.Join(details, ", "))
+		}
+		fmt.Println()
+	}
+	if diff.Reordered {
+		fmt.Println("the members are in a different order")
+	}
+	if diff.TrailerChanged {
+		fmt.Printf("the end of the archives differs (%d -> %d bytes)\n", diff.OldTrailer, diff.NewTrailer)
+	}
+	logrus.Infof("%d members differ between %s and %s", len(diff.Changes), c.Args()[0], c.Args()[1])
+	if diff.Differs() {
+		os.Exit(1)
+	}
+}
+
+// changeDetails describes what differs of a member in both archives.
+func changeDetails(change asm.Change) []string {
+	if change.Old == nil || change.New == nil {
+		return nil
+	}
+	var details []string
+	a, b := change.Old, change.New
+	if change.Kind == asm.ContentChanged {
+		if a.Entry.Size != b.Entry.Size {
+			details = append(details, fmt.Sprintf("size %d -> %d", a.Entry.Size, b.Entry.Size))
+		} else {
+			details = append(details, "checksum")
+		}
+	}
+	for _, field := range change.Fields {
+		details = append(details, fmt.Sprintf("%s %s -> %s", field, headerField(a.Header, field), headerField(b.Header, field)))
+	}
+	if change.Kind == asm.EncodingChanged {
+		if a.Header.Name != b.Header.Name {
+			details = append(details, fmt.Sprintf("name %q -> %q", a.Header.Name, b.Header.Name))
+		}
+		if a.Header.Format != b.Header.Format {
+			details = append(details, fmt.Sprintf("format %s -> %s", a.Header.Format, b.Header.Format))
+		}
+		if len(a.Raw) != len(b.Raw) {
+			details = append(details, fmt.Sprintf("header %d -> %d bytes", len(a.Raw), len(b.Raw)))
+		}
+	}
+	return details
+}
+
+// headerField formats the field of hdr, as named by asm.Change.Fields.
+func headerField(hdr *tar.Header, field string) string {
+	switch field {
+	case "type":
+		return fmt.Sprintf("%q", hdr.Typeflag)
+	case "mode":
+		return fmt.Sprintf("%#o", hdr.Mode)
+	case "uid":
+		return fmt.Sprint(hdr.Uid)
+	case "gid":
+		return fmt.Sprint(hdr.Gid)
+	case "uname":
+		return fmt.Sprintf("%q", hdr.Uname)
+	case "gname":
+		return fmt.Sprintf("%q", hdr.Gname)
+	case "mtime":
+		return hdr.ModTime.UTC().Format("2006-01-02T15:04:05.999999999Z")
+	case "atime":
+		return hdr.AccessTime.UTC().Format("2006-01-02T15:04:05.999999999Z")
+	case "ctime":
+		return hdr.ChangeTime.UTC().Format("2006-01-02T15:04:05.999999999Z")
+	case "linkname":
+		return fmt.Sprintf("%q", hdr.Linkname)
+	case "devmajor":
+		return fmt.Sprint(hdr.Devmajor)
+	case "devminor":
+		return fmt.Sprint(hdr.Devminor)
+	case "records":
+		var records []string
+		for key, value := range hdr.PAXRecords {
+			records = append(records, fmt.Sprintf("%s=%q", key, value))
+		}
+		sort.Strings(records)
+		return "[" + strings.Join(records, " ") + "]"
+	case "xattrs":
+		var xattrs []string
+		for key, value := range hdr.PAXRecords {
+			if strings.HasPrefix(key, "SCHILY.xattr.") {
+				xattrs = append(xattrs, fmt.Sprintf("%s=%q", strings.TrimPrefix(key, "SCHILY.xattr."), value))
+			}
+		}
+		sort.Strings(xattrs)
+		return "[" + strings.Join(xattrs, " ") + "]"
+	}
+	return "?"
+}
@@ -19,9 +19,15 @@ func CommandDisasm(c *cli.Context) {
 	if len(c.String("output")) == 0 {
 		logrus.Fatalf("--output filename must be set")
 	}
+	if len(c.String("compress")) > 0 && len(c.String("store")) == 0 {
+		logrus.Fatalf("--compress requires --store")
+	}
 
 	// Set up the tar input stream
-	var inputStream io.Reader
+	var (
+		inputStream io.Reader
+		inputFile   *os.File
+	)
 	if c.Args()[0] == "-" {
 		inputStream = os.Stdin
 	} else {
@@ -30,7 +36,7 @@ func CommandDisasm(c *cli.Context) {
 			logrus.Fatal(err)
 		}
 		defer safeClose(fh)
-		inputStream = fh
+		inputStream, inputFile = fh, fh
 	}
 
 	// Set up the metadata storage
@@ -43,9 +49,52 @@ func CommandDisasm(c *cli.Context) {
 	defer safeClose(mfz)
 	metaPacker := storage.NewJSONPacker(mfz)
 
-	// we're passing nil here for the file putter, because the ApplyDiff will
-	// handle the extraction of the archive
-	its, err := asm.NewInputTarStream(inputStream, metaPacker, nil)
+	// we're passing nil here for the file putter, unless a helper is to store
+	// the payloads, because the ApplyDiff will handle the extraction of the
+	// archive
+	var filePutter storage.FilePutter
+	if len(c.String("putter-exec")) > 0 {
+		efp, err := storage.NewExecFilePutter(helperCommand(c.String("putter-exec")))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(efp)
+		filePutter = efp
+	} else if len(c.String("store")) > 0 {
+		cs, err := storage.NewChecksumStoreWithOptions(c.String("store"), storage.StoreOptions{
+			Compression: c.String("compress"),
+		})
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		filePutter = cs
+	}
+	opts := asm.DisassembleOptions{
+		Limits: asm.Limits{
+			MaxHeaderSize:  c.Int64("max-header-size"),
+			MaxSegmentSize: c.Int64("max-segment-size"),
+			MaxEntries:     c.Int64("max-entries"),
+			MaxNameLength:  c.Int("max-name-length"),
+			MaxPaddingSize: c.Int64("max-padding-size"),
+		},
+		InlineThreshold: c.Int64("inline-threshold"),
+		RawPadding:      c.Bool("raw-padding"),
+		HeaderEntries:   c.Bool("header-entries"),
+	}
+	if c.Bool("no-stdout") && inputFile != nil {
+		// not passed through, so payloads can be copied out of the input
+		// file in the kernel
+		if err := asm.DisassembleFile(inputFile, metaPacker, filePutter, opts); err != nil {
+			logrus.Fatal(err)
+		}
+		off, err := inputFile.Seek(0, io.SeekCurrent)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("created %s from %s (read %d bytes)", c.String("output"), c.Args()[0], off)
+		return
+	}
+	its, err := asm.NewInputTarStreamWithOptions(inputStream, metaPacker, filePutter, opts)
 	if err != nil {
 		logrus.Fatal(err)
 	}
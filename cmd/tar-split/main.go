@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/bmoylan/tar-split/version"
 	"github.com/sirupsen/logrus"
@@ -46,6 +47,53 @@ func main() {
 					Name:  "no-stdout",
 					Usage: "do not throughput the stream to STDOUT",
 				},
+				cli.Int64Flag{
+					Name:  "max-header-size",
+					Usage: "largest header in bytes, with its extensions and preceding padding (0 is unlimited)",
+				},
+				cli.Int64Flag{
+					Name:  "max-segment-size",
+					Usage: "largest raw segment in bytes (0 is unlimited)",
+				},
+				cli.Int64Flag{
+					Name:  "max-entries",
+					Usage: "most metadata entries to pack (0 is unlimited)",
+				},
+				cli.IntFlag{
+					Name:  "max-name-length",
+					Usage: "longest member name or link name in bytes (0 is unlimited)",
+				},
+				cli.Int64Flag{
+					Name:  "max-padding-size",
+					Usage: "most bytes allowed after the end-of-archive marker (0 is unlimited)",
+				},
+				cli.Int64Flag{
+					Name:  "inline-threshold",
+					Usage: "embed file payloads of at most this many bytes in the metadata (0 is none)",
+				},
+				cli.BoolFlag{
+					Name:  "raw-padding",
+					Usage: "store runs of zero bytes raw, so older versions can assemble the metadata",
+				},
+				cli.BoolFlag{
+					Name:  "header-entries",
+					Usage: "store headers as their fields, and how they differ from the regenerated header",
+				},
+				cli.StringFlag{
+					Name:  "store",
+					Value: "",
+					Usage: "directory of a content store to store the file payloads in",
+				},
+				cli.StringFlag{
+					Name:  "compress",
+					Value: "",
+					Usage: "codec to compress the file payloads stored in --store with, such as gzip",
+				},
+				cli.StringFlag{
+					Name:  "putter-exec",
+					Value: "",
+					Usage: "command of a helper process storing the file payloads, its arguments separated by spaces",
+				},
 			},
 		},
 		{
@@ -69,11 +117,361 @@ func main() {
 					Value: "",
 					Usage: "relative path of extracted tar",
 				},
+				cli.StringFlag{
+					Name:  "store",
+					Value: "",
+					Usage: "directory of the content store holding the file payloads",
+				},
+				cli.StringFlag{
+					Name:  "tar",
+					Value: "",
+					Usage: "tar archive holding the file payloads",
+				},
+				cli.StringFlag{
+					Name:  "url",
+					Value: "",
+					Usage: "URL of the file payloads by checksum, such as the /payloads of tar-split serve",
+				},
+				cli.StringFlag{
+					Name:  "getter-exec",
+					Value: "",
+					Usage: "command of a helper process providing the file payloads, its arguments separated by spaces",
+				},
+				cli.StringFlag{
+					Name:  "bundle",
+					Value: "",
+					Usage: "bundle to assemble from in place, instead of --input and --path",
+				},
 				cli.BoolFlag{
 					Name:  "compress",
 					Usage: "gzip compress the output",
 					// defaults to false
 				},
+				cli.StringSliceFlag{
+					Name:  "include",
+					Usage: "only assemble the members matching this glob, or under a directory matching it (repeatable)",
+				},
+				cli.IntFlag{
+					Name:  "workers",
+					Usage: "payloads to fetch and write at once, when the output is a file",
+				},
+				cli.Int64Flag{
+					Name:  "max-entry-size",
+					Usage: "largest metadata entry in bytes (0 is unlimited)",
+				},
+				cli.Int64Flag{
+					Name:  "max-ratio",
+					Usage: "largest decompression ratio of the metadata (0 is unlimited)",
+				},
+			},
+		},
+		{
+			Name:    "create",
+			Aliases: []string{"c"},
+			Usage:   "create a tar archive and its metadata from a directory",
+			Action:  CommandCreate,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "directory, C",
+					Value: "",
+					Usage: "directory to archive",
+				},
+				cli.StringFlag{
+					Name:  "output-tar",
+					Value: "-",
+					Usage: "created tar archive",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Value: "tar-data.json.gz",
+					Usage: "output of disassembled tar stream",
+				},
+				cli.BoolFlag{
+					Name:  "sort",
+					Usage: "archive the members of each directory in name order",
+				},
+				cli.BoolFlag{
+					Name:  "zero-owner",
+					Usage: "record uid/gid 0 and no user/group names",
+				},
+				cli.BoolFlag{
+					Name:  "access-times",
+					Usage: "record access and change times, in the pax and gnu formats",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "header format to use (ustar, pax or gnu)",
+				},
+				cli.StringFlag{
+					Name:   "source-date-epoch",
+					Value:  "",
+					Usage:  "clamp timestamps to these seconds since the epoch",
+					EnvVar: "SOURCE_DATE_EPOCH",
+				},
+			},
+		},
+		{
+			Name:  "bundle",
+			Usage: "pack metadata and the payloads it references into one file",
+			Subcommands: []cli.Command{
+				{
+					Name:   "create",
+					Usage:  "create a bundle of metadata and its payloads",
+					Action: CommandBundleCreate,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "input",
+							Value: "tar-data.json.gz",
+							Usage: "metadata of the archive",
+						},
+						cli.StringFlag{
+							Name:  "output",
+							Value: "-",
+							Usage: "bundle to create",
+						},
+						cli.StringFlag{
+							Name:  "store",
+							Value: "",
+							Usage: "directory of the content store holding the payloads",
+						},
+						cli.StringFlag{
+							Name:  "path",
+							Value: "",
+							Usage: "relative path of extracted tar holding the payloads",
+						},
+					},
+				},
+				{
+					Name:      "import",
+					Usage:     "unpack a bundle into a content store and its metadata",
+					ArgsUsage: "BUNDLE",
+					Action:    CommandBundleImport,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "store",
+							Value: "",
+							Usage: "directory of the content store",
+						},
+						cli.StringFlag{
+							Name:  "compress",
+							Value: "",
+							Usage: "codec to compress the file payloads stored with, such as gzip",
+						},
+						cli.StringFlag{
+							Name:  "output",
+							Value: "tar-data.json.gz",
+							Usage: "metadata of the archive",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "store",
+			Usage: "maintain a checksum content store of file payloads",
+			Subcommands: []cli.Command{
+				{
+					Name:      "gc",
+					Usage:     "remove the payloads not referenced by any of the given metadata",
+					ArgsUsage: "METADATA...",
+					Action:    CommandStoreGC,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "store",
+							Value: "",
+							Usage: "directory of the content store",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "only report what would be removed",
+						},
+						cli.DurationFlag{
+							Name:  "min-age",
+							Value: time.Hour,
+							Usage: "keep unreferenced payloads stored more recently than this, such as those of disassemblies in progress",
+						},
+					},
+				},
+				{
+					Name:      "repack",
+					Usage:     "rewrite a pack store, keeping only the payloads referenced by the given metadata",
+					ArgsUsage: "METADATA...",
+					Action:    CommandStoreRepack,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "store",
+							Value: "",
+							Usage: "directory of the pack store",
+						},
+					},
+				},
+				{
+					Name:   "chunk-stats",
+					Usage:  "report how well the payloads of a chunk store deduplicate",
+					Action: CommandStoreChunkStats,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "store",
+							Value: "",
+							Usage: "directory of the chunk store",
+						},
+					},
+				},
+				{
+					Name:   "plan",
+					Usage:  "list, as JSON, the payloads referenced by metadata that the store is missing",
+					Action: CommandStorePlan,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "input",
+							Value: "tar-data.json.gz",
+							Usage: "metadata of the archive",
+						},
+						cli.StringFlag{
+							Name:  "store",
+							Value: "",
+							Usage: "directory of the content store",
+						},
+					},
+				},
+				{
+					Name:   "fetch",
+					Usage:  "fetch the payloads referenced by metadata that the store is missing from a server",
+					Action: CommandStoreFetch,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "input",
+							Value: "tar-data.json.gz",
+							Usage: "metadata of the archive",
+						},
+						cli.StringFlag{
+							Name:  "store",
+							Value: "",
+							Usage: "directory of the content store",
+						},
+						cli.StringFlag{
+							Name:  "url",
+							Value: "",
+							Usage: "base URL of the payloads served by tar-split serve, such as http://host:8080/payloads",
+						},
+						cli.StringFlag{
+							Name:  "compress",
+							Value: "",
+							Usage: "codec to compress the file payloads stored with, such as gzip",
+						},
+					},
+				},
+				{
+					Name:   "scrub",
+					Usage:  "rehash every payload, reporting those no longer matching their checksum",
+					Action: CommandStoreScrub,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "store",
+							Value: "",
+							Usage: "directory of the content store",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:   "serve",
+			Usage:  "serve a content store, and the tar archives assembled from it, over HTTP",
+			Action: CommandServe,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "store",
+					Value: "",
+					Usage: "directory of the content store",
+				},
+				cli.StringFlag{
+					Name:  "metadata",
+					Value: "",
+					Usage: "directory of the metadata of the tar archives",
+				},
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "localhost:8080",
+					Usage: "address to listen on",
+				},
+				cli.Int64Flag{
+					Name:  "max-entry-size",
+					Usage: "largest metadata entry in bytes (0 is unlimited)",
+				},
+				cli.Int64Flag{
+					Name:  "max-ratio",
+					Usage: "largest decompression ratio of the metadata (0 is unlimited)",
+				},
+			},
+		},
+		{
+			Name:      "squash",
+			Usage:     "squash the archives of layers into one, applying their whiteouts",
+			ArgsUsage: "METADATA...",
+			Action:    CommandSquash,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "store",
+					Value: "",
+					Usage: "directory of the content store holding the payloads of all the layers",
+				},
+				cli.StringSliceFlag{
+					Name:  "path",
+					Usage: "relative path of the extracted tar of each layer, in the order of their metadata (repeatable)",
+				},
+				cli.StringSliceFlag{
+					Name:  "tar",
+					Usage: "tar archive of each layer, in the order of their metadata (repeatable)",
+				},
+				cli.StringFlag{
+					Name:  "output-tar",
+					Value: "-",
+					Usage: "squashed tar archive",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Value: "tar-data.json.gz",
+					Usage: "output of disassembled squashed tar stream",
+				},
+			},
+		},
+		{
+			Name:      "diff",
+			Usage:     "report the members added, removed or changed between the archives of two metadata",
+			ArgsUsage: "OLD NEW",
+			Action:    CommandDiff,
+		},
+		{
+			Name:      "chunk",
+			Usage:     "split a tar archive into tar archives of at most a size, each with its metadata",
+			ArgsUsage: "ARCHIVE",
+			Action:    CommandChunk,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "max-size",
+					Value: "512M",
+					Usage: "largest chunk in bytes, with an optional K, M or G suffix",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Value: "chunk",
+					Usage: "prefix of the chunks, their metadata and the manifest to rejoin them",
+				},
+			},
+		},
+		{
+			Name:      "join",
+			Usage:     "rejoin the chunks of a manifest into the original tar archive",
+			ArgsUsage: "MANIFEST",
+			Action:    CommandJoin,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output",
+					Value: "-",
+					Usage: "rejoined tar archive",
+				},
 			},
 		},
 		{
@@ -86,6 +484,18 @@ func main() {
 					Usage: "do not delete the working directory",
 					// defaults to false
 				},
+				cli.Int64Flag{
+					Name:  "inline-threshold",
+					Usage: "also report the metadata size with file payloads of at most this many bytes inlined",
+				},
+				cli.BoolFlag{
+					Name:  "metadata",
+					Usage: "check metadata files rather than tar archives, at the inline threshold recorded in them",
+				},
+				cli.BoolFlag{
+					Name:  "header-entries",
+					Usage: "also report the metadata size with headers stored as their fields",
+				},
 			},
 		},
 	}
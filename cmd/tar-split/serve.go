@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bmoylan/tar-split/tar/server"
+	"github.com/bmoylan/tar-split/tar/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// CommandServe provides the serve command.
+func CommandServe(c *cli.Context) {
+	if len(c.Args()) > 0 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args()))
+	}
+	if len(c.String("store")) == 0 {
+		logrus.Fatalf("--store directory must be set")
+	}
+	if len(c.String("metadata")) == 0 {
+		logrus.Fatalf("--metadata directory must be set")
+	}
+	cs, err := storage.NewChecksumStore(c.String("store"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	logrus.Infof("serving %s and %s on %s", c.String("store"), c.String("metadata"), c.String("listen"))
+	handler := server.NewHandlerWithOptions(cs, c.String("metadata"), server.HandlerOptions{
+		MaxEntrySize: c.Int64("max-entry-size"),
+		MaxRatio:     c.Int64("max-ratio"),
+	})
+	if err := http.ListenAndServe(c.String("listen"), handler); err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/bmoylan/tar-split/tar/asm"
+	"github.com/bmoylan/tar-split/tar/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// CommandSquash provides the squash command.
+func CommandSquash(c *cli.Context) {
+	if len(c.Args()) == 0 {
+		logrus.Fatalf("please specify the metadata of the layers, lowest first <NAME...>")
+	}
+	if len(c.String("output-tar")) == 0 {
+		logrus.Fatalf("--output-tar filename must be set ([FILENAME|-])")
+	}
+	if len(c.String("output")) == 0 {
+		logrus.Fatalf("--output filename must be set")
+	}
+	paths, tars := c.StringSlice("path"), c.StringSlice("tar")
+	switch {
+	case len(c.String("store"))+len(paths)+len(tars) == 0:
+		logrus.Fatalf("--store, --path or --tar must be set")
+	case len(c.String("store")) > 0 && len(paths)+len(tars) > 0, len(paths) > 0 && len(tars) > 0:
+		logrus.Fatalf("only one of --store, --path and --tar can be set")
+	case len(paths) > 0 && len(paths) != len(c.Args()):
+		logrus.Fatalf("--path must be set once for each of the %d layers", len(c.Args()))
+	case len(tars) > 0 && len(tars) != len(c.Args()):
+		logrus.Fatalf("--tar must be set once for each of the %d layers", len(c.Args()))
+	}
+
+	var cs *storage.ChecksumStore
+	if len(c.String("store")) > 0 {
+		var err error
+		cs, err = storage.NewChecksumStore(c.String("store"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	layers := make([]asm.SquashLayer, len(c.Args()))
+	for i, name := range c.Args() {
+		mf, err := os.Open(name)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(mf)
+		metadata, err := maybeGunzip(mf)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		layers[i].Unpacker = storage.NewJSONUnpacker(metadata)
+
+		switch {
+		case cs != nil:
+			layers[i].FileGetter = cs
+		case len(paths) > 0:
+			layers[i].FileGetter = storage.NewPathFileGetter(paths[i])
+		default:
+			tf, err := os.Open(tars[i])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			defer safeClose(tf)
+			tfg, err := storage.NewTarFileGetter(tf)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			layers[i].FileGetter = tfg
+		}
+	}
+
+	var outputStream io.Writer
+	if c.String("output-tar") == "-" {
+		outputStream = os.Stdout
+	} else {
+		fh, err := os.Create(c.String("output-tar"))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer safeClose(fh)
+		outputStream = fh
+	}
+
+	// Set up the metadata storage
+	mf, err := os.OpenFile(c.String("output"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer safeClose(mf)
+	mfz := gzip.NewWriter(mf)
+	defer safeClose(mfz)
+	metaPacker := storage.NewJSONPacker(mfz)
+
+	// we're passing nil here for the file putter, as the payloads are all
+	// where they were taken from already
+	if err := asm.WriteSquashedTar(layers, outputStream, metaPacker, nil); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("created %s and %s from %d layers", c.String("output-tar"), c.String("output"), len(layers))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/bmoylan/tar-split/tar/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// CommandStoreGC provides the store gc command.
+func CommandStoreGC(c *cli.Context) {
+	if len(c.String("store")) == 0 {
+		logrus.Fatalf("--store directory must be set")
+	}
+	if len(c.Args()) == 0 {
+		logrus.Fatalf("please specify the metadata of every archive in the store")
+	}
+	cs, err := storage.NewChecksumStore(c.String("store"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	referenced := storage.ChecksumSet{}
+	for _, arg := range c.Args() {
+		if err := addReferenced(referenced, arg); err != nil {
+			logrus.Fatalf("reading %s: %s", arg, err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	stats, err := cs.GC(ctx, referenced, storage.GCOptions{
+		DryRun: c.Bool("dry-run"),
+		MinAge: c.Duration("min-age"),
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	verb := "removed"
+	if c.Bool("dry-run") {
+		verb = "would remove"
+	}
+	fmt.Printf("%s %d payloads (%dk), kept %d\n", verb, stats.Removed, stats.RemovedBytes/1024, stats.Kept)
+}
+
+// CommandStoreRepack provides the store repack command.
+func CommandStoreRepack(c *cli.Context) {
+	if len(c.String("store")) == 0 {
+		logrus.Fatalf("--store directory must be set")
+	}
+	if len(c.Args()) == 0 {
+		logrus.Fatalf("please specify the metadata of every archive in the store")
+	}
+	ps, err := storage.OpenPackStore(c.String("store"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer safeClose(ps)
+
+	referenced := storage.ChecksumSet{}
+	for _, arg := range c.Args() {
+		if err := addReferenced(referenced, arg); err != nil {
+			logrus.Fatalf("reading %s: %s", arg, err)
+		}
+	}
+
+	stats, err := ps.Repack(referenced)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fmt.Printf("removed %d payloads (%dk), kept %d\n", stats.Removed, stats.RemovedBytes/1024, stats.Kept)
+}
+
+// addReferenced adds the payloads referenced by the metadata file name, which
+// may be gzip compressed, to referenced.
+func addReferenced(referenced storage.ChecksumSet, name string) error {
+	fh, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer safeClose(fh)
+	r, err := maybeGunzip(fh)
+	if err != nil {
+		return err
+	}
+	return referenced.AddEntries(storage.NewJSONUnpacker(r))
+}
+
+// maybeGunzip decompresses r, if it is gzip compressed.
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// CommandStoreScrub provides the store scrub command.
+func CommandStoreScrub(c *cli.Context) {
+	if len(c.Args()) > 0 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args()))
+	}
+	if len(c.String("store")) == 0 {
+		logrus.Fatalf("--store directory must be set")
+	}
+	cs, err := storage.NewChecksumStore(c.String("store"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	stats, err := cs.Scrub(ctx)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	for _, path := range stats.Corrupt {
+		fmt.Printf("corrupt: %s\n", path)
+	}
+	fmt.Printf("checked %d payloads, %d corrupt\n", stats.Checked, len(stats.Corrupt))
+	if len(stats.Corrupt) > 0 {
+		os.Exit(1)
+	}
+}
+
+// CommandStoreChunkStats provides the store chunk-stats command.
+func CommandStoreChunkStats(c *cli.Context) {
+	if len(c.Args()) > 0 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args()))
+	}
+	if len(c.String("store")) == 0 {
+		logrus.Fatalf("--store directory must be set")
+	}
+	cs, err := storage.NewChunkStore(c.String("store"), storage.ChunkOptions{})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	stats, err := cs.Stats()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fmt.Printf("%d payloads (%dk) stored as %d chunks (%dk), dedup ratio %.2f\n",
+		stats.Payloads, stats.PayloadBytes/1024, stats.Chunks, stats.ChunkBytes/1024, stats.DedupRatio())
+}
+
+// CommandStorePlan provides the store plan command.
+func CommandStorePlan(c *cli.Context) {
+	if len(c.Args()) > 0 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args()))
+	}
+	if len(c.String("store")) == 0 {
+		logrus.Fatalf("--store directory must be set")
+	}
+	cs, err := storage.NewChecksumStore(c.String("store"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	plan := planMissing(c.String("input"), cs)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(plan); err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("missing %d of %d payloads (%dk of %dk)", len(plan.Missing), plan.Payloads, plan.MissingBytes/1024, plan.Bytes/1024)
+}
+
+// CommandStoreFetch provides the store fetch command.
+func CommandStoreFetch(c *cli.Context) {
+	if len(c.Args()) > 0 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args()))
+	}
+	if len(c.String("store")) == 0 {
+		logrus.Fatalf("--store directory must be set")
+	}
+	if len(c.String("url")) == 0 {
+		logrus.Fatalf("--url must be set")
+	}
+	cs, err := storage.NewChecksumStoreWithOptions(c.String("store"), storage.StoreOptions{
+		Compression: c.String("compress"),
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	plan := planMissing(c.String("input"), cs)
+	for _, m := range plan.Missing {
+		if m.Reason != storage.PlanSizeMismatch {
+			continue
+		}
+		// corrupt, as it has the checksum but not the size
+		checksum, err := hex.DecodeString(m.Checksum)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if err := cs.Remove(checksum); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	n, err := plan.Fetch(storage.NewHTTPFileGetter(c.String("url")), cs)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fmt.Printf("fetched %d of %d payloads (%dk of %dk)\n", len(plan.Missing), plan.Payloads, n/1024, plan.Bytes/1024)
+}
+
+// planMissing plans the payloads referenced by the metadata file name, which
+// may be gzip compressed, that cs is missing.
+func planMissing(name string, cs *storage.ChecksumStore) *storage.Plan {
+	if len(name) == 0 {
+		logrus.Fatalf("--input metadata must be set")
+	}
+	fh, err := os.Open(name)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer safeClose(fh)
+	r, err := maybeGunzip(fh)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	plan, err := storage.PlanMissing(storage.NewJSONUnpacker(r), cs)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return plan
+}
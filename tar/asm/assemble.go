@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"os"
 	"sync"
 
 	"github.com/bmoylan/tar-split/tar/storage"
@@ -31,6 +32,12 @@ func NewOutputTarStream(fg storage.FileGetter, up storage.Unpacker) io.ReadClose
 }
 
 // WriteOutputTarStream writes assembled tar archive to a writer.
+//
+// When w is a regular *os.File, payloads the storage.FileGetter returns as
+// regular *os.File are copied by the kernel rather than through a buffer:
+// with copy_file_range on Linux, which shares their blocks on copy-on-write
+// filesystems such as btrfs and XFS. Their checksum is then verified by
+// reading them, without writing them again.
 func WriteOutputTarStream(fg storage.FileGetter, up storage.Unpacker, w io.Writer) error {
 	// ... Since these are interfaces, this is possible, so let's not have a nil pointer
 	if fg == nil || up == nil {
@@ -41,6 +48,8 @@ func WriteOutputTarStream(fg storage.FileGetter, up storage.Unpacker, w io.Write
 	var crcHash hash.Hash
 	var crcSum []byte
 	var multiWriter io.Writer
+	// payloads are copied in the kernel from regular files to a regular file
+	var dst *os.File
 	for {
 		entry, err := up.Next()
 		if err != nil {
@@ -54,24 +63,55 @@ func WriteOutputTarStream(fg storage.FileGetter, up storage.Unpacker, w io.Write
 			if _, err := w.Write(entry.Payload); err != nil {
 				return err
 			}
+		case storage.PaddingType:
+			if err := writeZeros(w, entry.Size); err != nil {
+				return err
+			}
+		case storage.OptionType:
+			// options are not part of the archive
+		case storage.HeaderType:
+			b, err := headerBytes(entry)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
 		case storage.FileType:
 			if entry.Size == 0 {
 				continue
 			}
-			fh, err := fg.Get(entry)
-			if err != nil {
-				return err
+			var fh io.ReadCloser
+			if len(entry.Inline) > 0 {
+				if int64(len(entry.Inline)) != entry.Size {
+					return fmt.Errorf("inline payload of %q is %d bytes, expected %d", entry.GetName(), len(entry.Inline), entry.Size)
+				}
+				fh = io.NopCloser(bytes.NewReader(entry.Inline))
+			} else {
+				fh, err = fg.Get(entry)
+				if err != nil {
+					return err
+				}
 			}
 			if crcHash == nil {
 				crcHash = storage.NewHash()
 				crcSum = make([]byte, crcHash.Size())
 				multiWriter = io.MultiWriter(w, crcHash)
 				copyBuffer = byteBufferPool.Get().([]byte)
+				dst, _ = w.(*os.File)
+				if dst != nil && !isRegular(dst) {
+					dst = nil
+				}
 			} else {
 				crcHash.Reset()
 			}
 
-			if _, err := io.CopyBuffer(multiWriter, fh, copyBuffer); err != nil {
+			if src, ok := fh.(*os.File); ok && dst != nil && isRegular(src) {
+				err = copyFile(dst, src, entry.Size, crcHash)
+			} else {
+				_, err = io.CopyBuffer(multiWriter, fh, copyBuffer)
+			}
+			if err != nil {
 				_ = fh.Close()
 				return err
 			}
@@ -84,8 +124,51 @@ func WriteOutputTarStream(fg storage.FileGetter, up storage.Unpacker, w io.Write
 				return fmt.Errorf("file integrity checksum failed for %q", entry.GetName())
 			}
 			_ = fh.Close()
+		default:
+			return fmt.Errorf("unknown entry type %d at position %d", entry.Type, entry.Position)
+		}
+	}
+}
+
+// copyFile copies size bytes of src to dst, as os.File.ReadFrom does, which
+// is in the kernel where it can be, and writes them to hsh.
+func copyFile(dst, src *os.File, size int64, hsh hash.Hash) error {
+	off, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	n, err := dst.ReadFrom(io.LimitReader(src, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("payload of %q is %d bytes, expected %d", src.Name(), n, size)
+	}
+	_, err = io.Copy(hsh, io.NewSectionReader(src, off, size))
+	return err
+}
+
+// isRegular reports whether file is a regular file.
+func isRegular(file *os.File) bool {
+	stat, err := file.Stat()
+	return err == nil && stat.Mode().IsRegular()
+}
+
+var zeroBlock [32 * 1024]byte
+
+// writeZeros writes n zero bytes to w.
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		chunk := zeroBlock[:]
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
 		}
+		n -= int64(len(chunk))
 	}
+	return nil
 }
 
 var byteBufferPool = &sync.Pool{
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/bmoylan/tar-split/archive/tar"
 	"github.com/bmoylan/tar-split/tar/storage"
 )
 
@@ -203,6 +206,359 @@ func TestTarStream(t *testing.T) {
 	}
 }
 
+// commitGetPutter is a FileGetPutter whose payloads are only visible once
+// committed, like storage.PackStore.
+type commitGetPutter interface {
+	storage.FileGetPutter
+	Commit() error
+}
+
+func TestTarStreamStores(t *testing.T) {
+	ps, err := storage.OpenPackStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ps.Close() }()
+	cs, err := storage.NewChunkStore(t.TempDir(), storage.ChunkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fgp := range []storage.FileGetPutter{ps, cs} {
+		for _, tc := range testCases {
+			fh, err := os.Open(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = fh.Close() }()
+			gzRdr, err := gzip.NewReader(fh)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := bytes.NewBuffer([]byte{})
+			tarStream, err := NewInputTarStream(gzRdr, storage.NewJSONPacker(w), fgp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, tarStream); err != nil {
+				t.Fatal(err)
+			}
+			if c, ok := fgp.(commitGetPutter); ok {
+				if err := c.Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			h1 := sha1.New()
+			i, err := io.Copy(h1, NewOutputTarStream(fgp, storage.NewJSONUnpacker(bytes.NewReader(w.Bytes()))))
+			if err != nil {
+				t.Fatalf("%T %s: %s", fgp, tc.path, err)
+			}
+			if i != tc.expectedSize {
+				t.Errorf("%T %s: size of output tar: expected %d; got %d", fgp, tc.path, tc.expectedSize, i)
+			}
+			if fmt.Sprintf("%x", h1.Sum(nil)) != tc.expectedSHA1Sum {
+				t.Errorf("%T %s: checksum of output tar: expected %s; got %x", fgp, tc.path, tc.expectedSHA1Sum, h1.Sum(nil))
+			}
+		}
+	}
+}
+
+func TestTarStreamTarFileGetter(t *testing.T) {
+	for _, tc := range testCases {
+		fh, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = fh.Close() }()
+		gzRdr, err := gzip.NewReader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// disassemble, and re-export the files with other headers, in reverse
+		w := bytes.NewBuffer([]byte{})
+		tarStream, err := NewInputTarStream(gzRdr, storage.NewJSONPacker(w), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		type file struct {
+			hdr  *tar.Header
+			body []byte
+		}
+		var files []file
+		tr := tar.NewReader(tarStream)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, file{hdr, body})
+		}
+		// the end-of-archive marker and any padding after it
+		if _, err := io.Copy(io.Discard, tarStream); err != nil {
+			t.Fatal(err)
+		}
+		reexported := bytes.NewBuffer(nil)
+		tw := tar.NewWriter(reexported)
+		for i := len(files) - 1; i >= 0; i-- {
+			hdr := *files[i].hdr
+			hdr.ModTime = time.Unix(0, 0)
+			hdr.Uname, hdr.Gname = "", ""
+			hdr.Format = tar.FormatPAX
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write(files[i].body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		fg, err := storage.NewTarFileGetter(bytes.NewReader(reexported.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h1 := sha1.New()
+		i, err := io.Copy(h1, NewOutputTarStream(fg, storage.NewJSONUnpacker(bytes.NewReader(w.Bytes()))))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.path, err)
+		}
+		if i != tc.expectedSize {
+			t.Errorf("%s: size of output tar: expected %d; got %d", tc.path, tc.expectedSize, i)
+		}
+		if fmt.Sprintf("%x", h1.Sum(nil)) != tc.expectedSHA1Sum {
+			t.Errorf("%s: checksum of output tar: expected %s; got %x", tc.path, tc.expectedSHA1Sum, h1.Sum(nil))
+		}
+	}
+}
+
+// inlineCheckGetter fails any Get for a payload that should have been inlined.
+type inlineCheckGetter struct {
+	storage.FileGetter
+	threshold int64
+}
+
+func (icg inlineCheckGetter) Get(entry *storage.Entry) (io.ReadCloser, error) {
+	if entry.Size <= icg.threshold {
+		return nil, fmt.Errorf("%q should have been inlined", entry.GetName())
+	}
+	return icg.FileGetter.Get(entry)
+}
+
+func TestTarStreamInline(t *testing.T) {
+	const threshold = 1024
+	for _, tc := range testCases {
+		fh, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = fh.Close() }()
+		gzRdr, err := gzip.NewReader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = gzRdr.Close() }()
+
+		w := bytes.NewBuffer([]byte{})
+		sp := storage.NewJSONPacker(w)
+		fgp := storage.NewBufferFileGetPutter()
+		tarStream, err := NewInputTarStreamWithOptions(gzRdr, sp, fgp, DisassembleOptions{InlineThreshold: threshold})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, tarStream); err != nil {
+			t.Fatal(err)
+		}
+
+		// the threshold leads the metadata
+		first, err := storage.NewJSONUnpacker(bytes.NewReader(w.Bytes())).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Type != storage.OptionType || first.Name != storage.InlineThresholdOption || first.Size != threshold {
+			t.Errorf("%s: expected the inline threshold to lead the metadata, got %+v", tc.path, first)
+		}
+
+		fg := inlineCheckGetter{FileGetter: fgp, threshold: threshold}
+		h1 := sha1.New()
+		i, err := io.Copy(h1, NewOutputTarStream(fg, storage.NewJSONUnpacker(bytes.NewReader(w.Bytes()))))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.path, err)
+		}
+		if i != tc.expectedSize {
+			t.Errorf("%s: size of output tar: expected %d; got %d", tc.path, tc.expectedSize, i)
+		}
+		if fmt.Sprintf("%x", h1.Sum(nil)) != tc.expectedSHA1Sum {
+			t.Errorf("%s: checksum of output tar: expected %s; got %x", tc.path, tc.expectedSHA1Sum, h1.Sum(nil))
+		}
+	}
+
+	// inlined payloads are still verified against their checksum
+	e := entries[0].Entry
+	e.Inline = []byte("imma derp til I hurr")
+	w := bytes.NewBuffer(nil)
+	if _, err := storage.NewJSONPacker(w).AddEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	err := WriteOutputTarStream(storage.NewBufferFileGetPutter(), storage.NewJSONUnpacker(w), io.Discard)
+	if err == nil {
+		t.Error("expected a checksum failure for a mangled inline payload")
+	}
+}
+
+func TestTarStreamPadding(t *testing.T) {
+	for _, rawPadding := range []bool{false, true} {
+		fh, err := os.Open("./testdata/t.tar.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = fh.Close() }()
+		gzRdr, err := gzip.NewReader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := bytes.NewBuffer([]byte{})
+		tarStream, err := NewInputTarStreamWithOptions(gzRdr, storage.NewJSONPacker(w), nil, DisassembleOptions{RawPadding: rawPadding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, tarStream); err != nil {
+			t.Fatal(err)
+		}
+
+		var padding int
+		up := storage.NewJSONUnpacker(bytes.NewReader(w.Bytes()))
+		for {
+			e, err := up.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Type == storage.PaddingType {
+				padding++
+			}
+		}
+		if rawPadding && padding > 0 {
+			t.Errorf("expected no padding entries with RawPadding, got %d", padding)
+		}
+		if !rawPadding && padding == 0 {
+			t.Error("expected padding entries")
+		}
+	}
+
+	// an unknown entry type is an error, rather than skipped
+	w := bytes.NewBuffer(nil)
+	if _, err := storage.NewJSONPacker(w).AddEntry(storage.Entry{Type: 99}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteOutputTarStream(storage.NewBufferFileGetPutter(), storage.NewJSONUnpacker(w), io.Discard); err == nil {
+		t.Error("expected an error for an unknown entry type")
+	}
+}
+
+func TestTarStreamHeaderEntries(t *testing.T) {
+	for _, tc := range testCases {
+		fh, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = fh.Close() }()
+		gzRdr, err := gzip.NewReader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := bytes.NewBuffer([]byte{})
+		fgp := storage.NewBufferFileGetPutter()
+		tarStream, err := NewInputTarStreamWithOptions(gzRdr, storage.NewJSONPacker(w), fgp, DisassembleOptions{HeaderEntries: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, tarStream); err != nil {
+			t.Fatal(err)
+		}
+
+		var headers int
+		up := storage.NewJSONUnpacker(bytes.NewReader(w.Bytes()))
+		for {
+			e, err := up.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Type == storage.HeaderType {
+				headers++
+			}
+		}
+		if headers == 0 {
+			t.Errorf("%s: expected header entries", tc.path)
+		}
+
+		h1 := sha1.New()
+		i, err := io.Copy(h1, NewOutputTarStream(fgp, storage.NewJSONUnpacker(bytes.NewReader(w.Bytes()))))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.path, err)
+		}
+		if i != tc.expectedSize {
+			t.Errorf("%s: size of output tar: expected %d; got %d", tc.path, tc.expectedSize, i)
+		}
+		if fmt.Sprintf("%x", h1.Sum(nil)) != tc.expectedSHA1Sum {
+			t.Errorf("%s: checksum of output tar: expected %s; got %x", tc.path, tc.expectedSHA1Sum, h1.Sum(nil))
+		}
+	}
+
+	// patches that do not fit the regenerated header are an error
+	e := storage.Entry{
+		Type:    storage.HeaderType,
+		Header:  &storage.Header{Typeflag: '0', Name: "file"},
+		Patches: []storage.Patch{{Offset: 1 << 20, Data: []byte("x")}},
+	}
+	w := bytes.NewBuffer(nil)
+	if _, err := storage.NewJSONPacker(w).AddEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteOutputTarStream(storage.NewBufferFileGetPutter(), storage.NewJSONUnpacker(w), io.Discard); err == nil {
+		t.Error("expected an error for patches out of range")
+	}
+
+	// as are fields that no longer regenerate the header packed
+	raw := make([]byte, blockSize)
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0o644, Format: tar.FormatUSTAR}
+	tw := tar.NewWriter(io.Discard)
+	tw.RawAccounting = true
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	copy(raw, tw.RawBytes())
+	entries := headerEntries(raw, hdr)
+	if len(entries) != 1 {
+		t.Fatalf("expected a header entry, got %v", entries)
+	}
+	if b, err := headerBytes(&entries[0]); err != nil || !bytes.Equal(b, raw) {
+		t.Fatalf("expected the header bytes packed, got %v", err)
+	}
+	entries[0].Header.Mode = 0o600
+	if _, err := headerBytes(&entries[0]); !errors.Is(err, ErrHeaderMismatch) {
+		t.Errorf("expected %v, got %v", ErrHeaderMismatch, err)
+	}
+}
+
 func BenchmarkAsm(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		for _, tc := range testCases {
@@ -0,0 +1,288 @@
+package asm
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// CreateOptions tunes how WriteTarFromFS lays out a new archive. The zero
+// value records the tree as the filesystem presents it.
+type CreateOptions struct {
+	// Sort orders the members of each directory by name, rather than the
+	// order the filesystem returns them in.
+	Sort bool
+
+	// ClampTime, when not zero, is the latest timestamp recorded in any
+	// header. Later modification, access and change times are clamped to it.
+	// This is typically parsed from SOURCE_DATE_EPOCH.
+	ClampTime time.Time
+
+	// AccessTimes records the access and change times of members, which the
+	// PAX and GNU formats encode. Reading or touching the tree changes them,
+	// so they are dropped unless set, for the same tree to give the same
+	// archive.
+	AccessTimes bool
+
+	// ZeroOwner records uid/gid 0 and empty user/group names for every member.
+	ZeroOwner bool
+
+	// Format fixes the header format. With tar.FormatUnknown, the Writer
+	// picks the first of USTAR, PAX or GNU able to encode each header.
+	Format tar.Format
+
+	// RawPadding packs runs of zero bytes as raw SegmentType bytes, as with
+	// DisassembleOptions.RawPadding.
+	RawPadding bool
+
+	// HeaderEntries packs headers as storage.HeaderType entries, as with
+	// DisassembleOptions.HeaderEntries.
+	HeaderEntries bool
+}
+
+// WriteTarFromDir is WriteTarFromFS for the directory tree rooted at dir on
+// the host filesystem.
+func WriteTarFromDir(dir string, w io.Writer, p storage.Packer, fp storage.FilePutter, opts CreateOptions) error {
+	return WriteTarFromFS(dirFS(dir), w, p, fp, opts)
+}
+
+// WriteTarFromFS writes a tar archive of fsys to w, while packing the
+// segments and file metadata to storage.Packer `p`, laid out as
+// NewInputTarStream would have packed the resulting archive.
+//
+// The storage.FilePutter is where payload of files are stashed. As with
+// NewInputTarStream, a nil storage.FilePutter only computes checksums.
+//
+// Symbolic links are recorded when fsys provides a
+// `ReadLink(name string) (string, error)` method. Sockets are skipped.
+//
+// Regular files of more than one link are archived in full once, and as hard
+// links to the first of them after, when fsys reports their device and inode
+// as the host filesystem does.
+func WriteTarFromFS(fsys fs.FS, w io.Writer, p storage.Packer, fp storage.FilePutter, opts CreateOptions) error {
+	if fp == nil {
+		fp = storage.NewDiscardFilePutter()
+	}
+	tw := tar.NewWriter(w)
+	tw.RawAccounting = true
+
+	pk := &disassembler{p: p, rawPadding: opts.RawPadding, headerEntries: opts.HeaderEntries}
+	addSegment := func() error {
+		if b := tw.RawBytes(); len(b) > 0 {
+			return pk.addSegment(b)
+		}
+		return nil
+	}
+
+	// the names regular files of more than one link were first archived as
+	links := map[fileID]string{}
+	err := walkFS(fsys, ".", opts.Sort, func(name string, d fs.DirEntry) error {
+		if name == "." {
+			return nil
+		}
+		hdr, err := createHeader(fsys, name, d, links, opts)
+		if err != nil || hdr == nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if b := tw.RawBytes(); len(b) > 0 {
+			if err := pk.addHeader(b, hdr); err != nil {
+				return err
+			}
+		}
+
+		var csum []byte
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			csum, err = putFSPayload(fsys, name, hdr, tw, fp)
+			if err != nil {
+				return err
+			}
+		}
+
+		entry := storage.Entry{
+			Type:    storage.FileType,
+			Size:    hdr.Size,
+			Payload: csum,
+		}
+		entry.SetName(hdr.Name)
+		return pk.addEntry(entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the padding of the last file, and the end-of-archive marker
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return addSegment()
+}
+
+// putFSPayload copies the file name of fsys through tw, while stashing it to
+// fp, and returns the checksum of the payload.
+func putFSPayload(fsys fs.FS, name string, hdr *tar.Header, tw *tar.Writer, fp storage.FilePutter) ([]byte, error) {
+	fh, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = fh.Close() }()
+
+	// limit the read, so a file growing underneath us is caught below rather
+	// than by the Writer as ErrWriteTooLong
+	n, csum, err := fp.Put(hdr.Name, io.TeeReader(io.LimitReader(fh, hdr.Size), tw))
+	if err != nil {
+		return nil, err
+	}
+	if n != hdr.Size {
+		return nil, fmt.Errorf("%q changed size while being archived: expected %d bytes, read %d", name, hdr.Size, n)
+	}
+	return csum, nil
+}
+
+// createHeader builds the tar header for the member name of fsys, applying
+// opts. A nil header is returned for members that can not be archived. A
+// regular file already in links is a hard link to the name it holds, and one
+// not yet in it is added.
+func createHeader(fsys fs.FS, name string, d fs.DirEntry, links map[fileID]string, opts CreateOptions) (*tar.Header, error) {
+	if d.Type()&fs.ModeSocket != 0 {
+		return nil, nil
+	}
+	fi, err := d.Info()
+	if err != nil {
+		return nil, err
+	}
+	var link string
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		rl, ok := fsys.(readLinkFS)
+		if !ok {
+			return nil, fmt.Errorf("%q is a symbolic link, but the filesystem can not read links", name)
+		}
+		if link, err = rl.ReadLink(name); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	if hdr.Typeflag == tar.TypeDir {
+		hdr.Name += "/"
+	}
+	if id, ok := hardLinkID(fi); ok && hdr.Typeflag == tar.TypeReg {
+		if first, ok := links[id]; ok {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+		} else {
+			links[id] = hdr.Name
+		}
+	}
+
+	if opts.ZeroOwner {
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+	}
+	if !opts.AccessTimes {
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	}
+	if !opts.ClampTime.IsZero() {
+		hdr.ModTime = clampTime(hdr.ModTime, opts.ClampTime)
+		hdr.AccessTime = clampTime(hdr.AccessTime, opts.ClampTime)
+		hdr.ChangeTime = clampTime(hdr.ChangeTime, opts.ClampTime)
+	}
+	hdr.Format = opts.Format
+	return hdr, nil
+}
+
+// fileID identifies a file by its device and inode, to find hard links.
+type fileID struct {
+	dev, ino uint64
+}
+
+func clampTime(t, max time.Time) time.Time {
+	if t.After(max) {
+		return max
+	}
+	return t
+}
+
+// walkFS calls fn for root and every member below it, parents before their
+// children. Unless sorted, members of a directory are visited in the order
+// the filesystem lists them.
+func walkFS(fsys fs.FS, root string, sorted bool, fn func(name string, d fs.DirEntry) error) error {
+	info, err := fs.Stat(fsys, root)
+	if err != nil {
+		return err
+	}
+	return walkDir(fsys, root, fs.FileInfoToDirEntry(info), sorted, fn)
+}
+
+func walkDir(fsys fs.FS, name string, d fs.DirEntry, sorted bool, fn func(name string, d fs.DirEntry) error) error {
+	if err := fn(name, d); err != nil || !d.IsDir() {
+		return err
+	}
+	dirs, err := readDir(fsys, name, sorted)
+	if err != nil {
+		return err
+	}
+	for _, child := range dirs {
+		childName := child.Name()
+		if name != "." {
+			childName = name + "/" + childName
+		}
+		if err := walkDir(fsys, childName, child, sorted, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDir(fsys fs.FS, name string, sorted bool) ([]fs.DirEntry, error) {
+	if sorted {
+		return fs.ReadDir(fsys, name)
+	}
+	fh, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = fh.Close() }()
+	dir, ok := fh.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("not implemented")}
+	}
+	return dir.ReadDir(-1)
+}
+
+// readLinkFS is implemented by filesystems that can report the target of a
+// symbolic link, such as the one returned by dirFS.
+type readLinkFS interface {
+	ReadLink(name string) (string, error)
+}
+
+// dirFS is os.DirFS, which also reads the targets of symbolic links.
+type dirFS string
+
+func (dir dirFS) Open(name string) (fs.File, error) {
+	return os.DirFS(string(dir)).Open(name)
+}
+
+func (dir dirFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Lstat(string(dir) + "/" + name)
+}
+
+func (dir dirFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Readlink(string(dir) + "/" + name)
+}
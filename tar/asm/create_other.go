@@ -0,0 +1,10 @@
+//go:build !unix
+
+package asm
+
+import "io/fs"
+
+// hardLinkID reports no file identities, so hard links are archived in full.
+func hardLinkID(fi fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,172 @@
+package asm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+func TestWriteTarFromFS(t *testing.T) {
+	epoch := time.Unix(1500000000, 0)
+	fsys := fstest.MapFS{
+		"b.txt":       {Data: []byte("bbbb"), Mode: 0644, ModTime: epoch.Add(time.Hour)},
+		"a/c.txt":     {Data: []byte("hello world"), Mode: 0600, ModTime: epoch.Add(-time.Hour)},
+		"a/empty.txt": {Mode: 0644, ModTime: epoch},
+		"a":           {Mode: 0755 | os.ModeDir, ModTime: epoch},
+	}
+
+	tarBuf := bytes.NewBuffer(nil)
+	metaBuf := bytes.NewBuffer(nil)
+	fgp := storage.NewBufferFileGetPutter()
+	opts := CreateOptions{
+		Sort:          true,
+		ClampTime:     epoch,
+		ZeroOwner:     true,
+		Format:        tar.FormatPAX,
+		HeaderEntries: true,
+	}
+	if err := WriteTarFromFS(fsys, tarBuf, storage.NewJSONPacker(metaBuf), fgp, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name    string
+		modTime time.Time
+	}{
+		{"a/", epoch},
+		{"a/c.txt", epoch.Add(-time.Hour)},
+		{"a/empty.txt", epoch},
+		{"b.txt", epoch},
+	}
+	tr := tar.NewReader(bytes.NewReader(tarBuf.Bytes()))
+	for _, exp := range expected {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != exp.name {
+			t.Errorf("expected member %q, got %q", exp.name, hdr.Name)
+		}
+		if !hdr.ModTime.Equal(exp.modTime) {
+			t.Errorf("%q: expected mtime %v, got %v", hdr.Name, exp.modTime, hdr.ModTime)
+		}
+		if hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%q: expected zeroed owner, got %d:%d (%q:%q)", hdr.Name, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected end of archive, got %v", err)
+	}
+
+	// the metadata and the stashed payloads reassemble the same archive
+	out := bytes.NewBuffer(nil)
+	if err := WriteOutputTarStream(fgp, storage.NewJSONUnpacker(metaBuf), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), tarBuf.Bytes()) {
+		t.Errorf("reassembled archive differs: expected %d bytes, got %d", tarBuf.Len(), out.Len())
+	}
+}
+
+func TestWriteTarFromDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "file"), []byte("some content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/file", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "sub", "file"), filepath.Join(dir, "sub", "hard")); err != nil {
+		t.Fatal(err)
+	}
+
+	tarBuf := bytes.NewBuffer(nil)
+	metaBuf := bytes.NewBuffer(nil)
+	if err := WriteTarFromDir(dir, tarBuf, storage.NewJSONPacker(metaBuf), nil, CreateOptions{Sort: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(tarBuf.Bytes()))
+	links, hardLinks := 0, 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			links++
+			if hdr.Name != "link" || hdr.Linkname != "sub/file" {
+				t.Errorf("expected link -> sub/file, got %s -> %s", hdr.Name, hdr.Linkname)
+			}
+		case tar.TypeLink:
+			hardLinks++
+			if hdr.Name != "sub/hard" || hdr.Linkname != "sub/file" || hdr.Size != 0 {
+				t.Errorf("expected sub/hard hard linked to sub/file, got %s -> %s of %d bytes", hdr.Name, hdr.Linkname, hdr.Size)
+			}
+		}
+	}
+	if links != 1 || hardLinks != 1 {
+		t.Errorf("expected 1 symlink and 1 hard link, got %d and %d", links, hardLinks)
+	}
+
+	// payloads come back from the tree we archived
+	out := bytes.NewBuffer(nil)
+	if err := WriteOutputTarStream(storage.NewPathFileGetter(dir), storage.NewJSONUnpacker(metaBuf), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), tarBuf.Bytes()) {
+		t.Errorf("reassembled archive differs: expected %d bytes, got %d", tarBuf.Len(), out.Len())
+	}
+}
+
+func TestWriteTarFromDirReproducible(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+	if err := os.WriteFile(name, []byte("some content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	create := func(atime time.Time, opts CreateOptions) []byte {
+		// reading the file moves its access time, and touching it its
+		// change time
+		if err := os.Chtimes(name, atime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		tarBuf := bytes.NewBuffer(nil)
+		if err := WriteTarFromDir(dir, tarBuf, storage.NewJSONPacker(io.Discard), nil, opts); err != nil {
+			t.Fatal(err)
+		}
+		return tarBuf.Bytes()
+	}
+
+	for _, format := range []tar.Format{tar.FormatPAX, tar.FormatGNU} {
+		opts := CreateOptions{Sort: true, Format: format}
+		if !bytes.Equal(create(mtime, opts), create(mtime.Add(time.Hour), opts)) {
+			t.Errorf("%v: expected the same archive of the same tree", format)
+		}
+
+		opts.AccessTimes = true
+		tr := tar.NewReader(bytes.NewReader(create(mtime.Add(time.Hour), opts)))
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hdr.AccessTime.Equal(mtime.Add(time.Hour)) {
+			t.Errorf("%v: expected the access time recorded, got %v", format, hdr.AccessTime)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package asm
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// hardLinkID returns the identity of the file of fi, if it has more than one
+// link.
+func hardLinkID(fi fs.FileInfo) (fileID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
@@ -0,0 +1,335 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// ChangeKind is how a member differs between two archives.
+type ChangeKind int
+
+const (
+	// EntryAdded is a member only in the new archive.
+	EntryAdded ChangeKind = iota
+	// EntryRemoved is a member only in the old archive.
+	EntryRemoved
+	// ContentChanged is a member of a different size or payload checksum,
+	// and maybe metadata too.
+	ContentChanged
+	// MetadataChanged is a member of the same payload but of different
+	// decoded header fields, such as its mode, owner or modification time.
+	MetadataChanged
+	// EncodingChanged is a member of the same payload and header fields, but
+	// different header bytes, such as a long name in a PAX record rather
+	// than a GNU one.
+	EncodingChanged
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case EntryAdded:
+		return "added"
+	case EntryRemoved:
+		return "removed"
+	case ContentChanged:
+		return "content"
+	case MetadataChanged:
+		return "metadata"
+	case EncodingChanged:
+		return "encoding"
+	}
+	return "unknown"
+}
+
+// Change is a member that differs between two archives.
+type Change struct {
+	Kind ChangeKind
+	// Name is the name of the member, without leading "/" and "./", nor
+	// trailing "/", so "" for the top directory.
+	Name string
+	// Index is which of the members of that name it is, 0 for the first, as
+	// an archive may hold several.
+	Index int
+	// Global is whether the member is a PAX global header. Those are matched
+	// by their order, Index among the global headers of the archive, rather
+	// than by name.
+	Global bool
+	// Old and New are the member in each archive, Old nil if it was added
+	// and New nil if it was removed.
+	Old, New *Record
+	// Fields are the names of the header fields that differ: "type",
+	// "mode", "uid", "gid", "uname", "gname", "mtime", "atime", "ctime",
+	// "linkname", "devmajor", "devminor" and "xattrs", or "records" for the
+	// records of a global header.
+	Fields []string
+}
+
+// ArchiveDiff is how two archives differ, member by member.
+type ArchiveDiff struct {
+	// Changes are sorted by name, global headers first.
+	Changes []Change
+	// Reordered is whether the members of both archives are in a different
+	// order, which makes them differ even without any Changes.
+	Reordered bool
+	// TrailerChanged is whether what follows the padding of the last member
+	// differs, such as the end-of-archive marker padded to another record
+	// size. OldTrailer and NewTrailer are its size in each archive.
+	TrailerChanged         bool
+	OldTrailer, NewTrailer int64
+}
+
+// Differs returns whether the archives differ at all.
+func (d *ArchiveDiff) Differs() bool {
+	return len(d.Changes) > 0 || d.Reordered || d.TrailerChanged
+}
+
+// DiffArchives compares the members of the archives of the metadata read from
+// a and b, matched by name, and by order among those of the same name. PAX
+// global headers are matched by their order, and what follows the last member
+// is compared as a whole.
+func DiffArchives(a, b storage.Unpacker) (*ArchiveDiff, error) {
+	oldArchive, err := readRecords(a)
+	if err != nil {
+		return nil, err
+	}
+	newArchive, err := readRecords(b)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &ArchiveDiff{
+		TrailerChanged: oldArchive.trailer != newArchive.trailer,
+		OldTrailer:     oldArchive.trailer.size,
+		NewTrailer:     newArchive.trailer.size,
+	}
+	var oldCommon, newCommon []string
+	for _, key := range oldArchive.keys {
+		old, rec := oldArchive.records[key], newArchive.records[key]
+		if rec == nil {
+			diff.Changes = append(diff.Changes, Change{Kind: EntryRemoved, Name: key.name, Index: key.index, Global: key.global, Old: old})
+			continue
+		}
+		if !key.global {
+			oldCommon = append(oldCommon, key.String())
+		}
+		change := Change{Name: key.name, Index: key.index, Global: key.global, Old: old, New: rec}
+		if key.global {
+			if !equalRecords(old.Header.PAXRecords, rec.Header.PAXRecords) {
+				change.Fields = []string{"records"}
+			}
+		} else {
+			change.Fields = diffHeaders(old.Header, rec.Header)
+		}
+		switch {
+		case old.Entry.Size != rec.Entry.Size || !bytes.Equal(old.Entry.Payload, rec.Entry.Payload):
+			change.Kind = ContentChanged
+		case len(change.Fields) > 0:
+			change.Kind = MetadataChanged
+		case !bytes.Equal(old.Raw, rec.Raw):
+			change.Kind = EncodingChanged
+		default:
+			continue
+		}
+		diff.Changes = append(diff.Changes, change)
+	}
+	for _, key := range newArchive.keys {
+		if oldArchive.records[key] == nil {
+			diff.Changes = append(diff.Changes, Change{Kind: EntryAdded, Name: key.name, Index: key.index, Global: key.global, New: newArchive.records[key]})
+			continue
+		}
+		if !key.global {
+			newCommon = append(newCommon, key.String())
+		}
+	}
+	sort.SliceStable(diff.Changes, func(i, j int) bool {
+		a, b := diff.Changes[i], diff.Changes[j]
+		if a.Global != b.Global {
+			return a.Global
+		}
+		if a.Global {
+			return a.Index < b.Index
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Index < b.Index
+	})
+	diff.Reordered = strings.Join(oldCommon, "\x00") != strings.Join(newCommon, "\x00")
+	return diff, nil
+}
+
+// recordKey matches the members of two archives.
+type recordKey struct {
+	global bool
+	name   string
+	index  int
+}
+
+func (k recordKey) String() string {
+	return fmt.Sprintf("%s#%d", k.name, k.index)
+}
+
+// archiveTrailer is what follows the padding of the last member of an
+// archive, by its size and crc64 checksum.
+type archiveTrailer struct {
+	size int64
+	sum  uint64
+}
+
+// archiveRecords are the members of an archive, by key.
+type archiveRecords struct {
+	// keys are in the order of the members
+	keys    []recordKey
+	records map[recordKey]*Record
+	trailer archiveTrailer
+}
+
+// readRecords reads the members of the archive of the metadata read from up.
+func readRecords(up storage.Unpacker) (*archiveRecords, error) {
+	archive := &archiveRecords{records: map[recordKey]*Record{}}
+	tu := &trailerUnpacker{up: up}
+	rr := NewRecordReader(tu)
+	counts := map[string]int{}
+	globals := 0
+	var last *Record
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		last = rec
+		key := recordKey{name: cleanMemberName(rec.Header.Name)}
+		if rec.Header.Typeflag == tar.TypeXGlobalHeader {
+			key.global, key.index = true, globals
+			globals++
+		} else {
+			key.index = counts[key.name]
+			counts[key.name]++
+		}
+		archive.keys = append(archive.keys, key)
+		archive.records[key] = rec
+	}
+
+	// the last member is padded to a block, as its payload or records are
+	var pad int64
+	if last != nil {
+		pad = (blockSize - (int64(len(last.Raw))+last.Entry.Size)%blockSize) % blockSize
+	}
+	h := crc64.New(storage.CRCTable)
+	for _, entry := range tu.trailer {
+		var b []byte
+		size := entry.Size
+		if entry.Type == storage.SegmentType {
+			b, size = entry.Payload, int64(len(entry.Payload))
+		}
+		skip := pad
+		if skip > size {
+			skip = size
+		}
+		pad -= skip
+		size -= skip
+		if b != nil {
+			h.Write(b[skip:])
+		} else if err := writeZeros(h, size); err != nil {
+			return nil, err
+		}
+		archive.trailer.size += size
+	}
+	archive.trailer.sum = h.Sum64()
+	return archive, nil
+}
+
+// trailerUnpacker keeps the entries read from up since its last FileType
+// entry, which past the last member are what follows it.
+type trailerUnpacker struct {
+	up      storage.Unpacker
+	trailer []*storage.Entry
+}
+
+func (tu *trailerUnpacker) Next() (*storage.Entry, error) {
+	entry, err := tu.up.Next()
+	if err != nil {
+		return nil, err
+	}
+	switch entry.Type {
+	case storage.FileType:
+		tu.trailer = tu.trailer[:0]
+	case storage.SegmentType, storage.PaddingType:
+		tu.trailer = append(tu.trailer, entry)
+	}
+	return entry, nil
+}
+
+// diffHeaders returns the names of the fields that differ between a and b.
+func diffHeaders(a, b *tar.Header) []string {
+	var fields []string
+	add := func(field string, differ bool) {
+		if differ {
+			fields = append(fields, field)
+		}
+	}
+	add("type", a.Typeflag != b.Typeflag)
+	add("mode", a.Mode != b.Mode)
+	add("uid", a.Uid != b.Uid)
+	add("gid", a.Gid != b.Gid)
+	add("uname", a.Uname != b.Uname)
+	add("gname", a.Gname != b.Gname)
+	add("mtime", !a.ModTime.Equal(b.ModTime))
+	add("atime", !a.AccessTime.Equal(b.AccessTime))
+	add("ctime", !a.ChangeTime.Equal(b.ChangeTime))
+	add("linkname", a.Linkname != b.Linkname)
+	add("devmajor", a.Devmajor != b.Devmajor)
+	add("devminor", a.Devminor != b.Devminor)
+	add("xattrs", !equalXattrs(a.PAXRecords, b.PAXRecords))
+	return fields
+}
+
+// paxXattrPrefix is the prefix of the PAX records of extended attributes.
+const paxXattrPrefix = "SCHILY.xattr."
+
+func equalXattrs(a, b map[string]string) bool {
+	count := func(records map[string]string) int {
+		n := 0
+		for key := range records {
+			if strings.HasPrefix(key, paxXattrPrefix) {
+				n++
+			}
+		}
+		return n
+	}
+	if count(a) != count(b) {
+		return false
+	}
+	for key, value := range a {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// equalRecords returns whether the PAX records a and b are the same.
+func equalRecords(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
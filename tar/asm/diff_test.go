@@ -0,0 +1,149 @@
+package asm
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+func TestDiffArchives(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	longName := "usr/" + strings.Repeat("long/", 30) + "name"
+	file := func(name, body string) testMember {
+		return testMember{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, ModTime: mtime}, body: body}
+	}
+	metadata := func(members ...testMember) *bytes.Buffer {
+		w, _ := disassembleTestArchive(t, writeTestArchive(t, members...))
+		return w
+	}
+
+	chmod := file("etc/mode", "mode")
+	chmod.hdr.Mode = 0o600
+	xattr := file("etc/xattr", "xattr")
+	xattr.hdr.PAXRecords = map[string]string{"SCHILY.xattr.user.a": "1"}
+	newXattr := xattr
+	newXattr.hdr.PAXRecords = map[string]string{"SCHILY.xattr.user.a": "2"}
+	gnuName, paxName := file(longName, "long"), file(longName, "long")
+	gnuName.hdr.Format, paxName.hdr.Format = tar.FormatGNU, tar.FormatPAX
+	dotted := file("./etc/same", "same")
+
+	a := metadata(
+		file("etc/hosts", "127.0.0.1 localhost\n"),
+		file("etc/mode", "mode"),
+		xattr,
+		gnuName,
+		file("etc/same", "same"),
+		file("etc/old", "old"),
+	)
+	b := metadata(
+		file("etc/hosts", "::1 localhost\n"),
+		chmod,
+		newXattr,
+		paxName,
+		dotted,
+		file("etc/new", "new"),
+	)
+	diff, err := DiffArchives(storage.NewJSONUnpacker(a), storage.NewJSONUnpacker(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		kind   ChangeKind
+		name   string
+		fields string
+	}{
+		{ContentChanged, "etc/hosts", ""},
+		{MetadataChanged, "etc/mode", "mode"},
+		{EntryAdded, "etc/new", ""},
+		{EntryRemoved, "etc/old", ""},
+		{EncodingChanged, "etc/same", ""},
+		{MetadataChanged, "etc/xattr", "xattrs"},
+		{EncodingChanged, longName, ""},
+	}
+	if len(diff.Changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %d: %v", len(expected), len(diff.Changes), diff.Changes)
+	}
+	for i, change := range diff.Changes {
+		if change.Kind != expected[i].kind || change.Name != expected[i].name || strings.Join(change.Fields, ",") != expected[i].fields {
+			t.Errorf("expected %s %q %q, got %s %q %q", expected[i].kind, expected[i].name, expected[i].fields, change.Kind, change.Name, change.Fields)
+		}
+	}
+	if diff.Reordered {
+		t.Error("expected the members to be in the same order")
+	}
+
+	a = metadata(file("a", "a"), file("b", "b"))
+	b = metadata(file("b", "b"), file("a", "a"))
+	diff, err = DiffArchives(storage.NewJSONUnpacker(a), storage.NewJSONUnpacker(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Changes) != 0 || !diff.Reordered || diff.TrailerChanged || !diff.Differs() {
+		t.Errorf("expected only the order to differ, got %v and reordered %v", diff.Changes, diff.Reordered)
+	}
+
+	// members of the same name are matched in order, and global headers by
+	// their order
+	a = metadata(
+		testMember{hdr: tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "global", PAXRecords: map[string]string{"comment": "old"}}},
+		file("/etc/dup", "first"),
+		file("etc/dup", "second"),
+	)
+	b = metadata(
+		testMember{hdr: tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "global", PAXRecords: map[string]string{"comment": "new"}}},
+		file("/etc/dup", "first"),
+		testMember{hdr: tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "global2", PAXRecords: map[string]string{"comment": "added"}}},
+	)
+	diff, err = DiffArchives(storage.NewJSONUnpacker(a), storage.NewJSONUnpacker(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedChanges := []Change{
+		{Kind: MetadataChanged, Name: "global", Global: true, Fields: []string{"records"}},
+		{Kind: EntryAdded, Name: "global2", Index: 1, Global: true},
+		{Kind: EntryRemoved, Name: "etc/dup", Index: 1},
+	}
+	if len(diff.Changes) != len(expectedChanges) {
+		t.Fatalf("expected %d changes, got %d: %v", len(expectedChanges), len(diff.Changes), diff.Changes)
+	}
+	for i, change := range diff.Changes {
+		e := expectedChanges[i]
+		if change.Kind != e.Kind || change.Name != e.Name || change.Index != e.Index || change.Global != e.Global || strings.Join(change.Fields, ",") != strings.Join(e.Fields, ",") {
+			t.Errorf("expected %s %q %d global %v, got %s %q %d global %v", e.Kind, e.Name, e.Index, e.Global, change.Kind, change.Name, change.Index, change.Global)
+		}
+	}
+	if diff.Reordered {
+		t.Error("expected the members to be in the same order")
+	}
+
+	// what follows the padding of the last member is compared
+	archive := writeTestArchive(t, file("a", "a"))
+	a, _ = disassembleTestArchive(t, bytes.NewReader(archive.Bytes()))
+	b, _ = disassembleTestArchive(t, io.MultiReader(archive, bytes.NewReader(make([]byte, 8*blockSize))))
+	diff, err = DiffArchives(storage.NewJSONUnpacker(a), storage.NewJSONUnpacker(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Changes) != 0 || !diff.TrailerChanged || diff.OldTrailer != 2*blockSize || diff.NewTrailer != 10*blockSize || !diff.Differs() {
+		t.Errorf("expected only the trailer to differ, got %v and trailer %v (%d -> %d)", diff.Changes, diff.TrailerChanged, diff.OldTrailer, diff.NewTrailer)
+	}
+	diff, err = DiffArchives(storage.NewJSONUnpacker(metadata(file("a", "a"))), storage.NewJSONUnpacker(metadata(file("a", "abc"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Changes) != 1 || diff.TrailerChanged {
+		t.Errorf("expected only the payload to differ, got %v and trailer %v (%d -> %d)", diff.Changes, diff.TrailerChanged, diff.OldTrailer, diff.NewTrailer)
+	}
+	diff, err = DiffArchives(storage.NewJSONUnpacker(metadata(file("a", "a"))), storage.NewJSONUnpacker(metadata(file("a", "a"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Differs() {
+		t.Errorf("expected the archives not to differ, got %+v", diff)
+	}
+}
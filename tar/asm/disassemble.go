@@ -2,11 +2,38 @@ package asm
 
 import (
 	"io"
+	"os"
 
 	"github.com/bmoylan/tar-split/archive/tar"
 	"github.com/bmoylan/tar-split/tar/storage"
 )
 
+// DisassembleOptions tunes how NewInputTarStreamWithOptions packs a tar
+// stream. The zero value packs it as NewInputTarStream does.
+type DisassembleOptions struct {
+	// Limits bounds the resources spent on an untrusted stream.
+	Limits Limits
+
+	// InlineThreshold, when greater than zero, embeds file payloads of at
+	// most this many bytes in their FileType entry, as Entry.Inline. Inlined
+	// payloads are not passed to the storage.FilePutter, and are assembled
+	// without a call to the storage.FileGetter. The threshold is recorded
+	// as a leading storage.OptionType entry, which unpackers that predate
+	// it fail on.
+	InlineThreshold int64
+
+	// RawPadding packs runs of zero bytes as raw SegmentType bytes, rather
+	// than as storage.PaddingType entries. Unpackers that predate
+	// PaddingType can only read metadata packed with RawPadding.
+	RawPadding bool
+
+	// HeaderEntries packs headers as storage.HeaderType entries, holding
+	// their fields and how their raw bytes differ from those the forked
+	// archive/tar Writer produces for the fields. Headers are left as raw
+	// bytes when that is smaller.
+	HeaderEntries bool
+}
+
 // NewInputTarStream wraps the Reader stream of a tar archive and provides a
 // Reader stream of the same.
 //
@@ -18,6 +45,13 @@ import (
 // storage.FilePutter. Since the checksumming is still needed, then a default
 // of NewDiscardFilePutter will be used internally
 func NewInputTarStream(r io.Reader, p storage.Packer, fp storage.FilePutter) (io.Reader, error) {
+	return NewInputTarStreamWithOptions(r, p, fp, DisassembleOptions{})
+}
+
+// NewInputTarStreamWithOptions is NewInputTarStream, packing the stream as
+// tuned by opts. Exceeding opts.Limits fails the returned Reader with an
+// error wrapping the violated limit's error.
+func NewInputTarStreamWithOptions(r io.Reader, p storage.Packer, fp storage.FilePutter, opts DisassembleOptions) (io.Reader, error) {
 	// What to do here... folks will want their own access to the Reader that is
 	// their tar archive stream, but we'll need that same stream to use our
 	// forked 'archive/tar'.
@@ -38,23 +72,127 @@ func NewInputTarStream(r io.Reader, p storage.Packer, fp storage.FilePutter) (io
 	outputRdr := io.TeeReader(r, pW)
 
 	go func() {
-		err := readTarInputStream(outputRdr, p, fp)
+		err := readTarInputStream(outputRdr, nil, p, fp, opts)
 		_ = pW.CloseWithError(err)
 	}()
 
 	return pR, nil
 }
 
+// DisassembleFile packs the tar archive f, from its current offset, as
+// NewInputTarStreamWithOptions does, but without passing it through to a
+// Reader. When fp is a storage.FileCopyPutter, payloads are not read by the
+// disassembler, but stored with PutFile straight out of f, which can make
+// splitting an archive on a copy-on-write filesystem nearly free.
+func DisassembleFile(f *os.File, p storage.Packer, fp storage.FilePutter, opts DisassembleOptions) error {
+	return readTarInputStream(f, f, p, fp, opts)
+}
+
+// disassembler packs entries, within the limits of the stream.
+type disassembler struct {
+	p             storage.Packer
+	limits        Limits
+	rawPadding    bool
+	headerEntries bool
+	entries       int64
+}
+
+func (d *disassembler) addEntry(e storage.Entry) error {
+	if max := d.limits.MaxEntries; max > 0 && d.entries >= max {
+		return limitError(ErrTooManyEntries, max)
+	}
+	if _, err := d.p.AddEntry(e); err != nil {
+		return err
+	}
+	d.entries++
+	return nil
+}
+
+func (d *disassembler) addSegment(b []byte) error {
+	if max := d.limits.MaxSegmentSize; max > 0 && int64(len(b)) > max {
+		return limitError(ErrSegmentTooLarge, max)
+	}
+	if d.rawPadding {
+		return d.addEntry(storage.Entry{
+			Type:    storage.SegmentType,
+			Payload: b,
+		})
+	}
+	for _, e := range storage.SegmentEntries(b) {
+		if err := d.addEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addHeader packs the raw bytes b read for hdr, which are the padding of the
+// previous file and the header blocks.
+func (d *disassembler) addHeader(b []byte, hdr *tar.Header) error {
+	if !d.headerEntries {
+		return d.addSegment(b)
+	}
+	if max := d.limits.MaxSegmentSize; max > 0 && int64(len(b)) > max {
+		return limitError(ErrSegmentTooLarge, max)
+	}
+	entries := headerEntries(b, hdr)
+	if entries == nil {
+		return d.addSegment(b)
+	}
+	for _, e := range entries {
+		if err := d.addEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *disassembler) checkName(name string) error {
+	if max := d.limits.MaxNameLength; max > 0 && len(name) > max {
+		return limitError(ErrNameTooLong, int64(max))
+	}
+	return nil
+}
+
 // readTarInputStream processes a tar reader, passing entries to the Packer and FilePutter.
-func readTarInputStream(outputRdr io.Reader, p storage.Packer, fp storage.FilePutter) error {
+// If outputRdr is the file src, payloads may be copied straight out of it.
+func readTarInputStream(outputRdr io.Reader, src *os.File, p storage.Packer, fp storage.FilePutter, opts DisassembleOptions) error {
 	// we need a putter that will generate the crc64 sums of file payloads
 	if fp == nil {
 		fp = storage.NewDiscardFilePutter()
 	}
+	cp, _ := fp.(storage.FileCopyPutter)
+	if src == nil {
+		cp = nil
+	}
+	d := &disassembler{
+		p:             p,
+		limits:        opts.Limits,
+		rawPadding:    opts.RawPadding,
+		headerEntries: opts.HeaderEntries,
+	}
+	if opts.InlineThreshold > 0 {
+		if err := d.addEntry(storage.Entry{
+			Type: storage.OptionType,
+			Name: storage.InlineThresholdOption,
+			Size: opts.InlineThreshold,
+		}); err != nil {
+			return err
+		}
+	}
 	tr := tar.NewReader(outputRdr)
 	tr.RawAccounting = true
+	tr.MaxRawBytes = opts.Limits.MaxHeaderSize
 	for {
 		hdr, err := tr.Next()
+		if err == tar.ErrInsecurePath {
+			// the archive is preserved as-is, it is not extracted. Leave
+			// the decision on such names to whoever unpacks it.
+			err = nil
+		}
+		if err == tar.ErrRawTooLong {
+			return limitError(ErrHeaderTooLarge, opts.Limits.MaxHeaderSize)
+		}
 		if err != nil {
 			if err != io.EOF {
 				return err
@@ -62,11 +200,7 @@ func readTarInputStream(outputRdr io.Reader, p storage.Packer, fp storage.FilePu
 			// even when an EOF is reached, there is often 1024 null bytes on
 			// the end of an archive. Collect them too.
 			if b := tr.RawBytes(); len(b) > 0 {
-				_, err := p.AddEntry(storage.Entry{
-					Type:    storage.SegmentType,
-					Payload: b,
-				})
-				if err != nil {
+				if err := d.addSegment(b); err != nil {
 					return err
 				}
 			}
@@ -75,19 +209,31 @@ func readTarInputStream(outputRdr io.Reader, p storage.Packer, fp storage.FilePu
 		if hdr == nil {
 			break // not return. We need the end of the reader.
 		}
+		if err := d.checkName(hdr.Name); err != nil {
+			return err
+		}
+		if err := d.checkName(hdr.Linkname); err != nil {
+			return err
+		}
 
 		if b := tr.RawBytes(); len(b) > 0 {
-			_, err := p.AddEntry(storage.Entry{
-				Type:    storage.SegmentType,
-				Payload: b,
-			})
-			if err != nil {
+			if err := d.addHeader(b, hdr); err != nil {
 				return err
 			}
 		}
 
-		var csum []byte
-		if hdr.Size > 0 {
+		var csum, inline []byte
+		if hdr.Size > 0 && hdr.Size <= opts.InlineThreshold {
+			inline, csum, err = readInline(tr, hdr.Size)
+			if err != nil {
+				return err
+			}
+		} else if hdr.Size > 0 && cp != nil {
+			csum, err = copyPayload(tr, src, cp, hdr)
+			if err != nil {
+				return err
+			}
+		} else if hdr.Size > 0 {
 			var err error
 			_, csum, err = fp.Put(hdr.Name, tr)
 			if err != nil {
@@ -99,22 +245,18 @@ func readTarInputStream(outputRdr io.Reader, p storage.Packer, fp storage.FilePu
 			Type:    storage.FileType,
 			Size:    hdr.Size,
 			Payload: csum,
+			Inline:  inline,
 		}
 		// For proper marshalling of non-utf8 characters
 		entry.SetName(hdr.Name)
 
 		// File entries added, regardless of size
-		_, err = p.AddEntry(entry)
-		if err != nil {
+		if err := d.addEntry(entry); err != nil {
 			return err
 		}
 
 		if b := tr.RawBytes(); len(b) > 0 {
-			_, err = p.AddEntry(storage.Entry{
-				Type:    storage.SegmentType,
-				Payload: b,
-			})
-			if err != nil {
+			if err := d.addSegment(b); err != nil {
 				return err
 			}
 		}
@@ -127,20 +269,25 @@ func readTarInputStream(outputRdr io.Reader, p storage.Packer, fp storage.FilePu
 	// into memory.
 	const paddingChunkSize = 1024 * 1024
 	var paddingChunk [paddingChunkSize]byte
+	chunk := paddingChunk[:]
+	if max := opts.Limits.MaxSegmentSize; max > 0 && max < paddingChunkSize {
+		chunk = paddingChunk[:max]
+	}
+	var padding int64
 	for {
 		var isEOF bool
-		n, err := outputRdr.Read(paddingChunk[:])
+		n, err := outputRdr.Read(chunk)
 		if err != nil {
 			if err != io.EOF {
 				return err
 			}
 			isEOF = true
 		}
-		_, err = p.AddEntry(storage.Entry{
-			Type:    storage.SegmentType,
-			Payload: paddingChunk[:n],
-		})
-		if err != nil {
+		padding += int64(n)
+		if max := opts.Limits.MaxPaddingSize; max > 0 && padding > max {
+			return limitError(ErrPaddingTooLarge, max)
+		}
+		if err := d.addSegment(chunk[:n]); err != nil {
 			return err
 		}
 		if isEOF {
@@ -149,3 +296,37 @@ func readTarInputStream(outputRdr io.Reader, p storage.Packer, fp storage.FilePu
 	}
 	return nil
 }
+
+// copyPayload stores the payload of hdr with cp, straight out of src, the file
+// tr reads, and skips tr past it. Sparse payloads are read through tr.
+func copyPayload(tr *tar.Reader, src *os.File, cp storage.FileCopyPutter, hdr *tar.Header) ([]byte, error) {
+	off, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	skipped, err := tr.SkipPayload()
+	if err != nil {
+		return nil, err
+	}
+	if !skipped {
+		_, csum, err := cp.Put(hdr.Name, tr)
+		return csum, err
+	}
+	if _, err := src.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	_, csum, err := cp.PutFile(hdr.Name, src, hdr.Size)
+	return csum, err
+}
+
+// readInline reads the size bytes of a payload to be inlined, and their
+// checksum.
+func readInline(r io.Reader, size int64) ([]byte, []byte, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+	h := storage.NewHash()
+	_, _ = h.Write(buf)
+	return buf, h.Sum(nil), nil
+}
@@ -2,9 +2,15 @@ package asm
 
 import (
 	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/bmoylan/tar-split/tar/storage"
@@ -69,3 +75,135 @@ func TestLargeJunkPadding(t *testing.T) {
 	// At this point, if we haven't crashed then we are not vulnerable to
 	// CVE-2017-14992.
 }
+
+func TestLimits(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Name: strings.Repeat("a", 200), Typeflag: tar.TypeReg, Size: 5},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: strings.Repeat("b", 300)},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, strings.Repeat("c", int(hdr.Size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// junk past the end-of-archive marker
+	buf.Write(make([]byte, 4096))
+
+	vectors := []struct {
+		limits  Limits
+		wantErr error
+	}{
+		{Limits{}, nil},
+		{Limits{MaxHeaderSize: 1 << 20, MaxSegmentSize: 1 << 20, MaxEntries: 100, MaxNameLength: 300, MaxPaddingSize: 4096}, nil},
+		{Limits{MaxHeaderSize: 1024}, ErrHeaderTooLarge},
+		{Limits{MaxSegmentSize: 1024}, ErrSegmentTooLarge},
+		{Limits{MaxEntries: 4}, ErrTooManyEntries},
+		{Limits{MaxNameLength: 255}, ErrNameTooLong},
+		{Limits{MaxPaddingSize: 1024}, ErrPaddingTooLarge},
+	}
+	for i, v := range vectors {
+		metaBuf := bytes.NewBuffer(nil)
+		rdr, err := NewInputTarStreamWithOptions(bytes.NewReader(buf.Bytes()), storage.NewJSONPacker(metaBuf), nil, DisassembleOptions{Limits: v.limits})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(io.Discard, rdr)
+		if v.wantErr == nil {
+			if err != nil {
+				t.Errorf("test %d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if !errors.Is(err, v.wantErr) {
+			t.Errorf("test %d: expected error %v, got %v", i, v.wantErr, err)
+		}
+	}
+}
+
+func TestDisassembleFile(t *testing.T) {
+	for _, tc := range testCases {
+		fh, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = fh.Close() }()
+		gzRdr, err := gzip.NewReader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := os.CreateTemp(t.TempDir(), "src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = src.Close() }()
+		if _, err := io.Copy(src, gzRdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+
+		cs, err := storage.NewChecksumStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := bytes.NewBuffer(nil)
+		if err := DisassembleFile(src, storage.NewJSONPacker(w), cs, DisassembleOptions{}); err != nil {
+			t.Fatalf("%s: %s", tc.path, err)
+		}
+
+		// assembled to a regular file, payloads are copied from the store
+		dst, err := os.CreateTemp(t.TempDir(), "dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = dst.Close() }()
+		if err := WriteOutputTarStream(cs, storage.NewJSONUnpacker(bytes.NewReader(w.Bytes())), dst); err != nil {
+			t.Fatalf("%s: %s", tc.path, err)
+		}
+		if _, err := dst.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		h := sha1.New()
+		i, err := io.Copy(h, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != tc.expectedSize {
+			t.Errorf("%s: size of output tar: expected %d; got %d", tc.path, tc.expectedSize, i)
+		}
+		if fmt.Sprintf("%x", h.Sum(nil)) != tc.expectedSHA1Sum {
+			t.Errorf("%s: checksum of output tar: expected %s; got %x", tc.path, tc.expectedSHA1Sum, h.Sum(nil))
+		}
+	}
+}
+
+func TestWriteOutputTarStreamFileChecksum(t *testing.T) {
+	dir := t.TempDir()
+	w := bytes.NewBuffer(nil)
+	sp := storage.NewJSONPacker(w)
+	for _, e := range entriesMangled[:1] {
+		if err := os.WriteFile(filepath.Join(dir, e.Entry.GetName()), e.Body, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sp.AddEntry(e.Entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst, err := os.CreateTemp(dir, "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = dst.Close() }()
+	err = WriteOutputTarStream(storage.NewPathFileGetter(dir), storage.NewJSONUnpacker(w), dst)
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected the mangled payload copied to a file to fail its checksum, got %v", err)
+	}
+}
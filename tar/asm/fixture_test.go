@@ -0,0 +1,54 @@
+package asm
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// testMember is a member of an archive written by a test.
+type testMember struct {
+	hdr  tar.Header
+	body string
+}
+
+// writeTestArchive writes the members as an archive with the forked Writer,
+// each of the size of its body.
+func writeTestArchive(t *testing.T, members ...testMember) *bytes.Buffer {
+	t.Helper()
+	archive := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(archive)
+	for _, m := range members {
+		hdr := m.hdr
+		hdr.Size = int64(len(m.body))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, m.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+// disassembleTestArchive disassembles archive, returning its metadata and its
+// payloads.
+func disassembleTestArchive(t *testing.T, archive io.Reader) (*bytes.Buffer, storage.FileGetPutter) {
+	t.Helper()
+	w := bytes.NewBuffer(nil)
+	fgp := storage.NewBufferFileGetPutter()
+	tarStream, err := NewInputTarStream(archive, storage.NewJSONPacker(w), fgp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, tarStream); err != nil {
+		t.Fatal(err)
+	}
+	return w, fgp
+}
@@ -0,0 +1,343 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// maxSymlinks bounds the symbolic links followed resolving a name, as
+// Linux does.
+const maxSymlinks = 40
+
+// FS is a read-only fs.FS of the file tree of a split archive, as described
+// by its metadata, with file payloads gotten from a storage.FileGetter as
+// they are read. It implements fs.ReadDirFS and fs.StatFS.
+//
+// Modes, times and owners are those of the decoded headers; the Sys method of
+// a fs.FileInfo returns the *tar.Header. Directories missing from the archive
+// are implied, with mode 0755. When a name occurs more than once, the last
+// member wins, as when extracting.
+//
+// Open and Stat follow symbolic links within the tree, absolute ones being
+// relative to its root. ReadLink and Lstat do not.
+type FS struct {
+	root *fsNode
+	fg   storage.FileGetter
+}
+
+type fsNode struct {
+	hdr      *tar.Header
+	entry    *storage.Entry
+	children map[string]*fsNode // of directories
+}
+
+// NewFS reads the metadata of an archive from up, and returns an FS of its
+// file tree, getting payloads from fg.
+func NewFS(up storage.Unpacker, fg storage.FileGetter) (*FS, error) {
+	fsys := &FS{root: newDirNode("."), fg: fg}
+	rr := NewRecordReader(up)
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			return fsys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch rec.Header.Typeflag {
+		case tar.TypeXGlobalHeader, tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			continue
+		}
+		fsys.add(rec)
+	}
+}
+
+func newDirNode(name string) *fsNode {
+	return &fsNode{
+		hdr:      &tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0o755},
+		children: map[string]*fsNode{},
+	}
+}
+
+// cleanPath returns name as a path valid for fs.FS.
+func cleanPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (fsys *FS) add(rec *Record) {
+	name := cleanPath(rec.Header.Name)
+	node := &fsNode{hdr: rec.Header, entry: rec.Entry}
+	if rec.Header.Typeflag == tar.TypeDir {
+		node.children = map[string]*fsNode{}
+	}
+	if name == "." {
+		if node.children != nil {
+			node.children = fsys.root.children
+			fsys.root = node
+		}
+		return
+	}
+
+	dir := fsys.root
+	elems := strings.Split(name, "/")
+	for i, elem := range elems[:len(elems)-1] {
+		child, ok := dir.children[elem]
+		if !ok || child.children == nil {
+			child = newDirNode(strings.Join(elems[:i+1], "/"))
+			dir.children[elem] = child
+		}
+		dir = child
+	}
+	base := elems[len(elems)-1]
+	if old, ok := dir.children[base]; ok && old.children != nil && node.children != nil {
+		// a directory again keeps what is in it
+		node.children = old.children
+	}
+	dir.children[base] = node
+}
+
+// resolve returns the node of name, following symbolic links, except in the
+// last element of name unless follow is set.
+func (fsys *FS) resolve(op, name string, follow bool) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	var links int
+	var dir []string // path of the directory being looked in
+	todo := strings.Split(name, "/")
+	if name == "." {
+		todo = nil
+	}
+	node := fsys.root
+	for len(todo) > 0 {
+		elem := todo[0]
+		todo = todo[1:]
+		switch elem {
+		case ".", "":
+			continue
+		case "..":
+			if len(dir) > 0 {
+				dir = dir[:len(dir)-1]
+			}
+			node = fsys.lookup(dir)
+			continue
+		}
+		if node.children == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("not a directory")}
+		}
+		child, ok := node.children[elem]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if child.hdr.Typeflag == tar.TypeSymlink && (len(todo) > 0 || follow) {
+			if links++; links > maxSymlinks {
+				return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+			target := child.hdr.Linkname
+			if strings.HasPrefix(target, "/") {
+				dir, node = nil, fsys.root
+			}
+			todo = append(strings.Split(target, "/"), todo...)
+			continue
+		}
+		dir = append(dir, elem)
+		node = child
+	}
+	return node, nil
+}
+
+// lookup returns the directory node at the resolved path elems.
+func (fsys *FS) lookup(elems []string) *fsNode {
+	node := fsys.root
+	for _, elem := range elems {
+		node = node.children[elem]
+	}
+	return node
+}
+
+// Open opens the file name, following symbolic links.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	node, err := fsys.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := fsys.info(name, node)
+	if node.children != nil {
+		return &fsDir{info: info, node: node, fsys: fsys}, nil
+	}
+	return &fsFile{info: info, node: fsys.payload(node), fg: fsys.fg}, nil
+}
+
+// Stat returns the fs.FileInfo of name, following symbolic links.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	node, err := fsys.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.info(name, node), nil
+}
+
+// Lstat returns the fs.FileInfo of name, not following a symbolic link.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	node, err := fsys.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.info(name, node), nil
+}
+
+// ReadLink returns the target of the symbolic link name.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	node, err := fsys.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.hdr.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return node.hdr.Linkname, nil
+}
+
+// ReadDir returns the entries of the directory name, sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := fsys.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.children == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return fsys.dirEntries(node), nil
+}
+
+func (fsys *FS) dirEntries(node *fsNode) []fs.DirEntry {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]fs.DirEntry, len(names))
+	for i, name := range names {
+		entries[i] = fs.FileInfoToDirEntry(fsys.info(name, node.children[name]))
+	}
+	return entries
+}
+
+// payload returns the node whose payload is that of node, following a hard
+// link to its target.
+func (fsys *FS) payload(node *fsNode) *fsNode {
+	for i := 0; node.hdr.Typeflag == tar.TypeLink && i < maxSymlinks; i++ {
+		target, err := fsys.resolve("open", cleanPath(node.hdr.Linkname), false)
+		if err != nil {
+			break
+		}
+		node = target
+	}
+	return node
+}
+
+// info returns the fs.FileInfo of node, named after the last element of name.
+// A hard link has the size of its target.
+func (fsys *FS) info(name string, node *fsNode) fs.FileInfo {
+	hdr := node.hdr
+	if hdr.Typeflag == tar.TypeLink {
+		if target := fsys.payload(node); target.hdr.Typeflag != tar.TypeLink && target.children == nil {
+			linked := *hdr
+			linked.Size = target.hdr.Size
+			hdr = &linked
+		}
+	}
+	return fsFileInfo{FileInfo: hdr.FileInfo(), name: path.Base(name)}
+}
+
+// fsFileInfo is the fs.FileInfo of a header, named as it was looked up.
+type fsFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi fsFileInfo) Name() string { return fi.name }
+
+type fsFile struct {
+	info fs.FileInfo
+	node *fsNode // whose payload is read
+	fg   storage.FileGetter
+	rc   io.ReadCloser
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.rc == nil {
+		entry := f.node.entry
+		switch {
+		case entry == nil || entry.Size == 0 || f.node.hdr.Typeflag != tar.TypeReg && f.node.hdr.Typeflag != tar.TypeRegA:
+			f.rc = io.NopCloser(bytes.NewReader(nil))
+		case len(entry.Inline) > 0:
+			f.rc = io.NopCloser(bytes.NewReader(entry.Inline))
+		default:
+			rc, err := f.fg.Get(entry)
+			if err != nil {
+				return 0, err
+			}
+			f.rc = rc
+		}
+	}
+	return f.rc.Read(p)
+}
+
+func (f *fsFile) Close() error {
+	if f.rc == nil {
+		return nil
+	}
+	return f.rc.Close()
+}
+
+type fsDir struct {
+	info    fs.FileInfo
+	node    *fsNode
+	fsys    *FS
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) Close() error { return nil }
+
+// ReadDir is fs.ReadDirFile.ReadDir. The entries are sorted by name.
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		d.entries, d.read = d.fsys.dirEntries(d.node), true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
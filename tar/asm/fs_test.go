@@ -0,0 +1,72 @@
+package asm
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+func TestFS(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	members := []testMember{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./etc/", Mode: 0o700}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./etc/passwd", Mode: 0o644}, body: "root:x:0:0"},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "./etc/link", Linkname: "passwd"}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./usr/bin/sh", Mode: 0o755}, body: "#!"},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "./bin", Linkname: "usr/bin"}},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "./abs", Linkname: "/etc/../etc/passwd"}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "./hard", Linkname: "./etc/passwd"}},
+	}
+	for i := range members {
+		members[i].hdr.ModTime = mtime
+	}
+	w, fgp := disassembleTestArchive(t, writeTestArchive(t, members...))
+	fsys, err := NewFS(storage.NewJSONUnpacker(w), fgp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fstest.TestFS(fsys, "etc/passwd", "etc/link", "usr/bin/sh", "bin", "abs", "hard"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, body := range map[string]string{
+		"etc/passwd": "root:x:0:0",
+		"etc/link":   "root:x:0:0",
+		"abs":        "root:x:0:0",
+		"hard":       "root:x:0:0",
+		"bin/sh":     "#!",
+	} {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != body {
+			t.Errorf("%s: expected %q, got %q", name, body, b)
+		}
+	}
+
+	fi, err := fs.Stat(fsys, "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != fs.ModeDir|0o700 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("expected etc to have mode %v and time %v, got %v and %v", fs.ModeDir|0o700, mtime, fi.Mode(), fi.ModTime())
+	}
+	if _, ok := fi.Sys().(*tar.Header); !ok {
+		t.Errorf("expected the header from Sys, got %T", fi.Sys())
+	}
+	if fi, err := fs.Stat(fsys, "usr"); err != nil || fi.Mode() != fs.ModeDir|0o755 {
+		t.Errorf("expected usr to be implied with mode %v, got %v (%v)", fs.ModeDir|0o755, fi, err)
+	}
+	if fi, err := fsys.Lstat("bin"); err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("expected bin to be a symbolic link, got %v (%v)", fi, err)
+	}
+	if target, err := fsys.ReadLink("etc/link"); err != nil || target != "passwd" {
+		t.Errorf("expected etc/link to point to passwd, got %q (%v)", target, err)
+	}
+}
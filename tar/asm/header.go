@@ -0,0 +1,181 @@
+package asm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"unicode/utf8"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// ErrHeaderMismatch is returned when the header bytes regenerated for a
+// HeaderType entry are not of the length and checksum it recorded, such as
+// when the Writer now produces other bytes for the same fields.
+var ErrHeaderMismatch = errors.New("regenerated header does not match its checksum")
+
+// headerEntries packs the raw bytes b, read for hdr, as a HeaderType entry,
+// preceded by a PaddingType entry for the padding of the previous file. It
+// returns nil when b is not the padding and header the Writer produces for
+// hdr, give or take patches, or when that does not pack smaller than b.
+func headerEntries(b []byte, hdr *tar.Header) []storage.Entry {
+	fields, ok := storageHeader(hdr)
+	if !ok {
+		return nil
+	}
+	gen, err := regenerateHeader(fields)
+	if err != nil || len(gen) > len(b) {
+		return nil
+	}
+	pad := len(b) - len(gen)
+	for _, c := range b[:pad] {
+		if c != 0 {
+			return nil
+		}
+	}
+	raw := b[pad:]
+	entry := storage.Entry{
+		Type:    storage.HeaderType,
+		Size:    int64(len(raw)),
+		Payload: headerChecksum(raw),
+		Header:  fields,
+		Patches: storage.DiffPatches(gen, raw),
+	}
+
+	// check the entry survives being packed, and that it is worth it
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return nil
+	}
+	var packed storage.Entry
+	if err := json.Unmarshal(buf, &packed); err != nil {
+		return nil
+	}
+	if out, err := headerBytes(&packed); err != nil || !bytes.Equal(out, raw) {
+		return nil
+	}
+	rawSize := 0
+	for _, e := range storage.SegmentEntries(raw) {
+		eb, err := json.Marshal(e)
+		if err != nil {
+			return nil
+		}
+		rawSize += len(eb)
+	}
+	if len(buf) >= rawSize {
+		return nil
+	}
+
+	var entries []storage.Entry
+	if pad > 0 {
+		entries = append(entries, storage.Entry{Type: storage.PaddingType, Size: int64(pad)})
+	}
+	return append(entries, entry)
+}
+
+// headerBytes returns the raw header bytes of a HeaderType entry, checked
+// against the length and checksum of those it was packed from.
+func headerBytes(entry *storage.Entry) ([]byte, error) {
+	if entry.Header == nil {
+		return nil, fmt.Errorf("header entry at position %d has no header fields", entry.Position)
+	}
+	b, err := regenerateHeader(entry.Header)
+	if err != nil {
+		return nil, err
+	}
+	if !storage.ApplyPatches(b, entry.Patches) {
+		return nil, fmt.Errorf("header entry at position %d has patches out of range", entry.Position)
+	}
+	if int64(len(b)) != entry.Size || !bytes.Equal(headerChecksum(b), entry.Payload) {
+		return nil, fmt.Errorf("header entry at position %d: %w", entry.Position, ErrHeaderMismatch)
+	}
+	return b, nil
+}
+
+// headerChecksum returns the crc64 checksum of the raw header bytes b, as
+// stored in the Payload of a HeaderType entry.
+func headerChecksum(b []byte) []byte {
+	h := crc64.New(storage.CRCTable)
+	_, _ = h.Write(b)
+	return h.Sum(nil)
+}
+
+// regenerateHeader returns the raw bytes the Writer produces for h.
+func regenerateHeader(h *storage.Header) ([]byte, error) {
+	tw := tar.NewWriter(io.Discard)
+	tw.RawAccounting = true
+	if err := tw.WriteHeader(tarHeader(h)); err != nil {
+		return nil, err
+	}
+	return tw.RawBytes(), nil
+}
+
+// storageHeader returns the fields of hdr to store. It returns false if they
+// would not survive being packed as JSON, which replaces invalid UTF-8.
+func storageHeader(hdr *tar.Header) (*storage.Header, bool) {
+	strs := []string{hdr.Name, hdr.Linkname, hdr.Uname, hdr.Gname}
+	for k, v := range hdr.PAXRecords {
+		strs = append(strs, k, v)
+	}
+	for _, s := range strs {
+		if !utf8.ValidString(s) {
+			return nil, false
+		}
+	}
+	h := &storage.Header{
+		Typeflag:   hdr.Typeflag,
+		Name:       hdr.Name,
+		Linkname:   hdr.Linkname,
+		Size:       hdr.Size,
+		Mode:       hdr.Mode,
+		Uid:        hdr.Uid,
+		Gid:        hdr.Gid,
+		Uname:      hdr.Uname,
+		Gname:      hdr.Gname,
+		ModTime:    hdr.ModTime,
+		Devmajor:   hdr.Devmajor,
+		Devminor:   hdr.Devminor,
+		PAXRecords: hdr.PAXRecords,
+		Format:     int(hdr.Format),
+	}
+	if !hdr.AccessTime.IsZero() {
+		t := hdr.AccessTime
+		h.AccessTime = &t
+	}
+	if !hdr.ChangeTime.IsZero() {
+		t := hdr.ChangeTime
+		h.ChangeTime = &t
+	}
+	return h, true
+}
+
+// tarHeader is the inverse of storageHeader.
+func tarHeader(h *storage.Header) *tar.Header {
+	hdr := &tar.Header{
+		Typeflag:   h.Typeflag,
+		Name:       h.Name,
+		Linkname:   h.Linkname,
+		Size:       h.Size,
+		Mode:       h.Mode,
+		Uid:        h.Uid,
+		Gid:        h.Gid,
+		Uname:      h.Uname,
+		Gname:      h.Gname,
+		ModTime:    h.ModTime,
+		Devmajor:   h.Devmajor,
+		Devminor:   h.Devminor,
+		PAXRecords: h.PAXRecords,
+		Format:     tar.Format(h.Format),
+	}
+	if h.AccessTime != nil {
+		hdr.AccessTime = *h.AccessTime
+	}
+	if h.ChangeTime != nil {
+		hdr.ChangeTime = *h.ChangeTime
+	}
+	return hdr
+}
@@ -0,0 +1,58 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrHeaderTooLarge occurs when the raw bytes of a header, together with
+	// its extensions (PAX records, GNU long names, sparse maps) and the
+	// padding before it, exceed Limits.MaxHeaderSize.
+	ErrHeaderTooLarge = errors.New("tar header exceeds size limit")
+
+	// ErrSegmentTooLarge occurs when a SegmentType entry would exceed
+	// Limits.MaxSegmentSize.
+	ErrSegmentTooLarge = errors.New("tar segment exceeds size limit")
+
+	// ErrTooManyEntries occurs when more than Limits.MaxEntries entries would
+	// be packed.
+	ErrTooManyEntries = errors.New("tar archive exceeds entry limit")
+
+	// ErrNameTooLong occurs when the name or link name of a member exceeds
+	// Limits.MaxNameLength.
+	ErrNameTooLong = errors.New("tar member name exceeds length limit")
+
+	// ErrPaddingTooLarge occurs when the bytes following the end-of-archive
+	// marker exceed Limits.MaxPaddingSize.
+	ErrPaddingTooLarge = errors.New("tar trailing padding exceeds size limit")
+)
+
+// Limits bounds the resources spent disassembling an untrusted tar stream.
+// A zero field is no limit, so the zero value imposes none.
+//
+// Violations are reported wrapping one of ErrHeaderTooLarge,
+// ErrSegmentTooLarge, ErrTooManyEntries, ErrNameTooLong or
+// ErrPaddingTooLarge, to be checked with errors.Is.
+type Limits struct {
+	// MaxHeaderSize is the most raw bytes buffered for a single member: its
+	// header blocks and extensions, plus the padding of the member before it.
+	// It also bounds the end-of-archive marker, so should be at least 1024.
+	MaxHeaderSize int64
+
+	// MaxSegmentSize is the largest payload of a SegmentType entry.
+	MaxSegmentSize int64
+
+	// MaxEntries is the most entries, of any type, packed for the stream.
+	MaxEntries int64
+
+	// MaxNameLength is the longest name or link name of a member, in bytes.
+	MaxNameLength int
+
+	// MaxPaddingSize is the most bytes read after the end-of-archive marker.
+	MaxPaddingSize int64
+}
+
+func limitError(err error, max int64) error {
+	return fmt.Errorf("%w (limit %d)", err, max)
+}
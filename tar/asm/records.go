@@ -0,0 +1,109 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// Record is a member of an archive, as described by its metadata.
+type Record struct {
+	// Header is decoded from the raw header bytes stored.
+	Header *tar.Header
+	// Entry is the FileType entry of the payload of the member.
+	Entry *storage.Entry
+	// Raw are the header blocks of the member, including those of any PAX
+	// or GNU long name records preceding it. For a PAX global header, it
+	// ends with the records, not padded to a block.
+	Raw []byte
+}
+
+// RecordReader reads the members of an archive from its metadata, without
+// its payloads.
+type RecordReader struct {
+	up      storage.Unpacker
+	raw     bytes.Buffer
+	nonZero bool // raw holds more than zero bytes
+	// pad is the padding of the previous member that raw starts with
+	pad int
+}
+
+// NewRecordReader returns a RecordReader of the metadata read from up.
+func NewRecordReader(up storage.Unpacker) *RecordReader {
+	return &RecordReader{up: up}
+}
+
+// Next returns the next member of the archive, or io.EOF after the last.
+func (rr *RecordReader) Next() (*Record, error) {
+	for {
+		entry, err := rr.up.Next()
+		if err != nil {
+			return nil, err
+		}
+		switch entry.Type {
+		case storage.SegmentType:
+			rr.write(entry.Payload)
+		case storage.PaddingType:
+			if err := writeZeros(&rr.raw, entry.Size); err != nil {
+				return nil, err
+			}
+			if !rr.nonZero {
+				// only padding so far, of which less than a block precedes
+				// the next header, and the rest are the end-of-archive
+				// marker and beyond
+				rr.raw.Truncate(rr.raw.Len() % blockSize)
+			}
+		case storage.OptionType:
+			// options are not part of the archive
+		case storage.HeaderType:
+			b, err := headerBytes(entry)
+			if err != nil {
+				return nil, err
+			}
+			rr.write(b)
+		case storage.FileType:
+			return rr.record(entry)
+		default:
+			return nil, fmt.Errorf("unknown entry type %d at position %d", entry.Type, entry.Position)
+		}
+	}
+}
+
+const blockSize = 512
+
+func (rr *RecordReader) write(b []byte) {
+	rr.raw.Write(b)
+	if !rr.nonZero && bytes.IndexFunc(b, func(r rune) bool { return r != 0 }) >= 0 {
+		rr.nonZero = true
+	}
+}
+
+// record decodes the header of the FileType entry from the raw bytes since
+// the previous one: the padding of the previous member, then the header
+// blocks.
+func (rr *RecordReader) record(entry *storage.Entry) (*Record, error) {
+	b := rr.raw.Bytes()
+	if len(b) < rr.pad {
+		return nil, fmt.Errorf("decoding the header of %q: %w", entry.GetName(), io.ErrUnexpectedEOF)
+	}
+	raw := append([]byte(nil), b[rr.pad:]...)
+	rr.raw.Reset()
+	rr.nonZero = false
+	// the records of a global header, and the payload, are padded to a block
+	rr.pad = int((blockSize - (int64(len(raw))+entry.Size)%blockSize) % blockSize)
+
+	hdr, err := tar.NewReader(bytes.NewReader(raw)).Next()
+	if err == tar.ErrInsecurePath {
+		err = nil
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("decoding the header of %q: %w", entry.GetName(), err)
+	}
+	return &Record{Header: hdr, Entry: entry, Raw: raw}, nil
+}
@@ -0,0 +1,117 @@
+package asm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+func TestRecordReader(t *testing.T) {
+	for _, tc := range testCases {
+		for _, headerEntries := range []bool{false, true} {
+			fh, err := os.Open(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = fh.Close() }()
+			gzRdr, err := gzip.NewReader(fh)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := bytes.NewBuffer([]byte{})
+			tarStream, err := NewInputTarStreamWithOptions(gzRdr, storage.NewJSONPacker(w), nil, DisassembleOptions{HeaderEntries: headerEntries})
+			if err != nil {
+				t.Fatal(err)
+			}
+			archive, err := io.ReadAll(tarStream)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tr := tar.NewReader(bytes.NewReader(archive))
+			rr := NewRecordReader(storage.NewJSONUnpacker(w))
+			for {
+				expected, err := tr.Next()
+				if err == tar.ErrInsecurePath {
+					err = nil
+				}
+				if err != nil && err != io.EOF {
+					t.Fatal(err)
+				}
+				rec, rerr := rr.Next()
+				if err == io.EOF {
+					if rerr != io.EOF {
+						t.Errorf("%s: expected io.EOF after the last record, got %v", tc.path, rerr)
+					}
+					break
+				}
+				if rerr != nil {
+					t.Fatalf("%s: %s", tc.path, rerr)
+				}
+				if !reflect.DeepEqual(rec.Header, expected) {
+					t.Errorf("%s: expected header %+v, got %+v", tc.path, expected, rec.Header)
+				}
+				if rec.Entry.GetName() != expected.Name || rec.Entry.Size != expected.Size {
+					t.Errorf("%s: record of %q has the entry of %q", tc.path, expected.Name, rec.Entry.GetName())
+				}
+				if len(rec.Raw) == 0 || len(rec.Raw)%blockSize != 0 {
+					t.Errorf("%s: expected whole header blocks, got %d bytes", tc.path, len(rec.Raw))
+				}
+			}
+		}
+	}
+}
+
+func TestRecordReaderGlobalHeader(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, Name: "global", PAXRecords: map[string]string{"comment": "global"}},
+		{Typeflag: tar.TypeReg, Name: "a", Mode: 0o644, Size: 3},
+		{Typeflag: tar.TypeReg, Name: "b", Mode: 0o644},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, "abc"[:hdr.Size]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := bytes.NewBuffer(nil)
+	tarStream, err := NewInputTarStream(buf, storage.NewJSONPacker(w), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, tarStream); err != nil {
+		t.Fatal(err)
+	}
+	// the records of the global header are not a whole block, so the header
+	// following them starts past their padding
+	var names []string
+	rr := NewRecordReader(storage.NewJSONUnpacker(w))
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, rec.Header.Name)
+	}
+	if expected := "global,a,b"; strings.Join(names, ",") != expected {
+		t.Errorf("expected records %q, got %q", expected, names)
+	}
+}
@@ -0,0 +1,222 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// layoutPart is a run of an assembled tar archive, starting at off: either raw
+// bytes, zero bytes, or the payload of entry.
+type layoutPart struct {
+	off   int64
+	size  int64
+	raw   []byte
+	zero  bool
+	entry *storage.Entry
+}
+
+// layout reads every entry of up, returning where each run of bytes lies in
+// the assembled tar archive, and its size.
+func layout(up storage.Unpacker) ([]layoutPart, int64, error) {
+	var (
+		parts []layoutPart
+		off   int64
+	)
+	for {
+		entry, err := up.Next()
+		if err != nil {
+			if err == io.EOF {
+				return parts, off, nil
+			}
+			return nil, 0, err
+		}
+		part := layoutPart{off: off}
+		switch entry.Type {
+		case storage.SegmentType:
+			part.raw = entry.Payload
+			part.size = int64(len(entry.Payload))
+		case storage.PaddingType:
+			part.zero = true
+			part.size = entry.Size
+		case storage.OptionType:
+			// options are not part of the archive
+			continue
+		case storage.HeaderType:
+			b, err := headerBytes(entry)
+			if err != nil {
+				return nil, 0, err
+			}
+			part.raw = b
+			part.size = int64(len(b))
+		case storage.FileType:
+			if len(entry.Inline) > 0 {
+				if int64(len(entry.Inline)) != entry.Size {
+					return nil, 0, fmt.Errorf("inline payload of %q is %d bytes, expected %d", entry.GetName(), len(entry.Inline), entry.Size)
+				}
+				part.raw = entry.Inline
+			} else {
+				part.entry = entry
+			}
+			part.size = entry.Size
+		default:
+			return nil, 0, fmt.Errorf("unknown entry type %d at position %d", entry.Type, entry.Position)
+		}
+		if part.size == 0 {
+			continue
+		}
+		parts = append(parts, part)
+		off += part.size
+	}
+}
+
+// TarReadSeeker is an assembled tar archive that can be read from any offset,
+// such as to serve HTTP range requests of it.
+//
+// Payloads are fetched from the FileGetter as they are read. Those read in
+// full from their start are verified against their checksum; those sought
+// into are not.
+type TarReadSeeker struct {
+	fg    storage.FileGetter
+	parts []layoutPart
+	size  int64
+	off   int64
+
+	// the payload being read: parts[cur], at offset curOff within it
+	cur    int
+	curOff int64
+	rc     io.ReadCloser
+	hash   hash.Hash
+}
+
+// NewTarReadSeeker returns a TarReadSeeker of the tar archive assembled from
+// up and fg. The entries of up are all read, to lay out the archive, before
+// it returns.
+func NewTarReadSeeker(fg storage.FileGetter, up storage.Unpacker) (*TarReadSeeker, error) {
+	if fg == nil || up == nil {
+		return nil, errors.New("tar-split: FileGetter and Unpacker must be set")
+	}
+	parts, size, err := layout(up)
+	if err != nil {
+		return nil, err
+	}
+	return &TarReadSeeker{fg: fg, parts: parts, size: size, cur: -1}, nil
+}
+
+// Size returns the size of the assembled tar archive.
+func (trs *TarReadSeeker) Size() int64 {
+	return trs.size
+}
+
+// Read reads the assembled tar archive, from its current offset.
+func (trs *TarReadSeeker) Read(p []byte) (int, error) {
+	if trs.off >= trs.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	i := sort.Search(len(trs.parts), func(i int) bool {
+		return trs.off < trs.parts[i].off+trs.parts[i].size
+	})
+	part := &trs.parts[i]
+	rel := trs.off - part.off
+	if int64(len(p)) > part.size-rel {
+		p = p[:part.size-rel]
+	}
+	switch {
+	case part.zero:
+		for j := range p {
+			p[j] = 0
+		}
+	case part.entry == nil:
+		copy(p, part.raw[rel:])
+	default:
+		if err := trs.readPayload(i, rel, p); err != nil {
+			return 0, err
+		}
+	}
+	trs.off += int64(len(p))
+	return len(p), nil
+}
+
+// readPayload fills p from the payload of parts[i], at offset rel within it.
+func (trs *TarReadSeeker) readPayload(i int, rel int64, p []byte) error {
+	part := &trs.parts[i]
+	if trs.cur != i || trs.curOff != rel {
+		trs.closePayload()
+		rc, err := trs.fg.Get(part.entry)
+		if err != nil {
+			return err
+		}
+		trs.rc, trs.cur = rc, i
+		if rel == 0 {
+			trs.hash = storage.NewHash()
+		} else if s, ok := rc.(io.Seeker); ok {
+			if _, err := s.Seek(rel, io.SeekStart); err != nil {
+				trs.closePayload()
+				return err
+			}
+		} else if _, err := io.CopyN(io.Discard, rc, rel); err != nil {
+			trs.closePayload()
+			return fmt.Errorf("payload of %q is shorter than %d bytes: %w", part.entry.GetName(), part.size, err)
+		}
+		trs.curOff = rel
+	}
+
+	if _, err := io.ReadFull(trs.rc, p); err != nil {
+		trs.closePayload()
+		return fmt.Errorf("payload of %q is shorter than %d bytes: %w", part.entry.GetName(), part.size, err)
+	}
+	if trs.hash != nil {
+		trs.hash.Write(p)
+	}
+	trs.curOff += int64(len(p))
+	if trs.curOff == part.size {
+		sum := []byte(nil)
+		if trs.hash != nil {
+			sum = trs.hash.Sum(nil)
+		}
+		trs.closePayload()
+		if sum != nil && !bytes.Equal(sum, part.entry.Payload) {
+			return fmt.Errorf("file integrity checksum failed for %q", part.entry.GetName())
+		}
+	}
+	return nil
+}
+
+func (trs *TarReadSeeker) closePayload() {
+	if trs.rc != nil {
+		_ = trs.rc.Close()
+	}
+	trs.rc, trs.cur, trs.hash = nil, -1, nil
+}
+
+// Seek sets the offset of the next Read, as io.Seeker.
+func (trs *TarReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += trs.off
+	case io.SeekEnd:
+		offset += trs.size
+	default:
+		return 0, errors.New("tar-split: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("tar-split: negative position")
+	}
+	trs.off = offset
+	return offset, nil
+}
+
+// Close closes the payload being read, if any.
+func (trs *TarReadSeeker) Close() error {
+	trs.closePayload()
+	return nil
+}
@@ -0,0 +1,108 @@
+package asm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+func TestTarReadSeeker(t *testing.T) {
+	for _, tc := range testCases {
+		fh, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = fh.Close() }()
+		gzRdr, err := gzip.NewReader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := bytes.NewBuffer([]byte{})
+		fgp := storage.NewBufferFileGetPutter()
+		tarStream, err := NewInputTarStream(gzRdr, storage.NewJSONPacker(w), fgp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole, err := io.ReadAll(tarStream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trs, err := NewTarReadSeeker(fgp, storage.NewJSONUnpacker(bytes.NewReader(w.Bytes())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trs.Size() != tc.expectedSize {
+			t.Errorf("%s: expected size %d, got %d", tc.path, tc.expectedSize, trs.Size())
+		}
+		h := sha1.New()
+		if _, err := io.Copy(h, trs); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%x", h.Sum(nil)) != tc.expectedSHA1Sum {
+			t.Errorf("%s: checksum of output tar: expected %s; got %x", tc.path, tc.expectedSHA1Sum, h.Sum(nil))
+		}
+
+		rnd := rand.New(rand.NewSource(int64(len(whole))))
+		for i := 0; i < 50; i++ {
+			off := rnd.Int63n(int64(len(whole)))
+			n := rnd.Int63n(int64(len(whole))-off) + 1
+			if _, err := trs.Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, n)
+			if _, err := io.ReadFull(trs, got); err != nil {
+				t.Fatalf("%s: reading %d bytes at %d: %s", tc.path, n, off, err)
+			}
+			if !bytes.Equal(got, whole[off:off+n]) {
+				t.Fatalf("%s: %d bytes at %d differ from the assembled stream", tc.path, n, off)
+			}
+		}
+		if _, err := trs.Seek(0, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := trs.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("%s: expected EOF at the end, got %d, %v", tc.path, n, err)
+		}
+		if err := trs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTarReadSeekerChecksum(t *testing.T) {
+	fgp := storage.NewBufferFileGetPutter()
+	w := bytes.NewBuffer([]byte{})
+	sp := storage.NewJSONPacker(w)
+	for _, e := range entriesMangled {
+		if _, _, err := fgp.Put(e.Entry.GetName(), bytes.NewBuffer(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sp.AddEntry(e.Entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trs, err := NewTarReadSeeker(fgp, storage.NewJSONUnpacker(w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trs.Close()
+	if _, err := io.ReadAll(trs); err == nil {
+		t.Error("expected the mangled payloads to fail their checksum")
+	}
+	// sought into, a payload can not be verified
+	if _, err := trs.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(io.LimitReader(trs, 19)); err != nil {
+		t.Errorf("expected no error reading part of a payload, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package asm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// minSplitSize is the smallest size of the chunks SplitArchive can cut: a
+// header block, a block of payload and the end-of-archive marker.
+const minSplitSize = 4 * blockSize
+
+// SplitManifest records how to rejoin the chunks cut by SplitArchive into
+// the original archive.
+type SplitManifest struct {
+	// Size is the size of the original archive.
+	Size   int64        `json:"size"`
+	Chunks []SplitChunk `json:"chunks"`
+}
+
+// SplitChunk is a chunk archive, holding Length bytes of the original
+// archive at Offset.
+//
+// Most chunks hold whole members of the original archive, as they are,
+// followed by an end-of-archive marker, at Offset 0. A member too large for
+// a chunk of its own is carried in parts instead, each the payload of the
+// only member of a chunk, at the Offset past its header.
+type SplitChunk struct {
+	// Name is where the chunk is stored, if the caller records it.
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	// Checksum is the hex checksum of the bytes of the original archive the
+	// chunk holds.
+	Checksum string `json:"checksum"`
+}
+
+// splitSpan is a run of the original archive, of whole members if part is
+// false.
+type splitSpan struct {
+	start, end int64
+	part       bool
+}
+
+// SplitArchive cuts the tar archive r, of size bytes, into valid tar archives
+// of at most maxSize bytes, and returns the manifest to rejoin them with
+// JoinArchive.
+//
+// For each chunk in turn, create returns where to write it and where to pack
+// its metadata, so that the chunk can be assembled on its own. The headers of
+// r are read first, to find where its members start, and then r is read once
+// through as the chunks are written.
+func SplitArchive(r io.ReaderAt, size, maxSize int64, create func(i int) (io.Writer, storage.Packer, error)) (*SplitManifest, error) {
+	if maxSize < minSplitSize {
+		return nil, fmt.Errorf("chunks must be at least %d bytes, got %d", minSplitSize, maxSize)
+	}
+	bounds, err := memberBounds(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	bounds = append(bounds, size)
+
+	// members are added to a chunk while they fit with the end-of-archive
+	// marker, and those that never fit are cut in parts of whole blocks
+	whole := maxSize - 2*blockSize
+	partSize := (maxSize - 3*blockSize) / blockSize * blockSize
+	var spans []splitSpan
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if start == end {
+			continue
+		}
+		if end-start > whole {
+			for off := start; off < end; off += partSize {
+				spans = append(spans, splitSpan{start: off, end: min64(off+partSize, end), part: true})
+			}
+			continue
+		}
+		if n := len(spans); n > 0 && !spans[n-1].part && end-spans[n-1].start <= whole {
+			spans[n-1].end = end
+			continue
+		}
+		spans = append(spans, splitSpan{start: start, end: end})
+	}
+
+	m := &SplitManifest{Size: size}
+	for i, span := range spans {
+		w, p, err := create(i)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := writeChunk(r, span, i, w, p)
+		if err != nil {
+			return nil, err
+		}
+		m.Chunks = append(m.Chunks, *chunk)
+	}
+	return m, nil
+}
+
+// memberBounds returns the offset of each member of the archive r, and of
+// the end of the last member, where the end-of-archive marker starts. PAX
+// global headers are bound to the member following them. Payloads are
+// skipped, rather than read, but for sparse ones.
+func memberBounds(r *io.SectionReader) ([]int64, error) {
+	var (
+		bounds []int64
+		global bool
+	)
+	tr := tar.NewReader(r)
+	for {
+		end, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		// members start at a block, after the padding of the previous one
+		start := end + (blockSize-end%blockSize)%blockSize
+		hdr, err := tr.Next()
+		if err == tar.ErrInsecurePath {
+			err = nil
+		}
+		if err == io.EOF {
+			return append(bounds, start), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !global {
+			bounds = append(bounds, start)
+		}
+		global = hdr.Typeflag == tar.TypeXGlobalHeader
+		if ok, err := tr.SkipPayload(); err != nil {
+			return nil, err
+		} else if !ok {
+			// sparse payloads are read through instead
+			if _, err := io.Copy(io.Discard, tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// writeChunk writes the chunk i of span of r to w, packing its metadata to
+// p, and returns how it holds span.
+func writeChunk(r io.ReaderAt, span splitSpan, i int, w io.Writer, p storage.Packer) (*SplitChunk, error) {
+	length := span.end - span.start
+	var head, tail []byte
+	if span.part {
+		var err error
+		if head, err = partHeader(i, length); err != nil {
+			return nil, err
+		}
+		tail = make([]byte, (blockSize-length%blockSize)%blockSize)
+	}
+	tail = append(tail, make([]byte, 2*blockSize)...)
+
+	hsh := storage.NewHash()
+	body := io.TeeReader(io.NewSectionReader(r, span.start, length), hsh)
+	its, err := NewInputTarStream(io.MultiReader(bytes.NewReader(head), body, bytes.NewReader(tail)), p, nil)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(w, its)
+	if err != nil {
+		return nil, err
+	}
+	return &SplitChunk{
+		Size:     n,
+		Offset:   int64(len(head)),
+		Length:   length,
+		Checksum: hex.EncodeToString(hsh.Sum(nil)),
+	}, nil
+}
+
+// partHeader returns the header of the member carrying a part of length
+// bytes in chunk i. It is a single block in the GNU format, which stores sizes
+// of 8 GiB and more in base-256, unlike USTAR, and needs no PAX records for
+// them.
+func partHeader(i int, length int64) ([]byte, error) {
+	hdr := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(hdr)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     fmt.Sprintf("tar-split-part-%d", i),
+		Mode:     0o644,
+		Size:     length,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatGNU,
+	}); err != nil {
+		return nil, err
+	}
+	return hdr.Bytes(), nil
+}
+
+// ErrChunkMismatch occurs when a chunk does not hold the bytes of the
+// original archive its SplitChunk records.
+var ErrChunkMismatch = errors.New("chunk does not match the manifest")
+
+// JoinArchive writes the original archive of the chunks of m to w, reading
+// each chunk from the io.ReadCloser open returns for it in turn.
+func JoinArchive(m *SplitManifest, open func(i int, chunk *SplitChunk) (io.ReadCloser, error), w io.Writer) error {
+	var written int64
+	for i := range m.Chunks {
+		chunk := &m.Chunks[i]
+		rc, err := open(i, chunk)
+		if err != nil {
+			return err
+		}
+		err = joinChunk(rc, chunk, w)
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+		written += chunk.Length
+	}
+	if written != m.Size {
+		return fmt.Errorf("chunks hold %d bytes of %d: %w", written, m.Size, ErrChunkMismatch)
+	}
+	return nil
+}
+
+func joinChunk(r io.Reader, chunk *SplitChunk, w io.Writer) error {
+	if _, err := io.CopyN(io.Discard, r, chunk.Offset); err != nil {
+		return err
+	}
+	hsh := storage.NewHash()
+	if _, err := io.CopyN(io.MultiWriter(w, hsh), r, chunk.Length); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("shorter than %d bytes: %w", chunk.Offset+chunk.Length, ErrChunkMismatch)
+		}
+		return err
+	}
+	if hex.EncodeToString(hsh.Sum(nil)) != chunk.Checksum {
+		return ErrChunkMismatch
+	}
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
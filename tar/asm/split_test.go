@@ -0,0 +1,121 @@
+package asm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+func TestSplitArchive(t *testing.T) {
+	for _, tc := range testCases {
+		fh, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = fh.Close() }()
+		gzRdr, err := gzip.NewReader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, err := io.ReadAll(gzRdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		maxSizes := []int64{10 * blockSize, 1 << 20}
+		if len(archive) < 1<<20 {
+			maxSizes = append(maxSizes, minSplitSize)
+		}
+		for _, maxSize := range maxSizes {
+			var chunks, metadata []*bytes.Buffer
+			m, err := SplitArchive(bytes.NewReader(archive), int64(len(archive)), maxSize, func(i int) (io.Writer, storage.Packer, error) {
+				if i != len(chunks) {
+					t.Fatalf("expected chunk %d, got %d", len(chunks), i)
+				}
+				chunks = append(chunks, bytes.NewBuffer(nil))
+				metadata = append(metadata, bytes.NewBuffer(nil))
+				return chunks[i], storage.NewJSONPacker(metadata[i]), nil
+			})
+			if err != nil {
+				t.Fatalf("%s: %s", tc.path, err)
+			}
+			if len(m.Chunks) != len(chunks) {
+				t.Fatalf("%s: expected %d chunks in the manifest, got %d", tc.path, len(chunks), len(m.Chunks))
+			}
+
+			for i, chunk := range chunks {
+				if int64(chunk.Len()) > maxSize || int64(chunk.Len()) != m.Chunks[i].Size {
+					t.Errorf("%s: chunk %d is %d bytes, manifest has %d, at most %d", tc.path, i, chunk.Len(), m.Chunks[i].Size, maxSize)
+				}
+				// each chunk is a tar archive of its own
+				tr := tar.NewReader(bytes.NewReader(chunk.Bytes()))
+				for {
+					if _, err := tr.Next(); err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatalf("%s: chunk %d: %s", tc.path, i, err)
+					}
+				}
+				// and can be assembled from its metadata
+				tfg, err := storage.NewTarFileGetter(bytes.NewReader(chunk.Bytes()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				out := bytes.NewBuffer(nil)
+				if err := WriteOutputTarStream(tfg, storage.NewJSONUnpacker(metadata[i]), out); err != nil {
+					t.Fatalf("%s: chunk %d: %s", tc.path, i, err)
+				}
+				if !bytes.Equal(out.Bytes(), chunk.Bytes()) {
+					t.Errorf("%s: chunk %d differs assembled from its metadata", tc.path, i)
+				}
+			}
+
+			open := func(i int, _ *SplitChunk) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(chunks[i].Bytes())), nil
+			}
+			joined := bytes.NewBuffer(nil)
+			if err := JoinArchive(m, open, joined); err != nil {
+				t.Fatalf("%s: %s", tc.path, err)
+			}
+			if !bytes.Equal(joined.Bytes(), archive) {
+				t.Errorf("%s in chunks of %d: joined archive differs", tc.path, maxSize)
+			}
+
+			last := chunks[len(chunks)-1].Bytes()
+			last[m.Chunks[len(chunks)-1].Offset] ^= 0xff
+			if err := JoinArchive(m, open, io.Discard); !errors.Is(err, ErrChunkMismatch) {
+				t.Errorf("%s: expected %v, got %v", tc.path, ErrChunkMismatch, err)
+			}
+		}
+	}
+
+	if _, err := SplitArchive(bytes.NewReader(nil), 0, blockSize, nil); err == nil {
+		t.Error("expected chunks smaller than the minimum to fail")
+	}
+}
+
+func TestPartHeader(t *testing.T) {
+	// too large for the octal size field of USTAR
+	for _, length := range []int64{blockSize, 8 << 30, 16 << 30} {
+		head, err := partHeader(3, length)
+		if err != nil {
+			t.Fatalf("%d: %s", length, err)
+		}
+		if len(head) != blockSize {
+			t.Errorf("%d: expected a header of one block, got %d bytes", length, len(head))
+		}
+		hdr, err := tar.NewReader(bytes.NewReader(head)).Next()
+		if err != nil {
+			t.Fatalf("%d: %s", length, err)
+		}
+		if hdr.Size != length || hdr.Name != "tar-split-part-3" {
+			t.Errorf("expected part 3 of %d bytes, got %s of %d", length, hdr.Name, hdr.Size)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// whiteoutPrefix marks a whiteout file, deleting the rest of its name from
+// the layers below, and whiteoutOpaqueDir an opaque directory, hiding what its
+// directory holds in the layers below.
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// SquashLayer is a layer of the archives squashed by WriteSquashedTar: the
+// metadata of its archive, and where its payloads are.
+type SquashLayer struct {
+	Unpacker   storage.Unpacker
+	FileGetter storage.FileGetter
+}
+
+// WriteSquashedTar writes a tar archive of the filesystem that layers, lowest
+// first, make up applied in turn, to w, while packing its metadata to p and
+// its payloads to fp, as NewInputTarStream would have.
+//
+// A member of a layer is hidden by a member of the same name in a higher
+// layer, by a whiteout file of it or of a directory above it, by an opaque
+// directory above it, or by a non-directory of a higher layer above it. Of
+// members of the same name in a layer, the last is the one kept. Whiteout
+// files and opaque directory markers are not written.
+//
+// The members kept are written in the order of their layers, each as its
+// original header blocks, preceded by the PAX global headers of its layer not
+// yet written, and its payload from the FileGetter of its layer. The records
+// of the global headers of a layer are reset before the members of the layers
+// above it, as they would otherwise apply to those too. A global header of a
+// name written already is renamed, as the layers may share their names.
+//
+// A hard link is written as it is, if the member it links to is kept. If that
+// member is hidden, such as deleted or replaced by a higher layer, the link is
+// written as a copy of it instead, with its header fields and payload.
+func WriteSquashedTar(layers []SquashLayer, w io.Writer, p storage.Packer, fp storage.FilePutter) error {
+	records := make([][]*Record, len(layers))
+	for i, layer := range layers {
+		rr := NewRecordReader(layer.Unpacker)
+		for {
+			rec, err := rr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("layer %d: %w", i, err)
+			}
+			records[i] = append(records[i], rec)
+		}
+	}
+	keep := squashRecords(records)
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(writeSquashed(layers, records, keep, pw))
+	}()
+	// stops writing the archive if it is not all read
+	defer func() { _ = pr.Close() }()
+	its, err := NewInputTarStream(pr, p, fp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, its)
+	return err
+}
+
+// squashRecords returns which of the records of each layer are kept.
+func squashRecords(records [][]*Record) [][]bool {
+	var (
+		// the names of the members kept of the higher layers, and whether
+		// each is a directory
+		present = map[string]bool{}
+		// the names deleted, and the directories made opaque, by the
+		// higher layers
+		deleted = map[string]bool{}
+		opaque  = map[string]bool{}
+	)
+	hidden := func(name string) bool {
+		if _, ok := present[name]; ok || deleted[name] {
+			return true
+		}
+		for dir := name; dir != ""; {
+			dir, _ = splitMemberName(dir)
+			if isDir, ok := present[dir]; ok && !isDir {
+				return true
+			}
+			if deleted[dir] || opaque[dir] {
+				return true
+			}
+		}
+		return false
+	}
+
+	keep := make([][]bool, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		keep[i] = make([]bool, len(records[i]))
+		// whiteouts only apply to the layers below, once the layer is done
+		layerPresent := map[string]bool{}
+		var layerDeleted, layerOpaque []string
+		for j := len(records[i]) - 1; j >= 0; j-- {
+			hdr := records[i][j].Header
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				continue
+			}
+			name := cleanMemberName(hdr.Name)
+			dir, base := splitMemberName(name)
+			if base == whiteoutOpaqueDir {
+				layerOpaque = append(layerOpaque, dir)
+				continue
+			}
+			if strings.HasPrefix(base, whiteoutPrefix) {
+				layerDeleted = append(layerDeleted, joinMemberName(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+				continue
+			}
+			if _, ok := layerPresent[name]; ok || hidden(name) {
+				continue
+			}
+			layerPresent[name] = hdr.Typeflag == tar.TypeDir
+			keep[i][j] = true
+		}
+		for name, isDir := range layerPresent {
+			present[name] = isDir
+		}
+		for _, name := range layerDeleted {
+			deleted[name] = true
+		}
+		for _, dir := range layerOpaque {
+			opaque[dir] = true
+		}
+	}
+	return keep
+}
+
+// squashMember is the position of a record, in records[layer][index].
+type squashMember struct {
+	layer, index int
+}
+
+// findMember returns the last member named name before records[layer][index],
+// in that layer or else the layers below it.
+func findMember(records [][]*Record, layer, index int, name string) (squashMember, bool) {
+	for i := layer; i >= 0; i-- {
+		if i < layer {
+			index = len(records[i])
+		}
+		for j := index - 1; j >= 0; j-- {
+			hdr := records[i][j].Header
+			if hdr.Typeflag != tar.TypeXGlobalHeader && cleanMemberName(hdr.Name) == name {
+				return squashMember{i, j}, true
+			}
+		}
+	}
+	return squashMember{}, false
+}
+
+// brokenLinks returns the member each hard link kept is to be written as a
+// copy of, for those linking to a member not kept. That is the member its
+// links lead to in the end, as they were when the layers were written.
+func brokenLinks(records [][]*Record, keep [][]bool) map[squashMember]squashMember {
+	broken := map[squashMember]squashMember{}
+	for i := range records {
+		for j, rec := range records[i] {
+			if !keep[i][j] || rec.Header.Typeflag != tar.TypeLink {
+				continue
+			}
+			target, ok := findMember(records, i, j, cleanMemberName(rec.Header.Linkname))
+			if !ok || keep[target.layer][target.index] {
+				continue
+			}
+			// links are to members before them, so this ends
+			for ok && records[target.layer][target.index].Header.Typeflag == tar.TypeLink {
+				hdr := records[target.layer][target.index].Header
+				target, ok = findMember(records, target.layer, target.index, cleanMemberName(hdr.Linkname))
+			}
+			if ok {
+				broken[squashMember{i, j}] = target
+			}
+		}
+	}
+	return broken
+}
+
+// linkCopy returns the record of the hard link, written as a copy of the
+// member target it links to.
+func linkCopy(link, target *Record) (*Record, error) {
+	hdr := *target.Header
+	hdr.Name = link.Header.Name
+	if hdr.Typeflag == tar.TypeRegA {
+		hdr.Typeflag = tar.TypeReg
+	}
+	// written in whichever format holds the name
+	hdr.Format = tar.FormatUnknown
+	hdr.PAXRecords = nil
+	for k, v := range target.Header.PAXRecords {
+		if k == "path" || k == "size" || strings.HasPrefix(k, "GNU.sparse.") {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[k] = v
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := tar.NewWriter(buf).WriteHeader(&hdr); err != nil {
+		return nil, fmt.Errorf("hard link %q: %w", link.Header.Name, err)
+	}
+	return &Record{Header: &hdr, Entry: target.Entry, Raw: buf.Bytes()}, nil
+}
+
+// globalReset returns a PAX global header named name, deleting the records of
+// keys.
+func globalReset(name string, keys map[string]bool) ([]byte, error) {
+	records := make(map[string]string, len(keys))
+	for k := range keys {
+		records[k] = ""
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := tar.NewWriter(buf).WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: name, PAXRecords: records}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// globalName is the name the Writer gives a PAX global header of none.
+const globalName = "GlobalHead.0.0"
+
+// uniqueName returns name, or name suffixed by a number if it is in names
+// already, and adds it to names. The global headers of the layers may share
+// their names, which a Packer rejects in one archive.
+func uniqueName(name string, names map[string]bool) string {
+	unique := name
+	for n := 1; names[cleanMemberName(unique)]; n++ {
+		unique = fmt.Sprintf("%s.%d", name, n)
+	}
+	names[cleanMemberName(unique)] = true
+	return unique
+}
+
+// renameGlobal returns the raw bytes of the PAX global header rec, named name
+// instead, with only its name field and checksum changed.
+func renameGlobal(rec *Record, name string) ([]byte, error) {
+	raw := append([]byte(nil), rec.Raw...)
+	if len(raw) < blockSize || raw[156] != tar.TypeXGlobalHeader || len(name) > 100 {
+		return nil, fmt.Errorf("global header %q can not be renamed %q", rec.Header.Name, name)
+	}
+	block := raw[:blockSize]
+	copy(block[:100], make([]byte, 100))
+	copy(block, name)
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, c := range block {
+		sum += int64(c)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return raw, nil
+}
+
+// writeSquashed writes the records of layers kept to w, and the
+// end-of-archive marker.
+func writeSquashed(layers []SquashLayer, records [][]*Record, keep [][]bool, w io.Writer) error {
+	copyBuffer := byteBufferPool.Get().([]byte)
+	defer byteBufferPool.Put(copyBuffer)
+	broken := brokenLinks(records, keep)
+	// the names written, for the global headers not to repeat them
+	names := map[string]bool{}
+	for i := range records {
+		for j, rec := range records[i] {
+			if keep[i][j] {
+				names[cleanMemberName(rec.Header.Name)] = true
+			}
+		}
+	}
+	// the keys of the global headers written of the layers below, not reset
+	active := map[string]bool{}
+	for i, layer := range layers {
+		var globals [][]byte
+		// the keys of the global headers of this layer, not written yet and
+		// written
+		pending, written := map[string]bool{}, map[string]bool{}
+		for j, rec := range records[i] {
+			if rec.Header.Typeflag == tar.TypeXGlobalHeader {
+				raw := rec.Raw
+				if name := uniqueName(rec.Header.Name, names); name != rec.Header.Name {
+					var err error
+					if raw, err = renameGlobal(rec, name); err != nil {
+						return fmt.Errorf("layer %d: %w", i, err)
+					}
+				}
+				globals = append(globals, raw)
+				for k := range rec.Header.PAXRecords {
+					pending[k] = true
+				}
+				continue
+			}
+			if !keep[i][j] {
+				continue
+			}
+			if len(active) > 0 {
+				reset, err := globalReset(uniqueName(globalName, names), active)
+				if err != nil {
+					return fmt.Errorf("layer %d: %w", i, err)
+				}
+				globals = append([][]byte{reset}, globals...)
+				active = map[string]bool{}
+			}
+			fg := layer.FileGetter
+			if target, ok := broken[squashMember{i, j}]; ok {
+				var err error
+				if rec, err = linkCopy(rec, records[target.layer][target.index]); err != nil {
+					return fmt.Errorf("layer %d: %w", i, err)
+				}
+				fg = layers[target.layer].FileGetter
+			}
+			if err := writeRecord(w, fg, rec, globals, copyBuffer); err != nil {
+				return fmt.Errorf("layer %d: %w", i, err)
+			}
+			globals = nil
+			for k := range pending {
+				written[k] = true
+			}
+			pending = map[string]bool{}
+		}
+		for k := range written {
+			active[k] = true
+		}
+	}
+	return writeZeros(w, 2*blockSize)
+}
+
+// splitMemberName splits a cleaned member name into its directory, "" at the
+// top, and its base name.
+func splitMemberName(name string) (dir, base string) {
+	i := strings.LastIndexByte(name, '/')
+	if i < 0 {
+		return "", name
+	}
+	return name[:i], name[i+1:]
+}
+
+func joinMemberName(dir, base string) string {
+	if dir == "" {
+		return base
+	}
+	return dir + "/" + base
+}
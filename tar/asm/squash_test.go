@@ -0,0 +1,279 @@
+package asm
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+func TestWriteSquashedTar(t *testing.T) {
+	dir := func(name string) testMember {
+		return testMember{hdr: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0o755}}
+	}
+	file := func(name, body string) testMember {
+		return testMember{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644}, body: body}
+	}
+	layers := [][]testMember{
+		{
+			dir("./"),
+			dir("./etc/"),
+			file("./etc/hosts", "127.0.0.1 localhost\n"),
+			file("./etc/passwd", "root:x:0:0::/root:/bin/sh\n"),
+			dir("./var/"),
+			dir("./var/lib/"),
+			file("./var/lib/db", "old"),
+			dir("./opt/"),
+			file("./opt/tool", "tool"),
+			dir("./bin/"),
+			file("./bin/sh", "shell"),
+			file("./f", "deleted"),
+		},
+		{
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hosts", Mode: 0o644, PAXRecords: map[string]string{"comment": "changed"}}, body: "::1 localhost\n"},
+			file("etc/.wh.passwd", ""),
+			file("var/lib/.wh..wh..opq", ""),
+			file("var/lib/new", "new"),
+			{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin"}},
+			file(".wh.f", ""),
+		},
+		{
+			file(".wh.opt", ""),
+			{hdr: tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "global", PAXRecords: map[string]string{"comment": "global"}}},
+			file("etc/motd", "motd"),
+		},
+	}
+
+	var (
+		squashLayers []SquashLayer
+		sources      = map[string][]byte{}
+	)
+	for _, members := range layers {
+		// each layer has payloads of its own
+		w, fgp := disassembleTestArchive(t, writeTestArchive(t, members...))
+		rr := NewRecordReader(storage.NewJSONUnpacker(bytes.NewReader(w.Bytes())))
+		for {
+			rec, err := rr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources[rec.Header.Name+"="+string(rec.Entry.Payload)] = rec.Raw
+		}
+		squashLayers = append(squashLayers, SquashLayer{Unpacker: storage.NewJSONUnpacker(w), FileGetter: fgp})
+	}
+
+	out := bytes.NewBuffer(nil)
+	w := bytes.NewBuffer(nil)
+	fgp := storage.NewBufferFileGetPutter()
+	if err := WriteSquashedTar(squashLayers, out, storage.NewJSONPacker(w), fgp); err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata assembles the archive written
+	assembled := bytes.NewBuffer(nil)
+	if err := WriteOutputTarStream(fgp, storage.NewJSONUnpacker(bytes.NewReader(w.Bytes())), assembled); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembled.Bytes(), out.Bytes()) {
+		t.Error("expected the metadata to assemble the squashed archive")
+	}
+
+	var names []string
+	bodies := map[string]string{}
+	rr := NewRecordReader(storage.NewJSONUnpacker(w))
+	tr := tar.NewReader(out)
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// headers are written as they were in their layer
+		if raw, ok := sources[rec.Header.Name+"="+string(rec.Entry.Payload)]; !ok || !bytes.Equal(raw, rec.Raw) {
+			t.Errorf("%s: expected the header of its layer", rec.Header.Name)
+		}
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		bodies[hdr.Name] = string(body)
+	}
+	expected := []string{"./", "./etc/", "./var/", "./var/lib/", "etc/hosts", "var/lib/new", "bin", "global", "etc/motd"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected members %q, got %q", expected, names)
+	}
+	if bodies["etc/hosts"] != "::1 localhost\n" || bodies["etc/motd"] != "motd" {
+		t.Errorf("expected the payloads of the highest layer, got %q", bodies)
+	}
+}
+
+func TestWriteSquashedTarHiddenMembers(t *testing.T) {
+	file := func(name, body string) testMember {
+		return testMember{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644}, body: body}
+	}
+	link := func(name, target string) testMember {
+		return testMember{hdr: tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: target}}
+	}
+	layers := [][]testMember{
+		{
+			file("lib/libc", "libc"),
+			link("lib/libc.so", "lib/libc"),
+			file("lib/libm", "libm"),
+			link("lib/libm.so", "lib/libm"),
+			link("lib/libm.so.1", "lib/libm.so"),
+			file("lib/libz", "libz"),
+			link("lib/libz.so", "lib/libz"),
+			{hdr: tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "global", PAXRecords: map[string]string{"comment": "lower"}}},
+			file("lib/keep", "keep"),
+		},
+		{
+			file("lib/.wh.libc", ""),
+			file("lib/libm", "new libm"),
+			file("lib/.wh.libm.so", ""),
+			file("etc/motd", "motd"),
+		},
+	}
+
+	var squashLayers []SquashLayer
+	for _, members := range layers {
+		w, fgp := disassembleTestArchive(t, writeTestArchive(t, members...))
+		squashLayers = append(squashLayers, SquashLayer{Unpacker: storage.NewJSONUnpacker(w), FileGetter: fgp})
+	}
+
+	out := bytes.NewBuffer(nil)
+	w := bytes.NewBuffer(nil)
+	fgp := storage.NewBufferFileGetPutter()
+	if err := WriteSquashedTar(squashLayers, out, storage.NewJSONPacker(w), fgp); err != nil {
+		t.Fatal(err)
+	}
+	assembled := bytes.NewBuffer(nil)
+	if err := WriteOutputTarStream(fgp, storage.NewJSONUnpacker(w), assembled); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembled.Bytes(), out.Bytes()) {
+		t.Error("expected the metadata to assemble the squashed archive")
+	}
+
+	var names []string
+	hdrs := map[string]*tar.Header{}
+	bodies := map[string]string{}
+	tr := tar.NewReader(out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		hdrs[hdr.Name] = hdr
+		bodies[hdr.Name] = string(body)
+	}
+
+	// links to deleted or replaced members are written as copies of the
+	// member they were linked to
+	for name, body := range map[string]string{"lib/libc.so": "libc", "lib/libm.so.1": "libm"} {
+		if hdr, ok := hdrs[name]; !ok || hdr.Typeflag != tar.TypeReg || bodies[name] != body {
+			t.Errorf("%s: expected a copy of %q, got %+v", name, body, hdr)
+		}
+	}
+	if hdr, ok := hdrs["lib/libz.so"]; !ok || hdr.Typeflag != tar.TypeLink || hdr.Linkname != "lib/libz" {
+		t.Errorf("lib/libz.so: expected a link to lib/libz, got %+v", hdr)
+	}
+
+	// the global header of the lower layer is reset before the members of
+	// the higher layer
+	expected := []string{"lib/libc.so", "lib/libm.so.1", "lib/libz", "lib/libz.so", "global", "lib/keep", "", "lib/libm", "etc/motd"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected members %q, got %q", expected, names)
+	}
+	for i, name := range names {
+		if expected[i] == "" {
+			hdr := hdrs[name]
+			if value, ok := hdr.PAXRecords["comment"]; hdr.Typeflag != tar.TypeXGlobalHeader || !ok || value != "" {
+				t.Errorf("expected a global header resetting the comment, got %+v", hdr)
+			}
+		} else if name != expected[i] {
+			t.Errorf("expected members %q, got %q", expected, names)
+			break
+		}
+	}
+}
+
+func TestWriteSquashedTarGlobalHeaders(t *testing.T) {
+	global := func(name, comment string) testMember {
+		return testMember{hdr: tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: name, PAXRecords: map[string]string{"comment": comment}}}
+	}
+	file := func(name string) testMember {
+		return testMember{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644}, body: name}
+	}
+	for _, names := range [][2]string{
+		{"pax_global_header", "pax_global_header"},
+		{"first", "second"},
+	} {
+		var squashLayers []SquashLayer
+		for _, members := range [][]testMember{
+			{global(names[0], "lower"), file("a")},
+			{global(names[1], "middle"), file("b")},
+			{file("c")},
+		} {
+			w, fgp := disassembleTestArchive(t, writeTestArchive(t, members...))
+			squashLayers = append(squashLayers, SquashLayer{Unpacker: storage.NewJSONUnpacker(w), FileGetter: fgp})
+		}
+
+		out := bytes.NewBuffer(nil)
+		w := bytes.NewBuffer(nil)
+		fgp := storage.NewBufferFileGetPutter()
+		if err := WriteSquashedTar(squashLayers, out, storage.NewJSONPacker(w), fgp); err != nil {
+			t.Fatalf("%q: %v", names, err)
+		}
+		assembled := bytes.NewBuffer(nil)
+		if err := WriteOutputTarStream(fgp, storage.NewJSONUnpacker(w), assembled); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(assembled.Bytes(), out.Bytes()) {
+			t.Errorf("%q: expected the metadata to assemble the squashed archive", names)
+		}
+
+		// each layer is preceded by the reset of the global headers of the
+		// layers below
+		var members []string
+		tr := tar.NewReader(out)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			member := hdr.Name
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				member = "global=" + hdr.PAXRecords["comment"]
+			}
+			members = append(members, member)
+		}
+		expected := []string{"global=lower", "a", "global=", "global=middle", "b", "global=", "c"}
+		if strings.Join(members, ",") != strings.Join(expected, ",") {
+			t.Errorf("%q: expected members %q, got %q", names, expected, members)
+		}
+	}
+}
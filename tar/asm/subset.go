@@ -0,0 +1,179 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// EntryFilter selects the members of an archive to assemble, by their decoded
+// header.
+type EntryFilter func(hdr *tar.Header) bool
+
+// GlobFilter returns an EntryFilter selecting the members whose name matches
+// any of patterns, as path.Match, or is under a directory that does. Leading
+// "/" and "./" are ignored, so "etc" selects "./etc/" and all below it.
+func GlobFilter(patterns ...string) (EntryFilter, error) {
+	cleaned := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		cleaned[i] = cleanMemberName(pattern)
+		if _, err := path.Match(cleaned[i], ""); err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+	}
+	return func(hdr *tar.Header) bool {
+		name := cleanMemberName(hdr.Name)
+		for {
+			for _, pattern := range cleaned {
+				if ok, _ := path.Match(pattern, name); ok {
+					return true
+				}
+			}
+			i := strings.LastIndexByte(name, '/')
+			if i < 0 {
+				return false
+			}
+			name = name[:i]
+		}
+	}, nil
+}
+
+// cleanMemberName returns name without leading "/" and "./", nor trailing "/".
+func cleanMemberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// WriteOutputTarSubset writes a tar archive of only the members of the
+// assembled archive that filter selects, to w. Each is written as its
+// original header blocks, including any PAX or GNU long name records of it,
+// and its payload. PAX global headers preceding a selected member are written
+// before it, and the archive ends with an end-of-archive marker.
+//
+// A hard link selected also selects the member it links to, so that it can be
+// extracted. The payloads of members not selected are not fetched from fg.
+func WriteOutputTarSubset(fg storage.FileGetter, up storage.Unpacker, w io.Writer, filter EntryFilter) error {
+	// ... Since these are interfaces, this is possible, so let's not have a nil pointer
+	if fg == nil || up == nil {
+		return nil
+	}
+	var (
+		records  []*Record
+		selected []bool
+		// the member each hard link links to, the last of its name before it
+		targets = map[int]int{}
+		last    = map[string]int{}
+	)
+	rr := NewRecordReader(up)
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		i := len(records)
+		records = append(records, rec)
+		if rec.Header.Typeflag == tar.TypeXGlobalHeader {
+			selected = append(selected, false)
+			continue
+		}
+		selected = append(selected, filter(rec.Header))
+		if rec.Header.Typeflag == tar.TypeLink {
+			if j, ok := last[cleanMemberName(rec.Header.Linkname)]; ok {
+				targets[i] = j
+			}
+		}
+		last[cleanMemberName(rec.Header.Name)] = i
+	}
+	// backwards, so that the target of a link to a link is selected too
+	for i := len(records) - 1; i >= 0; i-- {
+		if j, ok := targets[i]; ok && selected[i] {
+			selected[j] = true
+		}
+	}
+
+	copyBuffer := byteBufferPool.Get().([]byte)
+	defer byteBufferPool.Put(copyBuffer)
+	// the global headers not yet written, as they precede no selected member
+	var globals [][]byte
+	for i, rec := range records {
+		if rec.Header.Typeflag == tar.TypeXGlobalHeader {
+			globals = append(globals, rec.Raw)
+			continue
+		}
+		if !selected[i] {
+			continue
+		}
+		if err := writeRecord(w, fg, rec, globals, copyBuffer); err != nil {
+			return err
+		}
+		globals = nil
+	}
+	return writeZeros(w, 2*blockSize)
+}
+
+// writeRecord writes the member of rec to w, as its original header blocks
+// and its payload from fg, padded to a block, preceded by the global headers
+// raw.
+func writeRecord(w io.Writer, fg storage.FileGetter, rec *Record, globals [][]byte, buf []byte) error {
+	for _, raw := range globals {
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+		if pad := len(raw) % blockSize; pad > 0 {
+			if err := writeZeros(w, int64(blockSize-pad)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := w.Write(rec.Raw); err != nil {
+		return err
+	}
+	if err := writePayload(w, fg, rec.Entry, buf); err != nil {
+		return err
+	}
+	if pad := rec.Entry.Size % blockSize; pad > 0 {
+		return writeZeros(w, blockSize-pad)
+	}
+	return nil
+}
+
+// writePayload writes the payload of the FileType entry, inline or from fg,
+// to w, and verifies its checksum.
+func writePayload(w io.Writer, fg storage.FileGetter, entry *storage.Entry, buf []byte) error {
+	if entry.Size == 0 {
+		return nil
+	}
+	var fh io.ReadCloser
+	if len(entry.Inline) > 0 {
+		if int64(len(entry.Inline)) != entry.Size {
+			return fmt.Errorf("inline payload of %q is %d bytes, expected %d", entry.GetName(), len(entry.Inline), entry.Size)
+		}
+		fh = io.NopCloser(bytes.NewReader(entry.Inline))
+	} else {
+		var err error
+		fh, err = fg.Get(entry)
+		if err != nil {
+			return err
+		}
+	}
+	defer func() { _ = fh.Close() }()
+	hsh := storage.NewHash()
+	n, err := io.CopyBuffer(io.MultiWriter(w, hsh), io.LimitReader(fh, entry.Size), buf)
+	if err != nil {
+		return err
+	}
+	if n != entry.Size {
+		return fmt.Errorf("payload of %q is %d bytes, expected %d", entry.GetName(), n, entry.Size)
+	}
+	if !bytes.Equal(hsh.Sum(nil), entry.Payload) {
+		return fmt.Errorf("file integrity checksum failed for %q", entry.GetName())
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package asm
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// recordingGetter records the names of the payloads it is asked for.
+type recordingGetter struct {
+	storage.FileGetter
+	mu    sync.Mutex
+	names []string
+}
+
+func (rg *recordingGetter) Get(entry *storage.Entry) (io.ReadCloser, error) {
+	rg.mu.Lock()
+	rg.names = append(rg.names, entry.GetName())
+	rg.mu.Unlock()
+	return rg.FileGetter.Get(entry)
+}
+
+func TestWriteOutputTarSubset(t *testing.T) {
+	longName := "etc/" + strings.Repeat("long/", 30) + "name"
+	members := []testMember{
+		{hdr: tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "global", PAXRecords: map[string]string{"comment": "first"}}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hosts", Mode: 0o644}, body: "127.0.0.1 localhost\n"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: longName, Mode: 0o644, Format: tar.FormatGNU}, body: "gnu long name"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/pax", Mode: 0o644, PAXRecords: map[string]string{"comment": "local"}}, body: "pax"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/libc", Mode: 0o644}, body: "libc"},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "usr/lib/libc.so", Linkname: "usr/lib/libc", Mode: 0o644}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/libc", Linkname: "usr/lib/libc.so", Mode: 0o644}},
+		{hdr: tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "global2", PAXRecords: map[string]string{"comment": "second"}}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etcetera", Mode: 0o644}, body: "not under etc"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/tool", Mode: 0o755}, body: strings.Repeat("x", 1000)},
+	}
+	w, fgp := disassembleTestArchive(t, writeTestArchive(t, members...))
+
+	filter, err := GlobFilter("/etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg := &recordingGetter{FileGetter: fgp}
+	out := bytes.NewBuffer(nil)
+	if err := WriteOutputTarSubset(rg, storage.NewJSONUnpacker(w), out, filter); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len()%blockSize != 0 || !bytes.Equal(out.Bytes()[out.Len()-2*blockSize:], make([]byte, 2*blockSize)) {
+		t.Error("expected the subset to end with an end-of-archive marker")
+	}
+
+	var names []string
+	bodies := map[string]string{}
+	tr := tar.NewReader(out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		bodies[hdr.Name] = string(body)
+		if hdr.Typeflag == tar.TypeXGlobalHeader && hdr.PAXRecords["comment"] != "first" {
+			t.Errorf("expected the first global header, got %v", hdr.PAXRecords)
+		}
+	}
+	// with the links etc/libc links to
+	expected := []string{"global", "etc/", "etc/hosts", longName, "etc/pax", "usr/lib/libc", "usr/lib/libc.so", "etc/libc"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected members %q, got %q", expected, names)
+	}
+	for _, m := range members {
+		if body, ok := bodies[m.hdr.Name]; ok && body != m.body {
+			t.Errorf("%s: expected %q, got %q", m.hdr.Name, m.body, body)
+		}
+	}
+
+	sort.Strings(rg.names)
+	fetched := []string{longName, "etc/hosts", "etc/pax", "usr/lib/libc"}
+	sort.Strings(fetched)
+	if strings.Join(rg.names, ",") != strings.Join(fetched, ",") {
+		t.Errorf("expected only %q to be fetched, got %q", fetched, rg.names)
+	}
+
+	if _, err := GlobFilter("etc/["); err == nil {
+		t.Error("expected a malformed pattern to fail")
+	}
+}
@@ -0,0 +1,129 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// WriteOutputTarAt writes the assembled tar archive to w, from offset 0, and
+// returns its size. As the offset of every payload is known from the metadata
+// up front, payloads are fetched from fg and written by workers goroutines at
+// once, each verified against its checksum. A workers of zero or less is
+// runtime.GOMAXPROCS.
+//
+// The first error stops further payloads from being fetched, and is returned
+// once those being written are done. Anything of w past the size returned is
+// left as it is, so an existing file should be truncated to it.
+func WriteOutputTarAt(fg storage.FileGetter, up storage.Unpacker, w io.WriterAt, workers int) (int64, error) {
+	// ... Since these are interfaces, this is possible, so let's not have a nil pointer
+	if fg == nil || up == nil {
+		return 0, nil
+	}
+	parts, size, err := layout(up)
+	if err != nil {
+		return 0, err
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		jobs     = make(chan *layoutPart)
+		stop     = make(chan struct{})
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := byteBufferPool.Get().([]byte)
+			defer byteBufferPool.Put(buf)
+			for part := range jobs {
+				if err := writePayloadAt(fg, part, w, buf); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := range parts {
+		part := &parts[i]
+		var err error
+		switch {
+		case part.entry != nil:
+			select {
+			case jobs <- part:
+			case <-stop:
+				break dispatch
+			}
+		case part.zero:
+			err = writeZerosAt(w, part.off, part.size)
+		default:
+			_, err = w.WriteAt(part.raw, part.off)
+		}
+		if err != nil {
+			fail(err)
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return size, nil
+}
+
+// writePayloadAt writes the payload of part to w, at its offset, and verifies
+// its checksum.
+func writePayloadAt(fg storage.FileGetter, part *layoutPart, w io.WriterAt, buf []byte) error {
+	rc, err := fg.Get(part.entry)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rc.Close() }()
+	hsh := storage.NewHash()
+	dst := io.MultiWriter(&offsetWriter{w: w, off: part.off}, hsh)
+	n, err := io.CopyBuffer(dst, io.LimitReader(rc, part.size), buf)
+	if err != nil {
+		return err
+	}
+	if n != part.size {
+		return fmt.Errorf("payload of %q is %d bytes, expected %d", part.entry.GetName(), n, part.size)
+	}
+	if !bytes.Equal(hsh.Sum(nil), part.entry.Payload) {
+		return fmt.Errorf("file integrity checksum failed for %q", part.entry.GetName())
+	}
+	return nil
+}
+
+// writeZerosAt writes n zero bytes to w, at off.
+func writeZerosAt(w io.WriterAt, off, n int64) error {
+	return writeZeros(&offsetWriter{w: w, off: off}, n)
+}
+
+// offsetWriter writes to an io.WriterAt sequentially, from off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.off)
+	ow.off += int64(n)
+	return n, err
+}
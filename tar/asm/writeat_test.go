@@ -0,0 +1,82 @@
+package asm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+func TestWriteOutputTarAt(t *testing.T) {
+	for _, tc := range testCases {
+		fh, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = fh.Close() }()
+		gzRdr, err := gzip.NewReader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := bytes.NewBuffer(nil)
+		fgp := storage.NewBufferFileGetPutter()
+		tarStream, err := NewInputTarStream(gzRdr, storage.NewJSONPacker(w), fgp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, tarStream); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, workers := range []int{1, 4, 0} {
+			dst, err := os.CreateTemp(t.TempDir(), "dst")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = dst.Close() }()
+			size, err := WriteOutputTarAt(fgp, storage.NewJSONUnpacker(bytes.NewReader(w.Bytes())), dst, workers)
+			if err != nil {
+				t.Fatalf("%s: %s", tc.path, err)
+			}
+			if size != tc.expectedSize {
+				t.Errorf("%s: size of output tar: expected %d; got %d", tc.path, tc.expectedSize, size)
+			}
+			h := sha1.New()
+			if _, err := io.Copy(h, io.NewSectionReader(dst, 0, size)); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%x", h.Sum(nil)) != tc.expectedSHA1Sum {
+				t.Errorf("%s with %d workers: checksum of output tar: expected %s; got %x", tc.path, workers, tc.expectedSHA1Sum, h.Sum(nil))
+			}
+		}
+	}
+}
+
+func TestWriteOutputTarAtChecksum(t *testing.T) {
+	fgp := storage.NewBufferFileGetPutter()
+	w := bytes.NewBuffer(nil)
+	sp := storage.NewJSONPacker(w)
+	for _, e := range entriesMangled {
+		if _, _, err := fgp.Put(e.Entry.GetName(), bytes.NewBuffer(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sp.AddEntry(e.Entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst, err := os.CreateTemp(t.TempDir(), "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = dst.Close() }()
+	_, err = WriteOutputTarAt(fgp, storage.NewJSONUnpacker(w), dst, 2)
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected the mangled payloads to fail their checksum, got %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package bundle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+const (
+	// MetadataName is the name of the metadata member of a bundle.
+	MetadataName = "tar-data.json.gz"
+	payloadDir   = "payloads/"
+)
+
+var (
+	// ErrNoMetadata occurs when a bundle does not start with its metadata.
+	ErrNoMetadata = errors.New("bundle does not start with its metadata")
+	// ErrChecksumMismatch occurs when a payload does not match the checksum
+	// it is referenced or stored by.
+	ErrChecksumMismatch = storage.ErrChecksumMismatch
+)
+
+// Stats reports what Write packed.
+type Stats struct {
+	// Payloads and Bytes count the distinct payloads packed.
+	Payloads int
+	Bytes    int64
+}
+
+// Write writes a bundle to w of the metadata read from r, as packed by
+// storage.NewJSONPacker, and the payloads it references, gotten from fg.
+// Payloads referenced more than once are packed once. Empty payloads and
+// those inlined in their entry are not stored, so are not packed.
+//
+// The metadata is held in memory, as it is read twice.
+func Write(w io.Writer, r io.Reader, fg storage.FileGetter) (Stats, error) {
+	var stats Stats
+	metadata, err := io.ReadAll(r)
+	if err != nil {
+		return stats, err
+	}
+	zbuf := bytes.NewBuffer(nil)
+	zw := gzip.NewWriter(zbuf)
+	if _, err := zw.Write(metadata); err != nil {
+		return stats, err
+	}
+	if err := zw.Close(); err != nil {
+		return stats, err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(member(MetadataName, int64(zbuf.Len()))); err != nil {
+		return stats, err
+	}
+	if _, err := tw.Write(zbuf.Bytes()); err != nil {
+		return stats, err
+	}
+
+	seen := storage.ChecksumSet{}
+	up := storage.NewJSONUnpacker(bytes.NewReader(metadata))
+	for {
+		entry, err := up.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		if entry.Type != storage.FileType || entry.Size == 0 || len(entry.Inline) > 0 || seen.Has(entry.Payload) {
+			continue
+		}
+		seen.Add(entry.Payload)
+		if err := writePayload(tw, entry, fg); err != nil {
+			return stats, fmt.Errorf("%q: %w", entry.GetName(), err)
+		}
+		stats.Payloads++
+		stats.Bytes += entry.Size
+	}
+	return stats, tw.Close()
+}
+
+func writePayload(tw *tar.Writer, entry *storage.Entry, fg storage.FileGetter) error {
+	fh, err := fg.Get(entry)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fh.Close() }()
+	if err := tw.WriteHeader(member(payloadDir+hex.EncodeToString(entry.Payload), entry.Size)); err != nil {
+		return err
+	}
+	hsh := storage.NewHash()
+	n, err := io.Copy(io.MultiWriter(tw, hsh), io.LimitReader(fh, entry.Size))
+	if err != nil {
+		return err
+	}
+	if n != entry.Size {
+		return fmt.Errorf("payload has size %d but entry expects %d: %w", n, entry.Size, storage.ErrSizeMismatch)
+	}
+	if !bytes.Equal(hsh.Sum(nil), entry.Payload) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// member returns the header of a bundle member, the same for every bundle.
+func member(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}
+}
+
+// Import reads the bundle from r, writing its metadata, decompressed, to w
+// and putting its payloads to fp. Payloads are checked against the checksum
+// they are stored by.
+func Import(r io.Reader, w io.Writer, fp storage.FilePutter) (Stats, error) {
+	var stats Stats
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err == io.EOF || (err == nil && hdr.Name != MetadataName) {
+		return stats, ErrNoMetadata
+	}
+	if err != nil {
+		return stats, err
+	}
+	zr, err := gzip.NewReader(tr)
+	if err != nil {
+		return stats, err
+	}
+	if _, err := io.Copy(w, zr); err != nil {
+		return stats, err
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		checksum, err := payloadChecksum(hdr.Name)
+		if err != nil {
+			return stats, err
+		}
+		n, csum, err := fp.Put(hdr.Name, tr)
+		if err != nil {
+			return stats, err
+		}
+		if !bytes.Equal(csum, checksum) {
+			return stats, fmt.Errorf("%s: %w", hdr.Name, ErrChecksumMismatch)
+		}
+		stats.Payloads++
+		stats.Bytes += n
+	}
+}
+
+func payloadChecksum(name string) ([]byte, error) {
+	if !strings.HasPrefix(name, payloadDir) {
+		return nil, fmt.Errorf("unexpected bundle member %q", name)
+	}
+	checksum, err := hex.DecodeString(strings.TrimPrefix(name, payloadDir))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected bundle member %q", name)
+	}
+	return checksum, nil
+}
+
+// Reader reads the metadata and payloads of a bundle in place. It is a
+// storage.FileGetter of the payloads, by checksum, safe for concurrent use.
+type Reader struct {
+	metadata *io.SectionReader
+	payloads map[string]*io.SectionReader // by hex checksum
+}
+
+// NewReader indexes the bundle of size bytes read from ra. Only the headers
+// of its members are read.
+func NewReader(ra io.ReaderAt, size int64) (*Reader, error) {
+	sr := io.NewSectionReader(ra, 0, size)
+	tr := tar.NewReader(sr)
+	br := &Reader{payloads: map[string]*io.SectionReader{}}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the Reader does not read ahead of the data of a member
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		section := io.NewSectionReader(ra, offset, hdr.Size)
+		if br.metadata == nil {
+			if hdr.Name != MetadataName {
+				return nil, ErrNoMetadata
+			}
+			br.metadata = section
+			continue
+		}
+		checksum, err := payloadChecksum(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		br.payloads[hex.EncodeToString(checksum)] = section
+	}
+	if br.metadata == nil {
+		return nil, ErrNoMetadata
+	}
+	return br, nil
+}
+
+// Metadata returns the metadata of the bundle, decompressed, to read with
+// storage.NewJSONUnpacker.
+func (br *Reader) Metadata() (io.ReadCloser, error) {
+	return gzip.NewReader(io.NewSectionReader(br.metadata, 0, br.metadata.Size()))
+}
+
+// Get returns the payload of the FileType entry, by its checksum.
+func (br *Reader) Get(entry *storage.Entry) (io.ReadCloser, error) {
+	key := hex.EncodeToString(entry.Payload)
+	section, ok := br.payloads[key]
+	if !ok {
+		return nil, fmt.Errorf("payload %s: %w", key, os.ErrNotExist)
+	}
+	if section.Size() != entry.Size {
+		return nil, fmt.Errorf("bundled payload has size %d but entry expects %d: %w", section.Size(), entry.Size, storage.ErrSizeMismatch)
+	}
+	// a SectionReader of its own, as they are not safe for concurrent use
+	return io.NopCloser(io.NewSectionReader(section, 0, section.Size())), nil
+}
@@ -0,0 +1,123 @@
+package bundle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/bmoylan/tar-split/tar/asm"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// disassemble splits the archive at path into its metadata and a
+// ChecksumStore of its payloads, and returns them with the archive.
+func disassemble(t *testing.T, path string) ([]byte, *storage.ChecksumStore, []byte) {
+	t.Helper()
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fh.Close() }()
+	gzRdr, err := gzip.NewReader(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := storage.NewChecksumStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := bytes.NewBuffer(nil)
+	tarStream, err := asm.NewInputTarStream(gzRdr, storage.NewJSONPacker(metadata), cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(tarStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata.Bytes(), cs, archive
+}
+
+func assemble(t *testing.T, metadata io.Reader, fg storage.FileGetter) []byte {
+	t.Helper()
+	out := bytes.NewBuffer(nil)
+	if err := asm.WriteOutputTarStream(fg, storage.NewJSONUnpacker(metadata), out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestBundle(t *testing.T) {
+	for _, path := range []string{"../asm/testdata/t.tar.gz", "../asm/testdata/iso-8859.tar.gz"} {
+		metadata, cs, archive := disassemble(t, path)
+
+		b := bytes.NewBuffer(nil)
+		stats, err := Write(b, bytes.NewReader(metadata), cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Payloads == 0 {
+			t.Errorf("%s: expected payloads to be bundled", path)
+		}
+
+		// in place
+		br, err := NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr, err := br.Metadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := assemble(t, mr, br); !bytes.Equal(out, archive) {
+			t.Errorf("%s: archive assembled from the bundle differs", path)
+		}
+
+		// imported
+		imported, err := storage.NewChecksumStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := bytes.NewBuffer(nil)
+		istats, err := Import(bytes.NewReader(b.Bytes()), m, imported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if istats != stats {
+			t.Errorf("%s: imported %+v, bundled %+v", path, istats, stats)
+		}
+		if !bytes.Equal(m.Bytes(), metadata) {
+			t.Errorf("%s: imported metadata differs", path)
+		}
+		if out := assemble(t, m, imported); !bytes.Equal(out, archive) {
+			t.Errorf("%s: archive assembled from the import differs", path)
+		}
+	}
+}
+
+func TestBundleErrors(t *testing.T) {
+	metadata, cs, _ := disassemble(t, "../asm/testdata/t.tar.gz")
+
+	// a payload missing from the getter
+	if _, err := Write(io.Discard, bytes.NewReader(metadata), storage.NewBufferFileGetPutter()); err == nil {
+		t.Error("expected an error for a missing payload")
+	}
+
+	b := bytes.NewBuffer(nil)
+	if _, err := Write(b, bytes.NewReader(metadata), cs); err != nil {
+		t.Fatal(err)
+	}
+	// flip a byte of the last payload, before the end-of-archive marker
+	corrupt := append([]byte(nil), b.Bytes()...)
+	i := bytes.LastIndexFunc(corrupt[:len(corrupt)-1024], func(r rune) bool { return r != 0 })
+	corrupt[i] ^= 0xff
+	if _, err := Import(bytes.NewReader(corrupt), io.Discard, storage.NewBufferFileGetPutter()); err == nil {
+		t.Error("expected a checksum mismatch importing a corrupt payload")
+	}
+
+	if _, err := NewReader(bytes.NewReader(nil), 0); err != ErrNoMetadata {
+		t.Errorf("expected %v, got %v", ErrNoMetadata, err)
+	}
+}
@@ -0,0 +1,11 @@
+/*
+Package bundle packs the metadata of a tar archive together with the file
+payloads it references, so an archive can be moved as one file holding only
+what is needed to assemble it.
+
+A bundle is itself a tar archive. Its first member is the gzip compressed
+metadata, as packed by storage.NewJSONPacker, followed by one member per
+distinct payload, named by its hex checksum under "payloads/". Payloads are
+stored uncompressed, so they can be read in place from a bundle on disk.
+*/
+package bundle
@@ -0,0 +1,11 @@
+/*
+Package server serves a checksum content store, and the tar archives assembled
+from it, over HTTP.
+
+Payloads are served by their hex checksum under "/payloads/", so that
+storage.NewHTTPFileGetter of that URL fetches them. Tar archives are served
+under "/tars/", by the name of their metadata in the metadata directory less
+its ".json.gz" or ".json" extension, assembled as they are read and with
+support for range requests.
+*/
+package server
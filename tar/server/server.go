@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmoylan/tar-split/tar/asm"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+// metadataExts are the extensions of the metadata of a tar archive, gzip
+// compressed first.
+var metadataExts = []string{".json.gz", ".json"}
+
+// HandlerOptions tune a handler of NewHandlerWithOptions.
+type HandlerOptions struct {
+	// MaxEntrySize bounds the packed entries of the metadata read, as with
+	// storage.NewJSONUnpackerWithLimit. Zero is no limit.
+	MaxEntrySize int64
+	// MaxRatio bounds the decompression ratio of gzip compressed metadata,
+	// as with storage.NewGzipReaderWithLimit. Zero is no limit.
+	MaxRatio int64
+}
+
+// NewHandler returns an http.Handler serving the payloads of cs, and the tar
+// archives whose metadata is in metadataDir.
+func NewHandler(cs *storage.ChecksumStore, metadataDir string) http.Handler {
+	return NewHandlerWithOptions(cs, metadataDir, HandlerOptions{})
+}
+
+// NewHandlerWithOptions is NewHandler, tuned by opts.
+func NewHandlerWithOptions(cs *storage.ChecksumStore, metadataDir string, opts HandlerOptions) http.Handler {
+	s := &server{cs: cs, metadataDir: metadataDir, opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/payloads/", s.servePayload)
+	mux.HandleFunc("/tars/", s.serveTar)
+	return mux
+}
+
+type server struct {
+	cs          *storage.ChecksumStore
+	metadataDir string
+	opts        HandlerOptions
+}
+
+func (s *server) servePayload(w http.ResponseWriter, r *http.Request) {
+	checksum, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, "/payloads/"))
+	if err != nil || len(checksum) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	rc, err := s.cs.Open(checksum)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	defer rc.Close()
+	if file, ok := rc.(*os.File); ok {
+		stat, err := file.Stat()
+		if err != nil {
+			serveError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", stat.ModTime(), file)
+		return
+	}
+	// decompressed as it is read, so of unknown size
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = io.Copy(w, rc)
+}
+
+func (s *server) serveTar(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/tars/")
+	if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+		http.NotFound(w, r)
+		return
+	}
+	var (
+		mf  *os.File
+		ext string
+		err error
+	)
+	for _, ext = range metadataExts {
+		mf, err = os.Open(filepath.Join(s.metadataDir, name+ext))
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	defer mf.Close()
+	stat, err := mf.Stat()
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	var metadata io.Reader = mf
+	if ext == ".json.gz" {
+		gz, err := storage.NewGzipReaderWithLimit(mf, s.opts.MaxRatio)
+		if err != nil {
+			serveError(w, r, err)
+			return
+		}
+		defer gz.Close()
+		metadata = gz
+	}
+
+	trs, err := asm.NewTarReadSeeker(s.cs, storage.NewJSONUnpackerWithLimit(metadata, s.opts.MaxEntrySize))
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+	defer trs.Close()
+	w.Header().Set("Content-Type", "application/x-tar")
+	http.ServeContent(w, r, "", stat.ModTime(), trs)
+}
+
+// serveError replies to r with the status for err.
+func serveError(w http.ResponseWriter, r *http.Request, err error) {
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
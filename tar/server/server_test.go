@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmoylan/tar-split/tar/asm"
+	"github.com/bmoylan/tar-split/tar/storage"
+)
+
+func TestHandler(t *testing.T) {
+	fh, err := os.Open("../asm/testdata/longlink.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fh.Close() }()
+	gzRdr, err := gzip.NewReader(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := storage.NewChecksumStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadataDir := t.TempDir()
+	mf, err := os.Create(filepath.Join(metadataDir, "longlink.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfz := gzip.NewWriter(mf)
+	tarStream, err := asm.NewInputTarStream(gzRdr, storage.NewJSONPacker(mfz), cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(tarStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mfz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(NewHandler(cs, metadataDir))
+	defer srv.Close()
+
+	get := func(path, rng string) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+
+	if status, body := get("/tars/longlink", ""); status != http.StatusOK || !bytes.Equal(body, archive) {
+		t.Errorf("expected the archive, got status %d and %d bytes", status, len(body))
+	}
+	if status, body := get("/tars/longlink", "bytes=1000-2999"); status != http.StatusPartialContent || !bytes.Equal(body, archive[1000:3000]) {
+		t.Errorf("expected bytes 1000-2999 of the archive, got status %d and %d bytes", status, len(body))
+	}
+	for _, path := range []string{"/tars/missing", "/tars/..", "/tars/a/b", "/payloads/0011", "/payloads/nothex"} {
+		if status, _ := get(path, ""); status != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", path, http.StatusNotFound, status)
+		}
+	}
+
+	// the archive assembles from the payloads served
+	metadata, err := os.ReadFile(filepath.Join(metadataDir, "longlink.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(metadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.NewBuffer(nil)
+	fg := storage.NewHTTPFileGetter(srv.URL + "/payloads")
+	if err := asm.WriteOutputTarStream(fg, storage.NewJSONUnpacker(gz), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), archive) {
+		t.Error("archive assembled from served payloads differs")
+	}
+
+	// the metadata read is bounded
+	limited := httptest.NewServer(NewHandlerWithOptions(cs, metadataDir, HandlerOptions{MaxEntrySize: 16}))
+	defer limited.Close()
+	resp, err := http.Get(limited.URL + "/tars/longlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status %d past the entry size limit, got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
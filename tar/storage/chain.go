@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// ErrChecksumMismatch occurs when a payload does not match the checksum of
+// its Entry.
+var ErrChecksumMismatch = errors.New("payload checksum mismatch")
+
+// chainSpoolMemory is the size of payloads verified in memory by a
+// ChainFileGetter. Larger ones are spooled to a temporary file.
+const chainSpoolMemory = 1 << 20
+
+// ChainStats counts the outcomes of Get for a source of a ChainFileGetter.
+type ChainStats struct {
+	Hits             int
+	NotFound         int
+	SizeMismatch     int
+	ChecksumMismatch int
+	// Errors are other failures, which end the Get.
+	Errors int
+}
+
+// ChainFileGetter is a FileGetter that tries each of its sources in turn,
+// such as an extracted tree, then a shared store, then a remote mirror.
+//
+// A payload that a source does not have, or has at the wrong size or
+// checksum, falls through to the next source. As the checksum can only be
+// known once the payload is read, each payload is read in full and verified
+// before Get returns it, spooled to a temporary file if it is large. Any
+// other error of a source is returned.
+type ChainFileGetter struct {
+	getters []FileGetter
+
+	mu    sync.Mutex
+	stats []ChainStats
+}
+
+// NewChainFileGetter returns a ChainFileGetter of getters, tried in order.
+func NewChainFileGetter(getters ...FileGetter) *ChainFileGetter {
+	return &ChainFileGetter{
+		getters: getters,
+		stats:   make([]ChainStats, len(getters)),
+	}
+}
+
+// Stats returns the counts of each source, in order. It is safe to call
+// while Get is.
+func (c *ChainFileGetter) Stats() []ChainStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ChainStats(nil), c.stats...)
+}
+
+// Get returns the payload of entry from the first source having it intact.
+func (c *ChainFileGetter) Get(entry *Entry) (io.ReadCloser, error) {
+	for i, fg := range c.getters {
+		rc, err := getVerified(fg, entry)
+		c.mu.Lock()
+		stats := &c.stats[i]
+		switch {
+		case err == nil:
+			stats.Hits++
+		case errors.Is(err, fs.ErrNotExist):
+			stats.NotFound++
+		case errors.Is(err, ErrSizeMismatch):
+			stats.SizeMismatch++
+		case errors.Is(err, ErrChecksumMismatch):
+			stats.ChecksumMismatch++
+		default:
+			stats.Errors++
+		}
+		c.mu.Unlock()
+		if err == nil {
+			return rc, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrSizeMismatch) && !errors.Is(err, ErrChecksumMismatch) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%q is in none of %d sources: %w", entry.GetName(), len(c.getters), fs.ErrNotExist)
+}
+
+// getVerified reads the payload of entry from fg in full, and returns it if
+// it has the size and checksum of entry.
+func getVerified(fg FileGetter, entry *Entry) (io.ReadCloser, error) {
+	rc, err := fg.Get(entry)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+
+	// one byte more than expected, to tell a longer payload
+	src := io.LimitReader(rc, entry.Size+1)
+	hsh := NewHash()
+	var spool io.ReadCloser
+	var n int64
+	if entry.Size <= chainSpoolMemory {
+		buf := bytes.NewBuffer(make([]byte, 0, entry.Size))
+		n, err = io.Copy(io.MultiWriter(buf, hsh), src)
+		spool = io.NopCloser(buf)
+	} else {
+		var tmp *os.File
+		tmp, err = os.CreateTemp("", "tar-split-chain-")
+		if err != nil {
+			return nil, err
+		}
+		spool = tempFile{tmp}
+		n, err = io.Copy(io.MultiWriter(tmp, hsh), src)
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+	}
+	if err == nil && n != entry.Size {
+		err = fmt.Errorf("%q has size %d but entry expects %d: %w", entry.GetName(), n, entry.Size, ErrSizeMismatch)
+	}
+	if err == nil && !bytes.Equal(hsh.Sum(nil), entry.Payload) {
+		err = fmt.Errorf("%q: %w", entry.GetName(), ErrChecksumMismatch)
+	}
+	if err != nil {
+		_ = spool.Close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+// tempFile is a temporary file, removed once closed.
+type tempFile struct {
+	*os.File
+}
+
+func (tf tempFile) Close() error {
+	err := tf.File.Close()
+	if rerr := os.Remove(tf.File.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
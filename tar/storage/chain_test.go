@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+type errGetter struct{ err error }
+
+func (eg errGetter) Get(*Entry) (io.ReadCloser, error) { return nil, eg.err }
+
+func TestChainFileGetter(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), chainSpoolMemory/8)
+	files := map[string][]byte{"small": []byte("foo"), "large": large}
+
+	empty := NewBufferFileGetPutter()
+	wrongSize := NewBufferFileGetPutter()
+	corrupt := NewBufferFileGetPutter()
+	good := NewBufferFileGetPutter()
+	entries := map[string]*Entry{}
+	for name, body := range files {
+		n, csum, err := good.Put(name, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[name] = &Entry{Type: FileType, Name: name, Size: n, Payload: csum}
+		if _, _, err := wrongSize.Put(name, bytes.NewReader(append(body, '!'))); err != nil {
+			t.Fatal(err)
+		}
+		flipped := append([]byte(nil), body...)
+		flipped[0] ^= 0xff
+		if _, _, err := corrupt.Put(name, bytes.NewReader(flipped)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chain := NewChainFileGetter(empty, wrongSize, corrupt, good)
+	for name, body := range files {
+		r, err := chain.Get(entries[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, body) {
+			t.Errorf("%s: payload did not come from the good source", name)
+		}
+	}
+	expected := []ChainStats{{NotFound: 2}, {SizeMismatch: 2}, {ChecksumMismatch: 2}, {Hits: 2}}
+	for i, stats := range chain.Stats() {
+		if stats != expected[i] {
+			t.Errorf("source %d: expected %+v, got %+v", i, expected[i], stats)
+		}
+	}
+
+	if _, err := NewChainFileGetter(empty).Get(entries["small"]); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected %v, got %v", fs.ErrNotExist, err)
+	}
+	// other errors are not fallen through
+	boom := errors.New("boom")
+	if _, err := NewChainFileGetter(errGetter{boom}, good).Get(entries["small"]); err != boom {
+		t.Errorf("expected %v, got %v", boom, err)
+	}
+}
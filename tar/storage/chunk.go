@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"io"
+	"math/bits"
+)
+
+// ChunkOptions sets the sizes of the chunks content-defined chunking cuts.
+// Zero values take the defaults of 16 KiB, 64 KiB and 256 KiB.
+type ChunkOptions struct {
+	// MinSize is the smallest chunk cut, other than the last one.
+	MinSize int
+	// AvgSize is the size chunks are cut at on average, rounded down to a
+	// power of two.
+	AvgSize int
+	// MaxSize is the largest chunk cut.
+	MaxSize int
+}
+
+const (
+	defaultMinChunkSize = 16 << 10
+	defaultAvgChunkSize = 64 << 10
+	defaultMaxChunkSize = 256 << 10
+)
+
+func (opts ChunkOptions) withDefaults() ChunkOptions {
+	if opts.MinSize <= 0 {
+		opts.MinSize = defaultMinChunkSize
+	}
+	if opts.AvgSize <= 0 {
+		opts.AvgSize = defaultAvgChunkSize
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultMaxChunkSize
+	}
+	if opts.AvgSize < opts.MinSize {
+		opts.AvgSize = opts.MinSize
+	}
+	if opts.MaxSize < opts.AvgSize {
+		opts.MaxSize = opts.AvgSize
+	}
+	return opts
+}
+
+// gearTable holds the random values FastCDC rolls its hash with. It is fixed,
+// so the same content is cut the same way by every build.
+var gearTable = func() (t [256]uint64) {
+	// splitmix64
+	x := uint64(0x7461722d73706c69)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// chunker cuts a stream into chunks with FastCDC, so that an insertion or
+// deletion only changes the chunks around it, and the rest are cut the same.
+type chunker struct {
+	r     io.Reader
+	opts  ChunkOptions
+	maskS uint64 // harder to match, before AvgSize
+	maskL uint64 // easier to match, after AvgSize
+
+	buf  []byte
+	n    int // bytes read into buf
+	last int // size of the chunk last returned, at the start of buf
+	err  error
+}
+
+func newChunker(r io.Reader, opts ChunkOptions) *chunker {
+	opts = opts.withDefaults()
+	avgBits := bits.Len(uint(opts.AvgSize)) - 1
+	if avgBits < 3 {
+		avgBits = 3
+	}
+	return &chunker{
+		r:     r,
+		opts:  opts,
+		maskS: ^uint64(0) << (64 - (avgBits + 2)),
+		maskL: ^uint64(0) << (64 - (avgBits - 2)),
+		buf:   make([]byte, opts.MaxSize),
+	}
+}
+
+// Next returns the next chunk, which is only valid until the following call,
+// or io.EOF once the stream is exhausted.
+func (c *chunker) Next() ([]byte, error) {
+	c.n = copy(c.buf, c.buf[c.last:c.n])
+	c.last = 0
+	for c.n < len(c.buf) && c.err == nil {
+		var m int
+		m, c.err = c.r.Read(c.buf[c.n:])
+		c.n += m
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+	c.last = c.cut(c.buf[:c.n])
+	return c.buf[:c.last], nil
+}
+
+// cut returns where the first chunk of b ends.
+func (c *chunker) cut(b []byte) int {
+	if len(b) <= c.opts.MinSize {
+		return len(b)
+	}
+	normal := c.opts.AvgSize
+	if len(b) < normal {
+		normal = len(b)
+	}
+	var h uint64
+	i := c.opts.MinSize
+	for ; i < normal; i++ {
+		h = h<<1 + gearTable[b[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < len(b); i++ {
+		h = h<<1 + gearTable[b[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return len(b)
+}
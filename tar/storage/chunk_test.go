@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkSizes(t *testing.T, b []byte, opts ChunkOptions) []int {
+	t.Helper()
+	var sizes []int
+	c := newChunker(bytes.NewReader(b), opts)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return sizes
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(chunk))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	opts := ChunkOptions{MinSize: 1 << 10, AvgSize: 4 << 10, MaxSize: 16 << 10}
+	b := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(b)
+
+	sizes := chunkSizes(t, b, opts)
+	var total int
+	for i, size := range sizes {
+		total += size
+		if size > opts.MaxSize || (size < opts.MinSize && i != len(sizes)-1) {
+			t.Errorf("chunk %d has size %d out of bounds", i, size)
+		}
+	}
+	if total != len(b) {
+		t.Errorf("expected chunks to add up to %d, got %d", len(b), total)
+	}
+	if avg := total / len(sizes); avg < opts.AvgSize/2 || avg > opts.AvgSize*2 {
+		t.Errorf("expected an average chunk size near %d, got %d", opts.AvgSize, avg)
+	}
+
+	// an insertion only changes the chunks around it
+	edited := append(append(append([]byte(nil), b[:500<<10]...), "inserted"...), b[500<<10:]...)
+	seen := map[int]int{}
+	for _, size := range sizes {
+		seen[size]++
+	}
+	var shared int
+	for _, size := range chunkSizes(t, edited, opts) {
+		if seen[size] > 0 {
+			seen[size]--
+			shared++
+		}
+	}
+	if shared < len(sizes)-3 {
+		t.Errorf("expected all but a few of %d chunks to be shared, got %d", len(sizes), shared)
+	}
+}
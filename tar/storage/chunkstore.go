@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	chunkDir    = "chunks"
+	manifestDir = "manifests"
+)
+
+// chunkManifest lists the chunks a payload is the concatenation of.
+type chunkManifest struct {
+	Size   int64      `json:"size"`
+	Chunks []chunkRef `json:"chunks"`
+}
+
+type chunkRef struct {
+	Hash string `json:"hash"` // hex sha256
+	Size int64  `json:"size"`
+}
+
+// ChunkStore is a FileGetPutter that splits file payloads into chunks with
+// content-defined chunking, storing each chunk once by its sha256. Payloads
+// that differ in a few places, such as the same library across versions of
+// an image, share most of their chunks.
+//
+// A manifest of the chunks of each payload is stored by the checksum of the
+// payload, so Get works from the same metadata as any other FileGetter. As
+// with a ChecksumStore, chunks and manifests are written to temporary files
+// and renamed in place, so Put is safe to call from many goroutines and
+// processes sharing root.
+type ChunkStore struct {
+	root string
+	opts ChunkOptions
+}
+
+// NewChunkStore returns a ChunkStore rooted at root, creating the directory
+// if needed. The chunk sizes of opts only affect how well payloads Put from
+// now on deduplicate; payloads Put with other sizes can still be Get.
+func NewChunkStore(root string, opts ChunkOptions) (*ChunkStore, error) {
+	if err := os.MkdirAll(filepath.Join(root, storeTempDir), 0o755); err != nil {
+		return nil, err
+	}
+	return &ChunkStore{root: root, opts: opts}, nil
+}
+
+func (cs *ChunkStore) chunkPath(hash string) string {
+	return fanOut(filepath.Join(cs.root, chunkDir), hash)
+}
+
+func (cs *ChunkStore) manifestPath(checksum []byte) string {
+	return fanOut(filepath.Join(cs.root, manifestDir), hex.EncodeToString(checksum))
+}
+
+// Put chunks the payload read from r, storing the chunks not stored yet and
+// the manifest of the payload, and returns its size and checksum.
+func (cs *ChunkStore) Put(_ string, r io.Reader) (int64, []byte, error) {
+	hsh := NewHash()
+	c := newChunker(io.TeeReader(r, hsh), cs.opts)
+	var m chunkManifest
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		sum := sha256.Sum256(chunk)
+		ref := chunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(chunk))}
+		if err := cs.putFile(cs.chunkPath(ref.Hash), chunk, true); err != nil {
+			return 0, nil, err
+		}
+		m.Chunks = append(m.Chunks, ref)
+		m.Size += ref.Size
+	}
+	checksum := hsh.Sum(nil)
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := cs.putFile(cs.manifestPath(checksum), buf, false); err != nil {
+		return 0, nil, err
+	}
+	return m.Size, checksum, nil
+}
+
+// putFile stores b at dst, unless skipExisting and it is stored already.
+func (cs *ChunkStore) putFile(dst string, b []byte, skipExisting bool) error {
+	if skipExisting {
+		if _, err := os.Stat(dst); err == nil {
+			return nil
+		}
+	}
+	tmp, _, _, err := writeTemp(filepath.Join(cs.root, storeTempDir), "put-*", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return publish(tmp, dst)
+}
+
+// Get returns the payload of the FileType entry, by its checksum, streaming
+// the chunks it is made of in turn.
+func (cs *ChunkStore) Get(entry *Entry) (io.ReadCloser, error) {
+	m, err := cs.readManifest(entry.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if m.Size != entry.Size {
+		return nil, fmt.Errorf("chunked payload has size %d but entry expects %d: %w", m.Size, entry.Size, ErrSizeMismatch)
+	}
+	return &chunkReader{cs: cs, chunks: m.Chunks}, nil
+}
+
+func (cs *ChunkStore) readManifest(checksum []byte) (*chunkManifest, error) {
+	buf, err := os.ReadFile(cs.manifestPath(checksum))
+	if err != nil {
+		return nil, err
+	}
+	var m chunkManifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("reading manifest of %x: %w", checksum, err)
+	}
+	return &m, nil
+}
+
+// chunkReader reads the concatenation of chunks, opening one at a time.
+type chunkReader struct {
+	cs     *ChunkStore
+	chunks []chunkRef
+	cur    *os.File
+	left   int64 // bytes left in cur
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for cr.cur == nil {
+		if len(cr.chunks) == 0 {
+			return 0, io.EOF
+		}
+		fh, err := os.Open(cr.cs.chunkPath(cr.chunks[0].Hash))
+		if err != nil {
+			return 0, err
+		}
+		cr.cur, cr.left = fh, cr.chunks[0].Size
+		cr.chunks = cr.chunks[1:]
+	}
+	n, err := cr.cur.Read(p)
+	cr.left -= int64(n)
+	if cr.left < 0 {
+		return n, fmt.Errorf("chunk %s is larger than expected", cr.cur.Name())
+	}
+	if err == io.EOF {
+		name := cr.cur.Name()
+		_ = cr.cur.Close()
+		cr.cur = nil
+		if cr.left != 0 {
+			return n, fmt.Errorf("chunk %s is %d bytes short", name, cr.left)
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.cur == nil {
+		return nil
+	}
+	err := cr.cur.Close()
+	cr.cur = nil
+	return err
+}
+
+// ChunkStats reports what ChunkStore.Stats found.
+type ChunkStats struct {
+	// Payloads and PayloadBytes count the payloads stored, and their size
+	// before deduplication.
+	Payloads     int
+	PayloadBytes int64
+	// Chunks and ChunkBytes count the distinct chunks stored, and their size
+	// on disk.
+	Chunks     int
+	ChunkBytes int64
+}
+
+// DedupRatio is how many times larger the payloads are than the chunks they
+// are stored as, or 0 for an empty store.
+func (s ChunkStats) DedupRatio() float64 {
+	if s.ChunkBytes == 0 {
+		return 0
+	}
+	return float64(s.PayloadBytes) / float64(s.ChunkBytes)
+}
+
+// Stats walks the store, counting its payloads and chunks.
+func (cs *ChunkStore) Stats() (ChunkStats, error) {
+	var stats ChunkStats
+	err := walkFanOut(filepath.Join(cs.root, manifestDir), func(name string, _ fs.FileInfo) error {
+		checksum, err := hex.DecodeString(name)
+		if err != nil {
+			return nil // not a manifest
+		}
+		m, err := cs.readManifest(checksum)
+		if err != nil {
+			return err
+		}
+		stats.Payloads++
+		stats.PayloadBytes += m.Size
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	err = walkFanOut(filepath.Join(cs.root, chunkDir), func(_ string, info fs.FileInfo) error {
+		stats.Chunks++
+		stats.ChunkBytes += info.Size()
+		return nil
+	})
+	return stats, err
+}
+
+// walkFanOut calls fn for every file in the fanned out directories of dir.
+func walkFanOut(dir string, fn func(name string, info fs.FileInfo) error) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil // nothing Put yet
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(d.Name(), info)
+	})
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestChunkStore(t *testing.T) {
+	cs, err := NewChunkStore(t.TempDir(), ChunkOptions{MinSize: 1 << 10, AvgSize: 4 << 10, MaxSize: 16 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(v1)
+	v2 := append([]byte(nil), v1...)
+	copy(v2[100<<10:], "a small change")
+
+	var entries []Entry
+	for _, body := range [][]byte{v1, v2, []byte("tiny"), nil} {
+		n, csum, err := cs.Put("", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(body)) {
+			t.Errorf("expected size %d, got %d", len(body), n)
+		}
+		entries = append(entries, Entry{Type: FileType, Size: n, Payload: csum})
+
+		r, err := cs.Get(&entries[len(entries)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, body) {
+			t.Errorf("payload of %d bytes did not round trip", len(body))
+		}
+	}
+
+	bad := entries[0]
+	bad.Size++
+	if _, err := cs.Get(&bad); err == nil {
+		t.Error("expected a size mismatch error")
+	}
+
+	stats, err := cs.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Payloads != 4 || stats.PayloadBytes != int64(2*len(v1)+4) {
+		t.Errorf("unexpected payload stats %+v", stats)
+	}
+	if ratio := stats.DedupRatio(); ratio < 1.7 {
+		t.Errorf("expected the two versions to share most chunks, got a ratio of %.2f", ratio)
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Codec compresses the payloads of a ChecksumStore. Compressed payloads are
+// stored with the Name of their codec as an extension, so each payload
+// records how to decompress it.
+type Codec struct {
+	// Name identifies the codec, such as "gzip". It must not contain a dot.
+	Name string
+	// NewWriter returns a writer compressing to w. Closing it must flush
+	// all the data, but not close w.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+	// SizeMatches reports whether the n bytes of compressed data at r record
+	// an uncompressed size of size, without decompressing them. It is
+	// optional, for formats that record the size.
+	SizeMatches func(r io.ReaderAt, n, size int64) (bool, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"gzip": {
+			Name: "gzip",
+			NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriter(w), nil
+			},
+			NewReader: func(r io.Reader) (io.ReadCloser, error) {
+				return gzip.NewReader(r)
+			},
+			SizeMatches: gzipSizeMatches,
+		},
+	}
+)
+
+// gzipSizeMatches checks size against the ISIZE of the trailer of gzip data,
+// the uncompressed size modulo 2^32, as the payloads stored are of a single
+// member.
+func gzipSizeMatches(r io.ReaderAt, n, size int64) (bool, error) {
+	if n < 4 {
+		return false, nil
+	}
+	var trailer [4]byte
+	if _, err := r.ReadAt(trailer[:], n-4); err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint32(trailer[:]) == uint32(size), nil
+}
+
+// RegisterCodec makes a codec available to ChecksumStores, such as one for
+// zstd, which is not built in. It panics if a codec of the same name is
+// registered already.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, dup := codecs[c.Name]; dup {
+		panic("storage: RegisterCodec called twice for codec " + c.Name)
+	}
+	codecs[c.Name] = c
+}
+
+// lookupCodec returns the codec registered as name.
+func lookupCodec(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return Codec{}, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+// codecNames returns the names of the codecs registered, sorted.
+func codecNames() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// codecReadCloser closes both the decompressing reader and the file it reads.
+type codecReadCloser struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (crc codecReadCloser) Close() error {
+	err := crc.ReadCloser.Close()
+	if ferr := crc.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// sizeCheckReader fails reads of r that end at any size but size.
+type sizeCheckReader struct {
+	io.ReadCloser
+	size int64
+}
+
+func (scr *sizeCheckReader) Read(p []byte) (int, error) {
+	n, err := scr.ReadCloser.Read(p)
+	scr.size -= int64(n)
+	if scr.size < 0 || (err == io.EOF && scr.size != 0) {
+		return n, fmt.Errorf("payload does not have the size the entry expects: %w", ErrSizeMismatch)
+	}
+	return n, err
+}
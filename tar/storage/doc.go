@@ -7,6 +7,6 @@ an entry marking a file payload.
 
 The raw bytes are stored precisely in the packed (marshalled) Entry, whereas
 the file payload marker include the name of the file, size, and crc64 checksum
-(for basic file integrity).
+(for basic file integrity). Runs of zero bytes are stored as just their size.
 */
 package storage
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"encoding/json"
+	"fmt"
 	"unicode/utf8"
 )
 
@@ -25,8 +27,61 @@ const (
 	//
 	// Its payload is to be marshalled base64 encoded.
 	SegmentType
+	// PaddingType represents a run of Size zero bytes from the archive stream,
+	// such as block padding and the end-of-archive marker. It has no payload.
+	PaddingType
+	// HeaderType represents the raw bytes of a header, as the forked
+	// archive/tar Writer produces them for its Header fields, with Patches
+	// applied. Size is their length, and Payload their crc64 checksum.
+	HeaderType
+	// OptionType records an option the metadata was packed with, such as
+	// InlineThresholdOption, named Name and of value Size. It has no payload,
+	// and nothing of it is assembled.
+	OptionType
 )
 
+// InlineThresholdOption is the OptionType entry of the largest file payload
+// inlined in its FileType entry, leading metadata packed with inlining.
+const InlineThresholdOption = "inline_threshold"
+
+// typeNames are the types marshalled as a string rather than a number. Their
+// entries were added after the original packing format, so unpackers that
+// predate them fail to unmarshal them, rather than skipping them.
+var typeNames = map[Type]string{
+	PaddingType: "padding",
+	HeaderType:  "header",
+	OptionType:  "option",
+}
+
+// MarshalJSON marshals t as a number, or as a string for types that older
+// unpackers do not know about.
+func (t Type) MarshalJSON() ([]byte, error) {
+	if name, ok := typeNames[t]; ok {
+		return json.Marshal(name)
+	}
+	return json.Marshal(int(t))
+}
+
+// UnmarshalJSON unmarshals t from a number, or from the name of a type.
+func (t *Type) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		for typ, n := range typeNames {
+			if n == name {
+				*t = typ
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown entry type %q", name)
+	}
+	var i int
+	if err := json.Unmarshal(data, &i); err != nil {
+		return err
+	}
+	*t = Type(i)
+	return nil
+}
+
 // Entry is the structure for packing and unpacking the information read from
 // the Tar archive.
 //
@@ -35,12 +90,15 @@ const (
 // From http://www.backplane.com/matt/crc64.html, CRC32 has almost 40,000
 // collisions in a sample of 18.2 million, CRC64 had none.
 type Entry struct {
-	Type     Type   `json:"type"`
-	Name     string `json:"name,omitempty"`
-	NameRaw  []byte `json:"name_raw,omitempty"`
-	Size     int64  `json:"size,omitempty"`
-	Payload  []byte `json:"payload"` // SegmentType stores payload here; FileType stores crc64 checksum here;
-	Position int    `json:"position"`
+	Type     Type    `json:"type"`
+	Name     string  `json:"name,omitempty"`
+	NameRaw  []byte  `json:"name_raw,omitempty"`
+	Size     int64   `json:"size,omitempty"`
+	Payload  []byte  `json:"payload"`           // SegmentType stores payload here; FileType and HeaderType store crc64 checksum here;
+	Inline   []byte  `json:"inline,omitempty"`  // FileType may embed its file payload here, rather than in a FileGetter
+	Header   *Header `json:"header,omitempty"`  // HeaderType stores the header fields here
+	Patches  []Patch `json:"patches,omitempty"` // HeaderType stores the differences from the regenerated header here
+	Position int     `json:"position"`
 }
 
 // SetName will check name for valid UTF-8 string, and set the appropriate
@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// execSpoolMemory is the size of payloads an ExecFilePutter spools in memory,
+// to learn their size before sending them. Larger ones are spooled to a
+// temporary file.
+const execSpoolMemory = 1 << 20
+
+// execResponse is the header line of a response of an exec helper.
+type execResponse struct {
+	// Size is the number of payload bytes following the line, for a get.
+	Size int64 `json:"size,omitempty"`
+	// Error fails the request, as not found if NotFound is set.
+	Error    string `json:"error,omitempty"`
+	NotFound bool   `json:"not_found,omitempty"`
+}
+
+// execHelper is a running helper process, speaking the protocol described
+// at ExecFileGetter. Requests are made one at a time, by whoever acquired it,
+// until they release it.
+type execHelper struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+
+	mu   sync.Mutex
+	idle *sync.Cond // signalled once not busy
+	busy bool
+	// err breaks the helper, once a request leaves its streams out of step,
+	// or it is closed.
+	err error
+}
+
+func startExecHelper(cmd *exec.Cmd) (*execHelper, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	h := &execHelper{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}
+	h.idle = sync.NewCond(&h.mu)
+	return h, nil
+}
+
+// acquire waits until h is not busy, and makes it busy, unless it is broken.
+func (h *execHelper) acquire() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for h.busy && h.err == nil {
+		h.idle.Wait()
+	}
+	if h.err != nil {
+		return h.err
+	}
+	h.busy = true
+	return nil
+}
+
+// release makes h available to the next request.
+func (h *execHelper) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.busy = false
+	h.idle.Signal()
+}
+
+// request sends entry, and then body, if any, and reads the header line of the
+// response. The caller must have acquired h.
+func (h *execHelper) request(entry *Entry, body io.Reader) (*execResponse, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.stdin.Write(append(line, '\n')); err != nil {
+		return nil, h.fail(err)
+	}
+	if body != nil {
+		if _, err := io.Copy(h.stdin, body); err != nil {
+			return nil, h.fail(err)
+		}
+	}
+	line, err = h.stdout.ReadBytes('\n')
+	if err != nil {
+		return nil, h.fail(err)
+	}
+	var resp execResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, h.fail(fmt.Errorf("malformed response %q: %w", bytes.TrimSpace(line), err))
+	}
+	if resp.Size < 0 {
+		return nil, h.fail(fmt.Errorf("malformed response %q", bytes.TrimSpace(line)))
+	}
+	return &resp, nil
+}
+
+// fail breaks h with err, unless it is broken already, and returns why it is.
+func (h *execHelper) fail(err error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err == nil {
+		h.err = fmt.Errorf("exec helper %s: %w", h.cmd.Path, err)
+	}
+	return h.err
+}
+
+// broken returns why h is broken, if it is.
+func (h *execHelper) broken() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// close ends the input of the helper, and waits for it to exit. A request in
+// progress, such as a payload not closed yet, is cut short, killing the
+// helper, as its response will not be read.
+func (h *execHelper) close() error {
+	h.mu.Lock()
+	busy := h.busy
+	if h.err == nil {
+		h.err = errors.New("exec helper is closed")
+	}
+	h.idle.Broadcast()
+	h.mu.Unlock()
+
+	err := h.stdin.Close()
+	if busy {
+		_ = h.cmd.Process.Kill()
+		_ = h.cmd.Wait()
+		return err
+	}
+	if werr := h.cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// ExecFileGetter is a FileGetter of payloads from a long-running helper
+// process, such as one written in another language for a backend this package
+// does not support.
+//
+// For each payload, the helper reads one line from its stdin: the JSON of the
+// Entry, as NewJSONPacker marshals it. It replies on its stdout with one line
+// of JSON, either {"size": N} followed by the N bytes of the payload, or
+// {"error": "message"}, with "not_found": true if it does not have the
+// payload. The helper exits once its stdin is closed.
+//
+// The helper is asked for one payload at a time, so Get waits until the
+// payload it last returned is closed. A goroutine must therefore close each
+// payload before its next Get, or the Get waits forever; other goroutines
+// may Get at the same time. Close does not wait for payloads to be closed.
+type ExecFileGetter struct {
+	h *execHelper
+}
+
+// NewExecFileGetter starts cmd, which must not be started yet, as the helper
+// of an ExecFileGetter. Its stdin and stdout must not be set; its stderr is
+// left as it is.
+func NewExecFileGetter(cmd *exec.Cmd) (*ExecFileGetter, error) {
+	h, err := startExecHelper(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &ExecFileGetter{h: h}, nil
+}
+
+// Get asks the helper for the payload of entry.
+func (efg *ExecFileGetter) Get(entry *Entry) (io.ReadCloser, error) {
+	if err := efg.h.acquire(); err != nil {
+		return nil, err
+	}
+	resp, err := efg.h.request(entry, nil)
+	if err != nil {
+		efg.h.release()
+		return nil, err
+	}
+	if resp.Error != "" {
+		efg.h.release()
+		if resp.NotFound {
+			return nil, fmt.Errorf("%q: %s: %w", entry.GetName(), resp.Error, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("%q: %s", entry.GetName(), resp.Error)
+	}
+	ep := &execPayload{h: efg.h, remaining: resp.Size}
+	if resp.Size != entry.Size {
+		err := fmt.Errorf("%q has size %d but entry expects %d: %w", entry.GetName(), resp.Size, entry.Size, ErrSizeMismatch)
+		if cerr := ep.Close(); cerr != nil {
+			return nil, cerr
+		}
+		return nil, err
+	}
+	return ep, nil
+}
+
+// Close closes the stdin of the helper, and waits for it to exit. A payload
+// not closed yet can no longer be read.
+func (efg *ExecFileGetter) Close() error {
+	return efg.h.close()
+}
+
+// execPayload is the payload of a response of an exec helper, holding the
+// helper until it is closed.
+type execPayload struct {
+	h         *execHelper
+	remaining int64
+	once      sync.Once
+	err       error
+}
+
+func (ep *execPayload) Read(p []byte) (int, error) {
+	if ep.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > ep.remaining {
+		p = p[:ep.remaining]
+	}
+	n, err := ep.h.stdout.Read(p)
+	ep.remaining -= int64(n)
+	if err == io.EOF {
+		err = ep.h.fail(io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// Close skips what is left unread of the payload, and releases the helper.
+func (ep *execPayload) Close() error {
+	ep.once.Do(func() {
+		if ep.remaining > 0 && ep.h.broken() == nil {
+			if _, err := io.CopyN(io.Discard, ep.h.stdout, ep.remaining); err != nil {
+				ep.err = ep.h.fail(err)
+			}
+		}
+		ep.h.release()
+	})
+	return ep.err
+}
+
+// ExecFilePutter is a FilePutter of payloads to a long-running helper
+// process, speaking the protocol of ExecFileGetter.
+//
+// For each payload, the helper reads one line from its stdin: the JSON of a
+// FileType Entry with the name, size and checksum of the payload, followed by
+// that many bytes of payload. It replies on its stdout with one line of JSON,
+// {} once stored, or {"error": "message"}.
+type ExecFilePutter struct {
+	h *execHelper
+}
+
+// NewExecFilePutter starts cmd, which must not be started yet, as the helper
+// of an ExecFilePutter. Its stdin and stdout must not be set; its stderr is
+// left as it is.
+func NewExecFilePutter(cmd *exec.Cmd) (*ExecFilePutter, error) {
+	h, err := startExecHelper(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &ExecFilePutter{h: h}, nil
+}
+
+// Put reads the payload of r, to learn its size and checksum, and then sends
+// it to the helper.
+func (efp *ExecFilePutter) Put(name string, r io.Reader) (int64, []byte, error) {
+	hsh := NewHash()
+	buf := bytes.NewBuffer(nil)
+	n, err := io.Copy(io.MultiWriter(buf, hsh), io.LimitReader(r, execSpoolMemory+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	var body io.Reader = buf
+	if n > execSpoolMemory {
+		tmp, err := os.CreateTemp("", "tar-split-exec-")
+		if err != nil {
+			return 0, nil, err
+		}
+		spool := tempFile{tmp}
+		defer func() { _ = spool.Close() }()
+		if _, err := tmp.Write(buf.Bytes()); err != nil {
+			return 0, nil, err
+		}
+		rest, err := io.Copy(io.MultiWriter(tmp, hsh), r)
+		if err != nil {
+			return 0, nil, err
+		}
+		n += rest
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return 0, nil, err
+		}
+		body = tmp
+	}
+
+	entry := &Entry{Type: FileType, Size: n, Payload: hsh.Sum(nil)}
+	entry.SetName(name)
+	if err := efp.h.acquire(); err != nil {
+		return 0, nil, err
+	}
+	defer efp.h.release()
+	resp, err := efp.h.request(entry, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.Error != "" {
+		return 0, nil, fmt.Errorf("%q: %s", name, resp.Error)
+	}
+	return entry.Size, entry.Payload, nil
+}
+
+// Close closes the stdin of the helper, and waits for it to exit.
+func (efp *ExecFilePutter) Close() error {
+	return efp.h.close()
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestExecHelperProcess is not a test, but the helper process of the exec
+// tests, storing payloads by hex checksum in $EXEC_HELPER_DIR.
+func TestExecHelperProcess(t *testing.T) {
+	dir := os.Getenv("EXEC_HELPER_DIR")
+	if dir == "" {
+		t.Skip("run as a helper process only")
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		line, err := in.ReadBytes('\n')
+		if err == io.EOF {
+			os.Exit(0)
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			os.Exit(1)
+		}
+		path := filepath.Join(dir, hex.EncodeToString(entry.Payload))
+		if os.Getenv("EXEC_HELPER_PUT") != "" {
+			body := make([]byte, entry.Size)
+			if _, err := io.ReadFull(in, body); err != nil {
+				os.Exit(1)
+			}
+			if entry.GetName() == "refused" {
+				fmt.Println(`{"error": "refused"}`)
+				continue
+			}
+			if err := os.WriteFile(path, body, 0o644); err != nil {
+				os.Exit(1)
+			}
+			fmt.Println(`{}`)
+			continue
+		}
+		body, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Println(`{"error": "no such payload", "not_found": true}`)
+			continue
+		}
+		fmt.Printf("{\"size\": %d}\n", len(body))
+		os.Stdout.Write(body)
+	}
+}
+
+func execHelperCommand(dir string, put bool) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExecHelperProcess$")
+	cmd.Env = append(os.Environ(), "EXEC_HELPER_DIR="+dir)
+	if put {
+		cmd.Env = append(cmd.Env, "EXEC_HELPER_PUT=1")
+	}
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func TestExecFileGetPutter(t *testing.T) {
+	dir := t.TempDir()
+	efp, err := NewExecFilePutter(execHelperCommand(dir, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"small": []byte("foo"),
+		"empty": nil,
+		"large": bytes.Repeat([]byte("0123456789abcdef"), execSpoolMemory/8),
+	}
+	entries := map[string]*Entry{}
+	for name, body := range files {
+		n, csum, err := efp.Put(name, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(body)) {
+			t.Errorf("%s: expected size %d, got %d", name, len(body), n)
+		}
+		entries[name] = &Entry{Type: FileType, Name: name, Size: n, Payload: csum}
+	}
+	if _, _, err := efp.Put("refused", bytes.NewReader([]byte("bar"))); err == nil {
+		t.Error("expected the error of the helper")
+	}
+	if err := efp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	efg, err := NewExecFileGetter(execHelperCommand(dir, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := efg.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	for name, body := range files {
+		r, err := efg.Get(entries[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, body) {
+			t.Errorf("%s: payload differs", name)
+		}
+	}
+
+	// a payload closed unread leaves the helper ready for the next
+	r, err := efg.Get(entries["large"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wrongSize := *entries["small"]
+	wrongSize.Size++
+	if _, err := efg.Get(&wrongSize); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("expected %v, got %v", ErrSizeMismatch, err)
+	}
+	if _, err := efg.Get(&Entry{Type: FileType, Name: "missing", Payload: []byte{1}}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected %v, got %v", fs.ErrNotExist, err)
+	}
+	r, err = efg.Get(entries["small"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+
+	// closed with a payload left open, rather than waiting for it
+	open, err := NewExecFileGetter(execHelperCommand(dir, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = open.Get(entries["large"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := open.Close(); err != nil {
+		t.Error(err)
+	}
+	_ = r.Close()
+	if _, err := open.Get(entries["small"]); err == nil {
+		t.Error("expected an error getting from a closed helper")
+	}
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ChecksumSet is a set of payload checksums.
+type ChecksumSet map[string]struct{}
+
+// Add adds checksum to the set.
+func (s ChecksumSet) Add(checksum []byte) {
+	s[string(checksum)] = struct{}{}
+}
+
+// Has reports whether checksum is in the set.
+func (s ChecksumSet) Has(checksum []byte) bool {
+	_, ok := s[string(checksum)]
+	return ok
+}
+
+// AddEntries adds the checksums of the payloads referenced by the entries
+// read from up, until io.EOF. Payloads that are empty or inlined in their
+// entry are not stored, so are not referenced.
+func (s ChecksumSet) AddEntries(up Unpacker) error {
+	for {
+		entry, err := up.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Type == FileType && entry.Size > 0 && len(entry.Inline) == 0 {
+			s.Add(entry.Payload)
+		}
+	}
+}
+
+// Walk calls fn for every payload in the store, in either layout, with its
+// checksum, path and file info. Compressed payloads are reported with the
+// size they take on disk. Temporary files are skipped.
+func (cs *ChecksumStore) Walk(fn func(checksum []byte, path string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(cs.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == cs.root {
+				return nil
+			}
+			if filepath.Dir(path) != cs.root || d.Name() == storeTempDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name, ext, compressed := strings.Cut(d.Name(), ".")
+		if compressed {
+			if _, err := lookupCodec(ext); err != nil {
+				return nil // not a payload
+			}
+		}
+		checksum, err := hex.DecodeString(name)
+		if err != nil {
+			return nil // not a payload
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil // removed in the meantime
+		}
+		if err != nil {
+			return err
+		}
+		return fn(checksum, path, info)
+	})
+}
+
+// GCOptions tunes ChecksumStore.GC.
+type GCOptions struct {
+	// DryRun only reports what would be removed.
+	DryRun bool
+
+	// MinAge spares unreferenced payloads stored more recently, such as
+	// those of a disassembly still in progress.
+	MinAge time.Duration
+}
+
+// GCStats reports what ChecksumStore.GC found.
+type GCStats struct {
+	Kept         int
+	Removed      int
+	RemovedBytes int64
+}
+
+// GC removes the payloads of the store that are not in referenced, which is
+// typically gathered with ChecksumSet.AddEntries from the metadata of every
+// archive stored. Payloads of metadata missing from referenced are lost, so
+// include those of disassemblies in progress, or spare them with MinAge.
+//
+// GC stops with the error of ctx once it is done, having removed some of the
+// payloads, as reported in the stats returned.
+func (cs *ChecksumStore) GC(ctx context.Context, referenced ChecksumSet, opts GCOptions) (GCStats, error) {
+	var stats GCStats
+	now := time.Now()
+	err := cs.Walk(func(checksum []byte, path string, info fs.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if referenced.Has(checksum) || now.Sub(info.ModTime()) < opts.MinAge {
+			stats.Kept++
+			return nil
+		}
+		if !opts.DryRun {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		stats.Removed++
+		stats.RemovedBytes += info.Size()
+		return nil
+	})
+	return stats, err
+}
+
+// ScrubStats reports what ChecksumStore.Scrub found.
+type ScrubStats struct {
+	Checked int
+	// Corrupt are the paths of payloads whose content no longer matches the
+	// checksum they are stored by.
+	Corrupt []string
+}
+
+// Scrub rehashes every payload of the store, reporting those whose content
+// no longer matches their checksum, or that can not be read or decompressed.
+// Corrupt payloads are left in place. Scrub stops with the error of ctx once
+// it is done.
+func (cs *ChecksumStore) Scrub(ctx context.Context) (ScrubStats, error) {
+	var stats ScrubStats
+	buf := make([]byte, 32*1024)
+	err := cs.Walk(func(checksum []byte, path string, _ fs.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hsh := NewHash()
+		fh, err := openPayload(path)
+		if os.IsNotExist(err) {
+			return nil // removed in the meantime
+		}
+		if err == nil {
+			_, err = io.CopyBuffer(hsh, fh, buf)
+			_ = fh.Close()
+		}
+		stats.Checked++
+		if err != nil || string(hsh.Sum(nil)) != string(checksum) {
+			stats.Corrupt = append(stats.Corrupt, path)
+		}
+		return nil
+	})
+	return stats, err
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChecksumStoreGC(t *testing.T) {
+	cs, err := NewChecksumStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata of an archive, referencing half of the payloads
+	meta := bytes.NewBuffer(nil)
+	jp := NewJSONPacker(meta)
+	var unreferenced [][]byte
+	for i := 0; i < 10; i++ {
+		body := fmt.Sprintf("payload %d", i)
+		n, csum, err := cs.Put(body, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 1 {
+			unreferenced = append(unreferenced, csum)
+			continue
+		}
+		e := Entry{Type: FileType, Size: n, Payload: csum}
+		e.SetName(body)
+		if _, err := jp.AddEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	referenced := ChecksumSet{}
+	if err := referenced.AddEntries(NewJSONUnpacker(meta)); err != nil {
+		t.Fatal(err)
+	}
+	if len(referenced) != 5 {
+		t.Fatalf("expected 5 referenced payloads, got %d", len(referenced))
+	}
+
+	// a cancelled collection removes nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cs.GC(ctx, referenced, GCOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	for _, csum := range unreferenced {
+		if _, err := os.Stat(cs.Path(csum)); err != nil {
+			t.Errorf("expected a cancelled collection to keep %x: %v", csum, err)
+		}
+	}
+
+	// recent payloads are spared
+	stats, err := cs.GC(context.Background(), referenced, GCOptions{MinAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Kept != 10 || stats.Removed != 0 {
+		t.Errorf("expected all payloads kept, got %+v", stats)
+	}
+
+	stats, err = cs.GC(context.Background(), referenced, GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Kept != 5 || stats.Removed != 5 || stats.RemovedBytes != 5*int64(len("payload 0")) {
+		t.Errorf("unexpected dry run %+v", stats)
+	}
+	for _, csum := range unreferenced {
+		if _, err := os.Stat(cs.Path(csum)); err != nil {
+			t.Errorf("expected dry run to keep %x: %v", csum, err)
+		}
+	}
+
+	if _, err := cs.GC(context.Background(), referenced, GCOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, csum := range unreferenced {
+		if _, err := os.Stat(cs.Path(csum)); !os.IsNotExist(err) {
+			t.Errorf("expected %x to be removed", csum)
+		}
+	}
+	for csum := range referenced {
+		if _, err := os.Stat(cs.Path([]byte(csum))); err != nil {
+			t.Errorf("expected %x to be kept: %v", csum, err)
+		}
+	}
+}
+
+func TestChecksumStoreScrub(t *testing.T) {
+	root := t.TempDir()
+	cs, err := NewChecksumStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corrupt string
+	for i := 0; i < 4; i++ {
+		body := fmt.Sprintf("payload %d", i)
+		_, csum, err := cs.Put(body, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupt = cs.Path(csum)
+	}
+	// and one left in the flat layout
+	if _, _, err := NewChecksumFileGetter(root).Put("flat", bytes.NewBufferString("flat")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(corrupt, []byte("bit rot"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := cs.Scrub(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Checked != 5 {
+		t.Errorf("expected 5 payloads checked, got %d", stats.Checked)
+	}
+	if len(stats.Corrupt) != 1 || stats.Corrupt[0] != corrupt {
+		t.Errorf("expected %s to be corrupt, got %v", filepath.Base(corrupt), stats.Corrupt)
+	}
+}
+
+func TestChecksumStoreGCStoredAgain(t *testing.T) {
+	cs, err := NewChecksumStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.CreateTemp(t.TempDir(), "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString("payload"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a payload stored long ago, and again by a disassembly in progress, is
+	// as recent as if stored only now
+	for _, put := range []func() ([]byte, error){
+		func() ([]byte, error) {
+			_, csum, err := cs.Put("payload", bytes.NewBufferString("payload"))
+			return csum, err
+		},
+		func() ([]byte, error) {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			_, csum, err := cs.PutFile("payload", f, int64(len("payload")))
+			return csum, err
+		},
+	} {
+		csum, err := put()
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-48 * time.Hour)
+		if err := os.Chtimes(cs.Path(csum), old, old); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := put(); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := cs.GC(context.Background(), ChecksumSet{}, GCOptions{MinAge: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Kept != 1 || stats.Removed != 0 {
+			t.Errorf("expected the payload stored again kept, got %+v", stats)
+		}
+	}
+}
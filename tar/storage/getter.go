@@ -6,10 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
+// ErrSizeMismatch occurs when the payload a FileGetter has for an Entry is not
+// of the size the Entry expects.
+var ErrSizeMismatch = errors.New("payload size mismatch")
+
 // FileGetter is the interface for getting a stream of a file payload,
 // addressed by Entry. Presumably, the names will be scoped to relative
 // file paths.
@@ -26,6 +33,15 @@ type FilePutter interface {
 	Put(filename string, input io.Reader) (size int64, checksum []byte, err error)
 }
 
+// FileCopyPutter is a FilePutter that can also store a payload straight out of
+// a regular file, such as the tar archive being disassembled, without reading
+// it through a buffer.
+type FileCopyPutter interface {
+	FilePutter
+	// PutFile is Put, with the payload being the next size bytes of src.
+	PutFile(filename string, src *os.File, size int64) (int64, []byte, error)
+}
+
 // FileGetPutter is the interface that groups both Getting and Putting file
 // payloads.
 type FileGetPutter interface {
@@ -47,6 +63,35 @@ func (pfg pathFileGetter) Get(entry *Entry) (io.ReadCloser, error) {
 	return os.Open(filepath.Join(pfg.root, entry.GetName()))
 }
 
+// NewFSFileGetter returns a FileGetter that is for files by their name in
+// fsys, such as an embed.FS, a zip.Reader or a fstest.MapFS. Leading "/" and
+// "./" are trimmed from names, as fs.FS requires.
+func NewFSFileGetter(fsys fs.FS) FileGetter {
+	return fsFileGetter{fsys: fsys}
+}
+
+type fsFileGetter struct {
+	fsys fs.FS
+}
+
+func (ffg fsFileGetter) Get(entry *Entry) (io.ReadCloser, error) {
+	name := strings.TrimPrefix(path.Clean("/"+entry.GetName()), "/")
+	file, err := ffg.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if entry.Size != stat.Size() {
+		_ = file.Close()
+		return nil, fmt.Errorf("%q has size %d but entry expects %d: %w", name, stat.Size(), entry.Size, ErrSizeMismatch)
+	}
+	return file, nil
+}
+
 type bufferFileGetPutter struct {
 	files map[string][]byte
 }
@@ -54,7 +99,7 @@ type bufferFileGetPutter struct {
 func (bfgp *bufferFileGetPutter) Get(entry *Entry) (io.ReadCloser, error) {
 	name := entry.GetName()
 	if _, ok := bfgp.files[name]; !ok {
-		return nil, errors.New("no such file")
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
 	}
 	b := bytes.NewBuffer(bfgp.files[name])
 	return io.NopCloser(b), nil
@@ -86,7 +131,13 @@ type checksumFileGetPutter struct {
 	root string
 }
 
+// checksumTempPrefix prefixes the temporary files of checksumFileGetPutter.
+const checksumTempPrefix = "checksumFileGetPutter-"
+
 // NewChecksumFileGetter returns a FileGetter that is for files stored by crc64 checksum.
+//
+// The files are stored flat in relpath. For many files, use a ChecksumStore,
+// which can migrate such a directory.
 func NewChecksumFileGetter(relpath string) FileGetPutter {
 	return &checksumFileGetPutter{root: relpath}
 }
@@ -101,35 +152,26 @@ func (cfg checksumFileGetPutter) Get(entry *Entry) (io.ReadCloser, error) {
 	}
 	stat, err := file.Stat()
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
 	if entry.Size != stat.Size() {
-		return nil, fmt.Errorf("checksum-addressed file has size %d but entry expects %d", stat.Size(), entry.Size)
+		_ = file.Close()
+		return nil, fmt.Errorf("checksum-addressed file has size %d but entry expects %d: %w", stat.Size(), entry.Size, ErrSizeMismatch)
 	}
 	return file, nil
 }
 
 func (cfg checksumFileGetPutter) Put(_ string, r io.Reader) (int64, []byte, error) {
-	tmp, err := os.CreateTemp(cfg.root, "checksumFileGetPutter-*")
+	tmp, i, checksum, err := writeTemp(cfg.root, checksumTempPrefix+"*", r)
 	if err != nil {
 		return 0, nil, err
 	}
-	i, checksum, err := copyWithChecksum(tmp, r)
-	if err != nil {
+	// replacing an existing file of the same checksum is harmless, and
+	// avoids racing another Put of it
+	if err := publish(tmp, filepath.Join(cfg.root, hex.EncodeToString(checksum))); err != nil {
 		return 0, nil, err
 	}
-	checksumPath := filepath.Join(cfg.root, hex.EncodeToString(checksum))
-	if _, err := os.Stat(checksumPath); os.IsNotExist(err) {
-		// checksum-addressed file does not yet exist
-		if err := os.Rename(tmp.Name(), checksumPath); err != nil {
-			return 0, nil, err
-		}
-	} else {
-		// checksum-addressed file already exists
-		if err := os.Remove(tmp.Name()); err != nil {
-			return 0, nil, err
-		}
-	}
 	return i, checksum, nil
 }
 
@@ -151,9 +193,12 @@ func (bbfp *bitBucketFilePutter) Put(name string, r io.Reader) (int64, []byte, e
 func copyWithChecksum(w io.WriteCloser, r io.Reader) (int64, []byte, error) {
 	hsh := NewHash()
 	cw := io.MultiWriter(hsh, w)
-	defer func() { _ = w.Close() }()
 	i, err := io.Copy(cw, r)
 	if err != nil {
+		_ = w.Close()
+		return 0, nil, err
+	}
+	if err := w.Close(); err != nil {
 		return 0, nil, err
 	}
 	return i, hsh.Sum(nil), nil
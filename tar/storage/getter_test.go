@@ -2,10 +2,13 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestGetter(t *testing.T) {
@@ -50,6 +53,7 @@ func TestChecksumGetPutter(t *testing.T) {
 		{
 			Entry: Entry{
 				Type:    FileType,
+				Size:    3,
 				Name:    "file1.txt",
 				Payload: []byte{60, 60, 48, 48, 0, 0, 0, 0},
 			},
@@ -58,6 +62,7 @@ func TestChecksumGetPutter(t *testing.T) {
 		{
 			Entry: Entry{
 				Type:    FileType,
+				Size:    3,
 				Name:    "file2.txt",
 				Payload: []byte{45, 196, 22, 240, 0, 0, 0, 0},
 			},
@@ -66,6 +71,7 @@ func TestChecksumGetPutter(t *testing.T) {
 		{
 			Entry: Entry{
 				Type:    FileType,
+				Size:    3,
 				Name:    "file3.txt",
 				Payload: []byte{32, 68, 22, 240, 0, 0, 0, 0},
 			},
@@ -74,6 +80,7 @@ func TestChecksumGetPutter(t *testing.T) {
 		{
 			Entry: Entry{
 				Type:    FileType,
+				Size:    3,
 				Name:    "file4.txt",
 				Payload: []byte{48, 9, 150, 240, 0, 0, 0, 0},
 			},
@@ -129,3 +136,29 @@ func BenchmarkPutter(b *testing.B) {
 		}
 	}
 }
+
+func TestFSFileGetter(t *testing.T) {
+	fg := NewFSFileGetter(fstest.MapFS{
+		"dir/file.txt": {Data: []byte("foo")},
+	})
+	for _, name := range []string{"dir/file.txt", "./dir/file.txt", "/dir/file.txt"} {
+		r, err := fg.Get(&Entry{Type: FileType, Name: name, Size: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "foo" {
+			t.Errorf("%s: expected %q, got %q", name, "foo", out)
+		}
+	}
+	if _, err := fg.Get(&Entry{Type: FileType, Name: "dir/file.txt", Size: 4}); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("expected %v, got %v", ErrSizeMismatch, err)
+	}
+	if _, err := fg.Get(&Entry{Type: FileType, Name: "missing", Size: 3}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected %v, got %v", fs.ErrNotExist, err)
+	}
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"time"
+)
+
+// Header holds the fields of a tar header, as stored in a HeaderType entry.
+// It mirrors the Header of the forked archive/tar, which the raw header bytes
+// are regenerated with.
+type Header struct {
+	Typeflag   byte              `json:"typeflag"`
+	Name       string            `json:"name,omitempty"`
+	Linkname   string            `json:"linkname,omitempty"`
+	Size       int64             `json:"size,omitempty"`
+	Mode       int64             `json:"mode,omitempty"`
+	Uid        int               `json:"uid,omitempty"`
+	Gid        int               `json:"gid,omitempty"`
+	Uname      string            `json:"uname,omitempty"`
+	Gname      string            `json:"gname,omitempty"`
+	ModTime    time.Time         `json:"mtime"`
+	AccessTime *time.Time        `json:"atime,omitempty"`
+	ChangeTime *time.Time        `json:"ctime,omitempty"`
+	Devmajor   int64             `json:"devmajor,omitempty"`
+	Devminor   int64             `json:"devminor,omitempty"`
+	PAXRecords map[string]string `json:"pax,omitempty"`
+	Format     int               `json:"format,omitempty"`
+}
+
+// Patch replaces the bytes at Offset with Data.
+type Patch struct {
+	Offset int    `json:"offset"`
+	Data   []byte `json:"data"`
+}
+
+// ApplyPatches applies patches to b in place. It returns false if any patch
+// falls outside of b.
+func ApplyPatches(b []byte, patches []Patch) bool {
+	for _, p := range patches {
+		if p.Offset < 0 || p.Offset > len(b) || len(p.Data) > len(b)-p.Offset {
+			return false
+		}
+		copy(b[p.Offset:], p.Data)
+	}
+	return true
+}
+
+// maxPatchGap is the longest run of matching bytes that DiffPatches folds
+// into the surrounding patches, rather than starting a new one.
+const maxPatchGap = 16
+
+// DiffPatches returns the patches turning from into to, which are of the same
+// length.
+func DiffPatches(from, to []byte) []Patch {
+	var patches []Patch
+	for i := 0; i < len(to); i++ {
+		if from[i] == to[i] {
+			continue
+		}
+		end := i + 1
+		for j := end; j < len(to) && j-end < maxPatchGap; j++ {
+			if from[j] != to[j] {
+				end = j + 1
+			}
+		}
+		patches = append(patches, Patch{Offset: i, Data: to[i:end]})
+		i = end - 1
+	}
+	return patches
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDiffPatches(t *testing.T) {
+	vectors := []struct {
+		from, to string
+		patches  int
+	}{
+		{"", "", 0},
+		{"same bytes", "same bytes", 0},
+		{"0123456789", "0x23456789", 1},
+		{"0123456789", "x12345678x", 1}, // a short gap is folded into one patch
+		{"0123456789abcdefghijklmnopqrstuvwxyz", "x123456789abcdefghijklmnopqrstuvwxyX", 2},
+	}
+	for i, v := range vectors {
+		patches := DiffPatches([]byte(v.from), []byte(v.to))
+		if len(patches) != v.patches {
+			t.Errorf("test %d: expected %d patches, got %d: %+v", i, v.patches, len(patches), patches)
+		}
+		b := []byte(v.from)
+		if !ApplyPatches(b, patches) {
+			t.Errorf("test %d: patches out of range", i)
+		}
+		if !bytes.Equal(b, []byte(v.to)) {
+			t.Errorf("test %d: expected %q, got %q", i, v.to, b)
+		}
+	}
+
+	for _, p := range []Patch{
+		{Offset: -1, Data: []byte("x")},
+		{Offset: 3, Data: []byte("xx")},
+		{Offset: 5, Data: []byte("x")},
+	} {
+		if ApplyPatches(make([]byte, 4), []Patch{p}) {
+			t.Errorf("expected patch %+v to be out of range", p)
+		}
+	}
+}
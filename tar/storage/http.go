@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPOptions tune a FileGetter of NewHTTPFileGetterWithOptions.
+type HTTPOptions struct {
+	// Client makes the requests. It defaults to http.DefaultClient.
+	Client *http.Client
+	// Retries is how many times a request is retried after a network error,
+	// a 5xx status or a 429 status, backing off exponentially. It defaults to
+	// 3, and is none if negative.
+	Retries int
+	// MaxConcurrent bounds the payloads fetched at once, from Get until the
+	// payload is closed. It defaults to 4.
+	MaxConcurrent int
+	// ByName fetches payloads by their name rather than their checksum, such
+	// as from a static file server of an extracted tree.
+	ByName bool
+}
+
+// httpBackoff is the wait before the first retry of an httpFileGetter, doubled
+// for each further retry.
+const httpBackoff = 100 * time.Millisecond
+
+// NewHTTPFileGetter returns a FileGetter for payloads at baseURL, by their hex
+// checksum, such as those of a "tar-split serve" at baseURL "/payloads".
+func NewHTTPFileGetter(baseURL string) FileGetter {
+	return NewHTTPFileGetterWithOptions(baseURL, HTTPOptions{})
+}
+
+// NewHTTPFileGetterWithOptions is NewHTTPFileGetter, tuned by opts.
+//
+// A payload the server does not have, with status 404, is an error wrapping
+// fs.ErrNotExist, so that a ChainFileGetter falls through to its next source.
+func NewHTTPFileGetterWithOptions(baseURL string, opts HTTPOptions) FileGetter {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.MaxConcurrent <= 0 {
+		opts.MaxConcurrent = 4
+	}
+	return &httpFileGetter{
+		base:    strings.TrimSuffix(baseURL, "/"),
+		opts:    opts,
+		sem:     make(chan struct{}, opts.MaxConcurrent),
+		backoff: httpBackoff,
+	}
+}
+
+type httpFileGetter struct {
+	base    string
+	opts    HTTPOptions
+	sem     chan struct{}
+	backoff time.Duration
+}
+
+func (hfg *httpFileGetter) Get(entry *Entry) (io.ReadCloser, error) {
+	var u string
+	if hfg.opts.ByName {
+		u = hfg.base + (&url.URL{Path: path.Clean("/" + entry.GetName())}).EscapedPath()
+	} else {
+		u = hfg.base + "/" + hex.EncodeToString(entry.Payload)
+	}
+
+	hfg.sem <- struct{}{}
+	resp, err := hfg.get(u)
+	if err != nil {
+		<-hfg.sem
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		_ = resp.Body.Close()
+		<-hfg.sem
+		return nil, fmt.Errorf("%s: %w", u, fs.ErrNotExist)
+	case resp.StatusCode != http.StatusOK:
+		_ = resp.Body.Close()
+		<-hfg.sem
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	case resp.ContentLength >= 0 && resp.ContentLength != entry.Size:
+		_ = resp.Body.Close()
+		<-hfg.sem
+		return nil, fmt.Errorf("%s has size %d but entry expects %d: %w", u, resp.ContentLength, entry.Size, ErrSizeMismatch)
+	}
+	return &httpBody{
+		ReadCloser: &sizeCheckReader{ReadCloser: resp.Body, size: entry.Size},
+		release:    func() { <-hfg.sem },
+	}, nil
+}
+
+// get requests u, retrying failures that may be transient. The response
+// returned may have any status but those retried, as may be the last.
+func (hfg *httpFileGetter) get(u string) (*http.Response, error) {
+	wait := hfg.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := hfg.opts.Client.Get(u)
+		if attempt >= hfg.opts.Retries {
+			return resp, err
+		}
+		if err == nil {
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				return resp, nil
+			}
+			_ = resp.Body.Close()
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// httpBody releases its slot of the httpFileGetter once closed.
+type httpBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (hb *httpBody) Close() error {
+	err := hb.ReadCloser.Close()
+	hb.once.Do(hb.release)
+	return err
+}
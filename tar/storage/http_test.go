@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPFileGetter(t *testing.T) {
+	body := []byte("payload served over http")
+	hsh := NewHash()
+	hsh.Write(body)
+	csum := hsh.Sum(nil)
+	entry := &Entry{Type: FileType, Name: "./dir/a file", Size: int64(len(body)), Payload: csum}
+
+	var (
+		mu       sync.Mutex
+		failures = 2
+		paths    []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		fail := failures > 0
+		failures--
+		mu.Unlock()
+		switch {
+		case fail:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/payloads/"+hex.EncodeToString(csum), r.URL.Path == "/tree/dir/a file":
+			_, _ = w.Write(body)
+		case r.URL.Path == "/short/"+hex.EncodeToString(csum):
+			_, _ = w.Write(body[1:])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	get := func(fg FileGetter) ([]byte, error) {
+		fg.(*httpFileGetter).backoff = 0
+		r, err := fg.Get(entry)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	out, err := get(NewHTTPFileGetter(srv.URL + "/payloads/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, body) {
+		t.Errorf("expected %q, got %q", body, out)
+	}
+	if len(paths) != 3 {
+		t.Errorf("expected 2 retries, got requests %q", paths)
+	}
+
+	out, err = get(NewHTTPFileGetterWithOptions(srv.URL+"/tree", HTTPOptions{ByName: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, body) {
+		t.Errorf("expected %q, got %q", body, out)
+	}
+
+	if _, err := get(NewHTTPFileGetter(srv.URL + "/missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected %v, got %v", fs.ErrNotExist, err)
+	}
+	if _, err := get(NewHTTPFileGetter(srv.URL + "/short")); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("expected %v, got %v", ErrSizeMismatch, err)
+	}
+
+	mu.Lock()
+	failures = 10
+	mu.Unlock()
+	if _, err := get(NewHTTPFileGetterWithOptions(srv.URL+"/payloads", HTTPOptions{Retries: -1})); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected the 503 without retrying, got %v", err)
+	}
+}
+
+func TestHTTPFileGetterConcurrency(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("x"))
+	}))
+	defer srv.Close()
+
+	entry := &Entry{Type: FileType, Size: 1, Payload: []byte{1}}
+	fg := NewHTTPFileGetterWithOptions(srv.URL, HTTPOptions{MaxConcurrent: 2})
+	var open []io.ReadCloser
+	for i := 0; i < 2; i++ {
+		r, err := fg.Get(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		open = append(open, r)
+	}
+
+	done := make(chan error)
+	go func() {
+		r, err := fg.Get(entry)
+		if err == nil {
+			err = r.Close()
+		}
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected Get to wait while 2 payloads are open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := open[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	// closing twice does not free another slot
+	_ = open[0].Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fg.(*httpFileGetter).sem); n != 1 {
+		t.Errorf("expected 1 slot still held, got %d", n)
+	}
+	_ = open[1].Close()
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrEntryTooLarge occurs when a packed Entry exceeds the size allowed
+	// to an Unpacker.
+	ErrEntryTooLarge = errors.New("packed entry exceeds size limit")
+
+	// ErrRatioTooLarge occurs when a compressed stream expands by more than
+	// the ratio allowed to its reader.
+	ErrRatioTooLarge = errors.New("decompression ratio exceeds limit")
+)
+
+// NewJSONUnpackerWithLimit is NewJSONUnpacker, failing with ErrEntryTooLarge
+// on any line of r longer than maxEntrySize bytes, rather than buffering it to
+// decode. A maxEntrySize of zero is no limit.
+func NewJSONUnpackerWithLimit(r io.Reader, maxEntrySize int64) Unpacker {
+	if maxEntrySize > 0 {
+		r = &lineLimitReader{r: r, max: maxEntrySize}
+	}
+	return NewJSONUnpacker(r)
+}
+
+// lineLimitReader fails reads once more than max bytes pass without a new
+// line.
+type lineLimitReader struct {
+	r   io.Reader
+	max int64
+	n   int64 // bytes since the last new line
+}
+
+func (llr *lineLimitReader) Read(p []byte) (int, error) {
+	n, err := llr.r.Read(p)
+	for _, c := range p[:n] {
+		if c == '\n' {
+			llr.n = 0
+			continue
+		}
+		llr.n++
+		if llr.n > llr.max {
+			return 0, ErrEntryTooLarge
+		}
+	}
+	return n, err
+}
+
+// ratioSlack is how many bytes a compressed stream may expand to, before its
+// ratio is checked. It spares small streams, which legitimately compress well.
+const ratioSlack = 1 << 20
+
+// NewGzipReaderWithLimit is gzip.NewReader, failing with ErrRatioTooLarge once
+// the decompressed stream is more than maxRatio times the compressed bytes
+// read. A maxRatio of zero is no limit.
+func NewGzipReaderWithLimit(r io.Reader, maxRatio int64) (io.ReadCloser, error) {
+	cr := &countingReader{r: r}
+	zr, err := gzip.NewReader(cr)
+	if err != nil {
+		return nil, err
+	}
+	if maxRatio <= 0 {
+		return zr, nil
+	}
+	return &ratioLimitReader{zr: zr, compressed: cr, max: maxRatio}, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+type ratioLimitReader struct {
+	zr         *gzip.Reader
+	compressed *countingReader
+	max        int64
+	n          int64 // decompressed bytes read
+}
+
+func (rlr *ratioLimitReader) Read(p []byte) (int, error) {
+	n, err := rlr.zr.Read(p)
+	rlr.n += int64(n)
+	if rlr.n > ratioSlack && rlr.n/rlr.max > rlr.compressed.n {
+		return 0, ErrRatioTooLarge
+	}
+	return n, err
+}
+
+func (rlr *ratioLimitReader) Close() error {
+	return rlr.zr.Close()
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestJSONUnpackerWithLimit(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	jp := NewJSONPacker(buf)
+	for _, e := range []Entry{
+		{Type: SegmentType, Payload: []byte("small")},
+		{Type: SegmentType, Payload: bytes.Repeat([]byte("big"), 1024)},
+	} {
+		if _, err := jp.AddEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the decoder reads ahead, so the long line may fail the first entry
+	jup := NewJSONUnpackerWithLimit(bytes.NewReader(buf.Bytes()), 1024)
+	var err error
+	for i := 0; i < 2 && err == nil; i++ {
+		_, err = jup.Next()
+	}
+	if err != ErrEntryTooLarge {
+		t.Errorf("expected %v, got %v", ErrEntryTooLarge, err)
+	}
+
+	jup = NewJSONUnpackerWithLimit(bytes.NewReader(buf.Bytes()), 1<<20)
+	for i := 0; i < 2; i++ {
+		if _, err := jup.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := jup.Next(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestGzipReaderWithLimit(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	gw := gzip.NewWriter(buf)
+	if _, err := io.WriteString(gw, strings.Repeat("\x00", 8<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vectors := []struct {
+		maxRatio int64
+		wantErr  error
+	}{
+		{0, nil},
+		{1 << 20, nil},
+		{10, ErrRatioTooLarge},
+	}
+	for _, v := range vectors {
+		zr, err := NewGzipReaderWithLimit(bytes.NewReader(buf.Bytes()), v.maxRatio)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, zr)
+		if err != v.wantErr {
+			t.Errorf("ratio %d: expected %v, got %v", v.maxRatio, v.wantErr, err)
+		}
+		if v.wantErr == nil && n != 8<<20 {
+			t.Errorf("ratio %d: expected %d bytes, got %d", v.maxRatio, 8<<20, n)
+		}
+		if err := zr.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,585 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	packIndexName = "index"
+	packLogName   = "index.log"
+	packLockName  = "lock"
+
+	// maxPackSize is the size past which Put starts a new pack file.
+	maxPackSize = 1 << 30
+)
+
+// ErrPackStoreLocked occurs when the writer lock of a PackStore is held by
+// another PackStore, in this process or another.
+var ErrPackStoreLocked = errors.New("pack store is locked by another writer")
+
+// packIndex maps the checksum of each payload to where it is in the packs.
+type packIndex struct {
+	Generation int64                   `json:"generation"`
+	Packs      []string                `json:"packs"`
+	Blobs      map[string]packLocation `json:"blobs"`
+}
+
+type packLocation struct {
+	Pack   int   `json:"pack"` // index in packIndex.Packs
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// packCommit is a line of the index log, adding the payloads committed to
+// the pack named Pack to the index. The Pack of their locations is unused.
+type packCommit struct {
+	Generation int64                   `json:"generation"`
+	Pack       string                  `json:"pack"`
+	Blobs      map[string]packLocation `json:"blobs"`
+}
+
+// apply adds the payloads of c to index.
+func (index *packIndex) apply(c *packCommit) {
+	pack := -1
+	for i, name := range index.Packs {
+		if name == c.Pack {
+			pack = i
+		}
+	}
+	if pack < 0 {
+		pack = len(index.Packs)
+		index.Packs = append(index.Packs, c.Pack)
+	}
+	for key, loc := range c.Blobs {
+		loc.Pack = pack
+		index.Blobs[key] = loc
+	}
+	index.Generation = c.Generation
+}
+
+// packFile is a read handle of a pack, shared by the payloads Get from it.
+// Once retired, such as by Repack, it is closed as soon as none of them are
+// still being read. Its fields are guarded by PackStore.mu.
+type packFile struct {
+	fh      *os.File
+	refs    int
+	retired bool
+}
+
+// packReader is a payload returned by PackStore.Get, releasing its pack on
+// Close.
+type packReader struct {
+	*io.SectionReader
+	ps   *PackStore
+	pf   *packFile
+	once sync.Once
+}
+
+func (r *packReader) Close() error {
+	var err error
+	r.once.Do(func() { err = r.ps.release(r.pf) })
+	return err
+}
+
+// PackStore is a FileGetPutter of file payloads addressed by their checksum,
+// appended to a few large pack files rather than stored one per file. An
+// index of where each payload is, by checksum, is kept next to the packs, as
+// a snapshot written by Repack and a log of the commits since.
+//
+// Any number of PackStores, in any process, may Get from the same root. Only
+// one at a time may Put or Repack; it takes the writer lock of root on its
+// first Put, and releases it on Close. Payloads Put are visible to the
+// PackStore that Put them immediately, and to others once committed.
+type PackStore struct {
+	root string
+
+	// wmu serializes the writers appending to the current pack, Put and
+	// Repack, which copy payloads without holding mu. It is taken before mu.
+	wmu sync.Mutex
+
+	mu    sync.Mutex
+	index *packIndex
+	files map[string]*packFile // read handles of packs, by name
+
+	// writer state, once locked. cur and curName change with both wmu and
+	// mu held, curSize with wmu held.
+	lock    *os.File
+	cur     *os.File // pack being appended to
+	curName string
+	curSize int64
+	pending map[string]packLocation // payloads Put since the last commit
+}
+
+// OpenPackStore returns a PackStore rooted at root, creating the directory
+// if needed.
+func OpenPackStore(root string) (*PackStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	ps := &PackStore{
+		root:  root,
+		files: map[string]*packFile{},
+	}
+	index, err := ps.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	ps.index = index
+	return ps, nil
+}
+
+// Get returns the payload of the FileType entry, by its checksum, as a
+// section of the pack holding it. The pack is kept open until the payload is
+// closed, even if it is removed by Repack in the meantime.
+func (ps *PackStore) Get(entry *Entry) (io.ReadCloser, error) {
+	key := hex.EncodeToString(entry.Payload)
+	r, pf, err := ps.get(key)
+	if err != nil {
+		// committed by another writer since the index was read, or moved by
+		// a repack
+		if rerr := ps.reload(); rerr != nil {
+			return nil, rerr
+		}
+		r, pf, err = ps.get(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Size() != entry.Size {
+		_ = ps.release(pf)
+		return nil, fmt.Errorf("pack payload has size %d but entry expects %d: %w", r.Size(), entry.Size, ErrSizeMismatch)
+	}
+	return &packReader{SectionReader: r, ps: ps, pf: pf}, nil
+}
+
+// get returns the section of the payload key, holding a reference to its
+// pack.
+func (ps *PackStore) get(key string) (*io.SectionReader, *packFile, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var name string
+	loc, ok := ps.pending[key]
+	if ok {
+		name = ps.curName
+	} else if loc, ok = ps.index.Blobs[key]; ok {
+		name = ps.index.Packs[loc.Pack]
+	} else {
+		return nil, nil, fmt.Errorf("payload %s: %w", key, os.ErrNotExist)
+	}
+	pf, err := ps.packFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	pf.refs++
+	return io.NewSectionReader(pf.fh, loc.Offset, loc.Size), pf, nil
+}
+
+// packFile returns the read handle of the pack name. ps.mu must be held.
+func (ps *PackStore) packFile(name string) (*packFile, error) {
+	if pf, ok := ps.files[name]; ok {
+		return pf, nil
+	}
+	fh, err := os.Open(filepath.Join(ps.root, name))
+	if err != nil {
+		return nil, err
+	}
+	pf := &packFile{fh: fh}
+	ps.files[name] = pf
+	return pf, nil
+}
+
+// release drops a reference to pf taken by get, closing it if it is retired
+// and was the last.
+func (ps *PackStore) release(pf *packFile) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pf.refs--
+	if pf.retired && pf.refs == 0 {
+		return pf.fh.Close()
+	}
+	return nil
+}
+
+// retire stops handing out the read handle of the pack name, closing it once
+// no payload read from it is left open. ps.mu must be held.
+func (ps *PackStore) retire(name string) error {
+	pf, ok := ps.files[name]
+	if !ok {
+		return nil
+	}
+	delete(ps.files, name)
+	pf.retired = true
+	if pf.refs == 0 {
+		return pf.fh.Close()
+	}
+	return nil
+}
+
+// reload reads the index again, if another writer committed it.
+func (ps *PackStore) reload() error {
+	index, err := ps.readIndex()
+	if err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if index.Generation > ps.index.Generation {
+		ps.index = index
+	}
+	return nil
+}
+
+// readIndex reads the index snapshot, and applies the commits logged since.
+func (ps *PackStore) readIndex() (*packIndex, error) {
+	index := packIndex{Blobs: map[string]packLocation{}}
+	buf, err := os.ReadFile(filepath.Join(ps.root, packIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, &index); err != nil {
+			return nil, fmt.Errorf("reading pack index: %w", err)
+		}
+		if index.Blobs == nil {
+			index.Blobs = map[string]packLocation{}
+		}
+	}
+
+	buf, err = os.ReadFile(filepath.Join(ps.root, packLogName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// a last line without a newline is a commit the writer did not finish
+	for i := bytes.IndexByte(buf, '\n'); i >= 0; i = bytes.IndexByte(buf, '\n') {
+		var c packCommit
+		if err := json.Unmarshal(buf[:i], &c); err != nil {
+			return nil, fmt.Errorf("reading pack index log: %w", err)
+		}
+		buf = buf[i+1:]
+		// logged before the snapshot was written
+		if c.Generation <= index.Generation {
+			continue
+		}
+		index.apply(&c)
+	}
+	for key, loc := range index.Blobs {
+		if loc.Pack < 0 || loc.Pack >= len(index.Packs) {
+			return nil, fmt.Errorf("reading pack index: payload %s is in unknown pack %d", key, loc.Pack)
+		}
+	}
+	return &index, nil
+}
+
+// Put appends the payload read from r to the current pack, unless a payload
+// of the same checksum is stored already, and returns its size and checksum.
+// It is not durable until committed. Puts are appended one at a time, while
+// Get and Commit go on.
+func (ps *PackStore) Put(_ string, r io.Reader) (int64, []byte, error) {
+	ps.wmu.Lock()
+	defer ps.wmu.Unlock()
+	ps.mu.Lock()
+	err := ps.startPack()
+	ps.mu.Unlock()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// past curSize, the pack is only read once the payload is pending
+	offset := ps.curSize
+	hsh := NewHash()
+	n, err := io.Copy(io.MultiWriter(ps.cur, hsh), r)
+	if err == nil {
+		checksum := hsh.Sum(nil)
+		key := hex.EncodeToString(checksum)
+		ps.mu.Lock()
+		_, committed := ps.index.Blobs[key]
+		_, pending := ps.pending[key]
+		if !committed && !pending {
+			ps.pending[key] = packLocation{Offset: offset, Size: n}
+		}
+		ps.mu.Unlock()
+		if !committed && !pending {
+			ps.curSize += n
+			return n, checksum, nil
+		}
+	}
+	// drop what was appended, as a duplicate or incomplete payload
+	if terr := ps.truncate(offset); terr != nil && err == nil {
+		err = terr
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, hsh.Sum(nil), nil
+}
+
+func (ps *PackStore) truncate(size int64) error {
+	if err := ps.cur.Truncate(size); err != nil {
+		return err
+	}
+	_, err := ps.cur.Seek(size, io.SeekStart)
+	return err
+}
+
+// lockWriter takes the writer lock, unless held already. ps.mu must be held.
+func (ps *PackStore) lockWriter() error {
+	if ps.lock != nil {
+		return nil
+	}
+	lock, err := lockPackStore(filepath.Join(ps.root, packLockName))
+	if err != nil {
+		return err
+	}
+	// committed by the previous writer, since this store was opened
+	index, err := ps.readIndex()
+	if err == nil {
+		err = ps.truncateLog()
+	}
+	if err != nil {
+		_ = unlockPackStore(lock)
+		return err
+	}
+	ps.lock, ps.index = lock, index
+	ps.pending = map[string]packLocation{}
+	return nil
+}
+
+// startPack takes the writer lock, and starts a new pack when there is none
+// or the current one is full. ps.mu must be held.
+func (ps *PackStore) startPack() error {
+	if err := ps.lockWriter(); err != nil {
+		return err
+	}
+	if ps.cur != nil && ps.curSize < maxPackSize {
+		return nil
+	}
+	if ps.cur != nil {
+		if err := ps.commit(); err != nil {
+			return err
+		}
+		// its handle is kept to read its payloads
+		ps.cur = nil
+	}
+	// a new pack for every writer, so no pack is appended to after a crash
+	fh, err := os.CreateTemp(ps.root, "pack-*.pack")
+	if err != nil {
+		return err
+	}
+	ps.cur, ps.curName, ps.curSize = fh, filepath.Base(fh.Name()), 0
+	ps.files[ps.curName] = &packFile{fh: fh}
+	return nil
+}
+
+// Commit makes the payloads Put so far durable, and visible to other
+// PackStores.
+func (ps *PackStore) Commit() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.commit()
+}
+
+// commit syncs the current pack, and appends the pending payloads to the
+// index log. ps.mu must be held.
+func (ps *PackStore) commit() error {
+	if ps.cur == nil || len(ps.pending) == 0 {
+		return nil
+	}
+	if err := ps.cur.Sync(); err != nil {
+		return err
+	}
+	c := &packCommit{
+		Generation: ps.index.Generation + 1,
+		Pack:       ps.curName,
+		Blobs:      ps.pending,
+	}
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(filepath.Join(ps.root, packLogName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(append(buf, '\n')); err != nil {
+		_ = fh.Close()
+		return err
+	}
+	if err := (syncCloser{fh}).Close(); err != nil {
+		return err
+	}
+	ps.index.apply(c)
+	ps.pending = map[string]packLocation{}
+	return nil
+}
+
+// truncateLog drops the unfinished commit a crashed writer left at the end
+// of the index log, so that the next is appended on a line of its own.
+func (ps *PackStore) truncateLog() error {
+	name := filepath.Join(ps.root, packLogName)
+	buf, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n := bytes.LastIndexByte(buf, '\n') + 1; n < len(buf) {
+		return os.Truncate(name, int64(n))
+	}
+	return nil
+}
+
+func (ps *PackStore) writeIndex(index *packIndex) error {
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(ps.root, "index-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := (syncCloser{tmp}).Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return publish(tmp.Name(), filepath.Join(ps.root, packIndexName))
+}
+
+// Repack copies the committed payloads in keep into a new pack, and removes
+// the packs and payloads that are left, along with the packs left behind by
+// writers that crashed. With a nil keep, every payload is kept, compacting
+// the store. Payloads pending a commit are committed first, and the index
+// log is replaced by a snapshot of the new index.
+//
+// Payloads Get before, from the packs removed, can still be read until they
+// are closed.
+func (ps *PackStore) Repack(keep ChecksumSet) (GCStats, error) {
+	var stats GCStats
+	ps.wmu.Lock()
+	defer ps.wmu.Unlock()
+	ps.mu.Lock()
+	err := ps.lockWriter()
+	if err == nil {
+		err = ps.commit()
+	}
+	// with wmu held, nothing else commits, so the index is read without mu
+	old := ps.index
+	ps.mu.Unlock()
+	if err != nil {
+		return stats, err
+	}
+
+	fh, err := os.CreateTemp(ps.root, "pack-*.pack")
+	if err != nil {
+		return stats, err
+	}
+	index := &packIndex{
+		Generation: old.Generation + 1,
+		Packs:      []string{filepath.Base(fh.Name())},
+		Blobs:      map[string]packLocation{},
+	}
+	var offset int64
+	for key, loc := range old.Blobs {
+		checksum, err := hex.DecodeString(key)
+		if err != nil {
+			continue
+		}
+		if keep != nil && !keep.Has(checksum) {
+			stats.Removed++
+			stats.RemovedBytes += loc.Size
+			continue
+		}
+		ps.mu.Lock()
+		src, err := ps.packFile(old.Packs[loc.Pack])
+		ps.mu.Unlock()
+		if err == nil {
+			_, err = io.Copy(fh, io.NewSectionReader(src.fh, loc.Offset, loc.Size))
+		}
+		if err != nil {
+			_ = fh.Close()
+			_ = os.Remove(fh.Name())
+			return GCStats{}, err
+		}
+		index.Blobs[key] = packLocation{Offset: offset, Size: loc.Size}
+		offset += loc.Size
+		stats.Kept++
+	}
+	if err := (syncCloser{fh}).Close(); err != nil {
+		_ = os.Remove(fh.Name())
+		return GCStats{}, err
+	}
+	if err := ps.writeIndex(index); err != nil {
+		_ = os.Remove(fh.Name())
+		return GCStats{}, err
+	}
+	// the commits logged are all in the snapshot, of a later generation
+	if err := os.Remove(filepath.Join(ps.root, packLogName)); err != nil && !os.IsNotExist(err) {
+		return stats, err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.index = index
+	// with the writer lock held, every other pack is garbage. Other
+	// PackStores reading them reload the index once they are gone.
+	ps.cur = nil
+	for name := range ps.files {
+		_ = ps.retire(name)
+	}
+	packs, err := filepath.Glob(filepath.Join(ps.root, "pack-*.pack"))
+	if err != nil {
+		return stats, err
+	}
+	for _, pack := range packs {
+		if filepath.Base(pack) == index.Packs[0] {
+			continue
+		}
+		if err := os.Remove(pack); err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// Close commits the payloads Put, releases the writer lock, and closes the
+// packs, each once the payloads returned by Get from it are closed.
+func (ps *PackStore) Close() error {
+	ps.wmu.Lock()
+	defer ps.wmu.Unlock()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var err error
+	if ps.lock != nil {
+		err = ps.commit()
+		if ps.cur != nil && ps.curSize == 0 {
+			if cerr := ps.retire(ps.curName); err == nil {
+				err = cerr
+			}
+			_ = os.Remove(filepath.Join(ps.root, ps.curName))
+		}
+		ps.cur = nil
+		if uerr := unlockPackStore(ps.lock); err == nil {
+			err = uerr
+		}
+		ps.lock = nil
+	}
+	for name := range ps.files {
+		if cerr := ps.retire(name); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
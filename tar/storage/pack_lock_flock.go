@@ -0,0 +1,31 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockPackStore takes an exclusive lock on the file path, without waiting.
+// The lock is released by the kernel if the process dies.
+func lockPackStore(path string) (*os.File, error) {
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = fh.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrPackStoreLocked
+		}
+		return nil, err
+	}
+	return fh, nil
+}
+
+func unlockPackStore(fh *os.File) error {
+	// closing the file releases the lock
+	return fh.Close()
+}
@@ -0,0 +1,26 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package storage
+
+import (
+	"os"
+)
+
+// lockPackStore takes the lock by creating the file path, which must not
+// exist. Unlike flock, the lock outlives a process that crashes; remove the
+// file by hand then.
+func lockPackStore(path string) (*os.File, error) {
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if os.IsExist(err) {
+		return nil, ErrPackStoreLocked
+	}
+	return fh, err
+}
+
+func unlockPackStore(fh *os.File) error {
+	err := fh.Close()
+	if rerr := os.Remove(fh.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
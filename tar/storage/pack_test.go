@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+func TestPackStore(t *testing.T) {
+	root := t.TempDir()
+	ps, err := OpenPackStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ps.Close() }()
+
+	bodies := []string{"foo", "bar", "baz", "foo"}
+	entries := make([]Entry, len(bodies))
+	for i, body := range bodies {
+		n, csum, err := ps.Put(body, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[i] = Entry{Type: FileType, Size: n, Payload: csum}
+	}
+	if _, _, err := ps.Put("bad", iotest.ErrReader(errors.New("boom"))); err == nil {
+		t.Error("expected the read error of Put")
+	}
+	if ps.curSize != 9 {
+		t.Errorf("expected duplicate and failed payloads to be dropped from the pack, got %d bytes", ps.curSize)
+	}
+
+	// another store only sees the payloads once committed
+	reader, err := OpenPackStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = reader.Close() }()
+	if _, err := reader.Get(&entries[0]); !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("expected a pending payload to not exist for other stores, got %v", err)
+	}
+	if _, _, err := reader.Put("foo", bytes.NewBufferString("foo")); err != ErrPackStoreLocked {
+		t.Errorf("expected %v, got %v", ErrPackStoreLocked, err)
+	}
+	if err := ps.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*PackStore{ps, reader} {
+		for i, body := range bodies {
+			r, err := s.Get(&entries[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := io.ReadAll(r)
+			_ = r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != body {
+				t.Errorf("expected %q, got %q", body, out)
+			}
+		}
+	}
+
+	bad := entries[0]
+	bad.Size++
+	if _, err := ps.Get(&bad); err == nil {
+		t.Error("expected a size mismatch error")
+	}
+
+	// payloads are read while another is being Put
+	pr, pw := io.Pipe()
+	put := make(chan error)
+	go func() {
+		_, _, err := ps.Put("slow", pr)
+		put <- err
+	}()
+	if _, err := pw.Write([]byte("slow")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ps.Get(&entries[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+	_ = pw.Close()
+	if err := <-put; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackStoreIndexLog(t *testing.T) {
+	root := t.TempDir()
+	var entries []Entry
+	for _, body := range []string{"foo", "bar"} {
+		ps, err := OpenPackStore(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, csum, err := ps.Put(body, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, Entry{Type: FileType, Size: n, Payload: csum})
+		if err := ps.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// each commit is appended to the log, rather than rewriting the index
+	if _, err := os.Stat(filepath.Join(root, packIndexName)); !os.IsNotExist(err) {
+		t.Errorf("expected no index snapshot, got %v", err)
+	}
+	buf, err := os.ReadFile(filepath.Join(root, packLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(buf, []byte("\n")); lines != 2 {
+		t.Errorf("expected 2 commits logged, got %d", lines)
+	}
+
+	// as by a writer that crashed while committing
+	if err := os.WriteFile(filepath.Join(root, packLogName), append(buf, `{"generation":3,"pa`...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ps, err := OpenPackStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ps.Close() }()
+	n, csum, err := ps.Put("baz", bytes.NewBufferString("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = append(entries, Entry{Type: FileType, Size: n, Payload: csum})
+	if err := ps.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenPackStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = reader.Close() }()
+	for i := range entries {
+		r, err := reader.Get(&entries[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Close()
+	}
+}
+
+func TestPackStoreRepack(t *testing.T) {
+	root := t.TempDir()
+	ps, err := OpenPackStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []Entry
+	for _, body := range []string{"foo", "bar", "baz"} {
+		n, csum, err := ps.Put(body, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, Entry{Type: FileType, Size: n, Payload: csum})
+		// a pack per writer
+		if err := ps.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packs, _ := filepath.Glob(filepath.Join(root, "pack-*.pack"))
+	if len(packs) != 3 {
+		t.Fatalf("expected 3 packs, got %d", len(packs))
+	}
+
+	reader, err := OpenPackStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	// a payload being read when its pack is removed
+	open, err := ps.Get(&entries[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keep := ChecksumSet{}
+	keep.Add(entries[0].Payload)
+	keep.Add(entries[2].Payload)
+	stats, err := ps.Repack(keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Kept != 2 || stats.Removed != 1 || stats.RemovedBytes != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if out, err := io.ReadAll(open); err != nil || string(out) != "bar" {
+		t.Errorf("expected the open payload to still read, got %q, %v", out, err)
+	}
+	if err := open.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, packLogName)); !os.IsNotExist(err) {
+		t.Errorf("expected the index log to be replaced by a snapshot, got %v", err)
+	}
+	if err := ps.Close(); err != nil {
+		t.Fatal(err)
+	}
+	packs, _ = filepath.Glob(filepath.Join(root, "pack-*.pack"))
+	if len(packs) != 1 {
+		t.Errorf("expected 1 pack after repacking, got %d", len(packs))
+	}
+
+	// a reader of the old index follows the repack
+	for _, i := range []int{0, 2} {
+		r, err := reader.Get(&entries[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Close()
+	}
+	if _, err := reader.Get(&entries[1]); err == nil {
+		t.Error("expected the unreferenced payload to be removed")
+	}
+}
@@ -0,0 +1,36 @@
+package storage
+
+// MinPaddingSize is the shortest run of zero bytes that SegmentEntries packs
+// as a PaddingType entry. Shorter runs, such as the unused fields of a header,
+// compress better left in place than split into entries of their own.
+const MinPaddingSize = 256
+
+// SegmentEntries splits the raw bytes b into SegmentType entries, and
+// PaddingType entries for the runs of at least MinPaddingSize zero bytes.
+// The Payload of the SegmentType entries reference b.
+func SegmentEntries(b []byte) []Entry {
+	var entries []Entry
+	start := 0 // start of the pending raw bytes
+	for i := 0; i < len(b); {
+		if b[i] != 0 {
+			i++
+			continue
+		}
+		j := i
+		for j < len(b) && b[j] == 0 {
+			j++
+		}
+		if j-i >= MinPaddingSize {
+			if i > start {
+				entries = append(entries, Entry{Type: SegmentType, Payload: b[start:i]})
+			}
+			entries = append(entries, Entry{Type: PaddingType, Size: int64(j - i)})
+			start = j
+		}
+		i = j
+	}
+	if start < len(b) {
+		entries = append(entries, Entry{Type: SegmentType, Payload: b[start:]})
+	}
+	return entries
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestSegmentEntries(t *testing.T) {
+	zeros := func(n int) []byte { return make([]byte, n) }
+	join := func(bs ...[]byte) []byte { return bytes.Join(bs, nil) }
+	hdr := []byte("header")
+
+	vectors := []struct {
+		input []byte
+		want  []Entry
+	}{
+		{nil, nil},
+		{hdr, []Entry{{Type: SegmentType, Payload: hdr}}},
+		{zeros(MinPaddingSize - 1), []Entry{{Type: SegmentType, Payload: zeros(MinPaddingSize - 1)}}},
+		{zeros(1024), []Entry{{Type: PaddingType, Size: 1024}}},
+		{join(zeros(300), hdr, zeros(10), hdr), []Entry{
+			{Type: PaddingType, Size: 300},
+			{Type: SegmentType, Payload: join(hdr, zeros(10), hdr)},
+		}},
+		{join(hdr, zeros(1024)), []Entry{
+			{Type: SegmentType, Payload: hdr},
+			{Type: PaddingType, Size: 1024},
+		}},
+	}
+	for i, v := range vectors {
+		got := SegmentEntries(v.input)
+		if len(got) != len(v.want) {
+			t.Errorf("test %d: expected %d entries, got %d", i, len(v.want), len(got))
+			continue
+		}
+		var rebuilt []byte
+		for j, e := range got {
+			if e.Type != v.want[j].Type || e.Size != v.want[j].Size || !bytes.Equal(e.Payload, v.want[j].Payload) {
+				t.Errorf("test %d: entry %d: expected %+v, got %+v", i, j, v.want[j], e)
+			}
+			if e.Type == PaddingType {
+				rebuilt = append(rebuilt, zeros(int(e.Size))...)
+			} else {
+				rebuilt = append(rebuilt, e.Payload...)
+			}
+		}
+		if !bytes.Equal(rebuilt, v.input) {
+			t.Errorf("test %d: entries do not rebuild the input", i)
+		}
+	}
+}
+
+func TestPaddingTypeJSON(t *testing.T) {
+	buf, err := json.Marshal(Entry{Type: PaddingType, Size: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Entry
+	if err := json.Unmarshal(buf, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != PaddingType || e.Size != 1024 {
+		t.Errorf("expected a padding entry of 1024 bytes, got %+v", e)
+	}
+
+	// the original types are still marshalled as numbers
+	buf, err = json.Marshal(Entry{Type: SegmentType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte(`"type":2`)) {
+		t.Errorf("expected a numeric segment type, got %s", buf)
+	}
+
+	// unpackers predating PaddingType decode the type as a number
+	var old struct {
+		Type int `json:"type"`
+	}
+	buf, _ = json.Marshal(Entry{Type: PaddingType, Size: 1024})
+	if err := json.Unmarshal(buf, &old); err == nil {
+		t.Errorf("expected an older unpacker to fail, got type %d", old.Type)
+	}
+
+	if err := json.Unmarshal([]byte(`{"type":"bogus"}`), &e); err == nil {
+		t.Error("expected an error for an unknown type name")
+	}
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// Reasons a payload is missing from a Plan.
+const (
+	PlanAbsent       = "absent"
+	PlanSizeMismatch = "size-mismatch"
+)
+
+// PlanEntry is a payload missing from a FileGetter.
+type PlanEntry struct {
+	// Checksum is the hex checksum the payload is stored by.
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+	// Name is that of the first entry referencing the payload.
+	Name string `json:"name"`
+	// Reason is PlanAbsent or PlanSizeMismatch.
+	Reason string `json:"reason"`
+}
+
+// Plan lists the payloads referenced by some metadata that a FileGetter does
+// not have, such as those to transfer to a store before assembling there.
+type Plan struct {
+	// Payloads and Bytes count the distinct payloads the metadata references.
+	Payloads int   `json:"payloads"`
+	Bytes    int64 `json:"bytes"`
+
+	Missing      []PlanEntry `json:"missing"`
+	MissingBytes int64       `json:"missing_bytes"`
+}
+
+// PayloadChecker is a FileGetter that can check it has a payload at its size
+// without reading it, such as ChecksumStore.
+type PayloadChecker interface {
+	// CheckPayload returns an error wrapping fs.ErrNotExist if the payload of
+	// entry is missing, or ErrSizeMismatch if it is of another size.
+	CheckPayload(entry *Entry) error
+}
+
+// PlanMissing reads the entries from up, until io.EOF, and checks fg for the
+// payload of each FileType entry, with CheckPayload if fg is a
+// PayloadChecker. Payloads that are empty or inlined in their entry are not
+// stored, so are not checked. Errors of fg other than a missing payload or
+// one of the wrong size are returned.
+func PlanMissing(up Unpacker, fg FileGetter) (*Plan, error) {
+	plan := &Plan{Missing: []PlanEntry{}}
+	seen := ChecksumSet{}
+	for {
+		entry, err := up.Next()
+		if err == io.EOF {
+			return plan, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Type != FileType || entry.Size == 0 || len(entry.Inline) > 0 || seen.Has(entry.Payload) {
+			continue
+		}
+		seen.Add(entry.Payload)
+		plan.Payloads++
+		plan.Bytes += entry.Size
+
+		reason, err := checkPayload(fg, entry)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			plan.Missing = append(plan.Missing, PlanEntry{
+				Checksum: hex.EncodeToString(entry.Payload),
+				Size:     entry.Size,
+				Name:     entry.GetName(),
+				Reason:   reason,
+			})
+			plan.MissingBytes += entry.Size
+		}
+	}
+}
+
+// checkPayload returns why fg does not have the payload of entry, or "" if
+// it does.
+func checkPayload(fg FileGetter, entry *Entry) (string, error) {
+	var r io.ReadCloser
+	var err error
+	if pc, ok := fg.(PayloadChecker); ok {
+		err = pc.CheckPayload(entry)
+	} else {
+		r, err = fg.Get(entry)
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return PlanAbsent, nil
+	case errors.Is(err, ErrSizeMismatch):
+		return PlanSizeMismatch, nil
+	case err != nil:
+		return "", err
+	case r == nil:
+		return "", nil
+	}
+	defer func() { _ = r.Close() }()
+
+	size, err := payloadSize(r)
+	if errors.Is(err, ErrSizeMismatch) {
+		return PlanSizeMismatch, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if size != entry.Size {
+		return PlanSizeMismatch, nil
+	}
+	return "", nil
+}
+
+// payloadSize returns the size of r, reading it through only if it can not
+// be told otherwise.
+func payloadSize(r io.Reader) (int64, error) {
+	switch r := r.(type) {
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	case interface{ Size() int64 }:
+		return r.Size(), nil
+	}
+	return io.Copy(io.Discard, r)
+}
+
+// Fetch copies the payloads missing from the plan from fg to fp, such as from
+// a remote mirror into the store the plan was made for, verifying each has
+// the size and checksum expected. It returns the number of bytes copied.
+//
+// A payload missing for being of the wrong size must be removed from fp
+// first, if fp keeps the payloads it has already, as ChecksumStore does.
+func (p *Plan) Fetch(fg FileGetter, fp FilePutter) (int64, error) {
+	var copied int64
+	for _, m := range p.Missing {
+		checksum, err := hex.DecodeString(m.Checksum)
+		if err != nil {
+			return copied, fmt.Errorf("%q: %w", m.Name, err)
+		}
+		entry := &Entry{Type: FileType, Name: m.Name, Size: m.Size, Payload: checksum}
+		rc, err := getVerified(fg, entry)
+		if err != nil {
+			return copied, err
+		}
+		_, _, err = fp.Put(m.Name, rc)
+		_ = rc.Close()
+		if err != nil {
+			return copied, err
+		}
+		copied += m.Size
+	}
+	return copied, nil
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanMissing(t *testing.T) {
+	cs, err := NewChecksumStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := NewDiscardFilePutter()
+
+	w := bytes.NewBuffer(nil)
+	p := NewJSONPacker(w)
+	add := func(name, body string, size int64, store bool) []byte {
+		n, csum, err := fp.Put(name, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store {
+			if _, _, err := cs.Put(name, bytes.NewBufferString(body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if size < 0 {
+			size = n
+		}
+		if _, err := p.AddEntry(Entry{Type: FileType, Name: name, Size: size, Payload: csum}); err != nil {
+			t.Fatal(err)
+		}
+		return csum
+	}
+	add("present", "foo", -1, true)
+	absent := add("absent", "bar", -1, false)
+	add("again", "bar", -1, false) // same payload as absent
+	mismatch := add("mismatch", "baz", 4, true)
+	add("empty", "", -1, false)
+	if _, err := p.AddEntry(Entry{Type: FileType, Name: "inline", Size: 3, Inline: []byte("bif")}); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := PlanMissing(NewJSONUnpacker(w), cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Payloads != 3 || plan.Bytes != 10 {
+		t.Errorf("expected 3 payloads of 10 bytes, got %d of %d", plan.Payloads, plan.Bytes)
+	}
+	expected := []PlanEntry{
+		{Checksum: hex.EncodeToString(absent), Size: 3, Name: "absent", Reason: PlanAbsent},
+		{Checksum: hex.EncodeToString(mismatch), Size: 4, Name: "mismatch", Reason: PlanSizeMismatch},
+	}
+	if len(plan.Missing) != len(expected) {
+		t.Fatalf("expected %d missing, got %+v", len(expected), plan.Missing)
+	}
+	for i := range expected {
+		if plan.Missing[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], plan.Missing[i])
+		}
+	}
+	if plan.MissingBytes != 7 {
+		t.Errorf("expected 7 missing bytes, got %d", plan.MissingBytes)
+	}
+}
+
+func TestPlanFetch(t *testing.T) {
+	cs, err := NewChecksumStoreWithOptions(t.TempDir(), StoreOptions{Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror, err := NewChecksumStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := bytes.NewBuffer(nil)
+	p := NewJSONPacker(w)
+	add := func(name string, body []byte) []byte {
+		n, csum, err := mirror.Put(name, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.AddEntry(Entry{Type: FileType, Name: name, Size: n, Payload: csum}); err != nil {
+			t.Fatal(err)
+		}
+		return csum
+	}
+	kept := bytes.Repeat([]byte("all work and no play "), 100)
+	resized := bytes.Repeat([]byte("makes jack a dull boy "), 100)
+	add("kept", kept)
+	add("absent", []byte("bar"))
+	csum := add("resized", resized)
+	if _, _, err := cs.Put("kept", bytes.NewReader(kept)); err != nil {
+		t.Fatal(err)
+	}
+	// compressed at another size, which is told without decompressing it
+	zw := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(zw)
+	_, _ = gz.Write(resized[1:])
+	_ = gz.Close()
+	if err := os.MkdirAll(filepath.Dir(cs.Path(csum)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cs.Path(csum)+".gzip", zw.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	meta := w.Bytes()
+
+	plan, err := PlanMissing(NewJSONUnpacker(bytes.NewReader(meta)), cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Missing) != 2 || plan.Missing[0].Reason != PlanAbsent || plan.Missing[1].Reason != PlanSizeMismatch {
+		t.Fatalf("expected absent and size-mismatch payloads, got %+v", plan.Missing)
+	}
+
+	if _, err := plan.Fetch(NewBufferFileGetPutter(), cs); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected %v fetching from an empty mirror, got %v", fs.ErrNotExist, err)
+	}
+	if err := cs.Remove(csum); err != nil {
+		t.Fatal(err)
+	}
+	n, err := plan.Fetch(mirror, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != plan.MissingBytes {
+		t.Errorf("expected %d bytes fetched, got %d", plan.MissingBytes, n)
+	}
+	plan, err = PlanMissing(NewJSONUnpacker(bytes.NewReader(meta)), cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Missing) != 0 {
+		t.Errorf("expected nothing missing once fetched, got %+v", plan.Missing)
+	}
+}
@@ -0,0 +1,510 @@
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// storeTempDir is the directory of a ChecksumStore holding payloads being
+// Put. It shares the filesystem of the store, so they can be renamed in place.
+const storeTempDir = "tmp"
+
+// ChecksumStore is a FileGetPutter of file payloads addressed by their
+// checksum, for storing the payloads of many archives at once.
+//
+// Payloads are fanned out in directories named by the first byte of their
+// checksum, as root/ab/abcdef0123456789. A payload is written to a temporary
+// file, synced to disk, and only then renamed in place, so a payload that can
+// be Get is complete. Put is safe to call from many goroutines and processes
+// sharing root.
+//
+// Payloads may be stored compressed, as root/ab/abcdef0123456789.gzip, and
+// are decompressed by Get, so a store can switch codecs at any time.
+type ChecksumStore struct {
+	root  string
+	codec *Codec
+}
+
+// StoreOptions tunes a ChecksumStore.
+type StoreOptions struct {
+	// Compression names the codec payloads are compressed with when Put,
+	// such as "gzip". Payloads that do not compress are stored raw. Payloads
+	// are addressed by the checksum of their uncompressed content either
+	// way, so metadata does not depend on it.
+	Compression string
+}
+
+// minCompressionSaving is the fraction of its size a compressed payload must
+// save, for it to be stored compressed rather than raw.
+const minCompressionSaving = 8 // 1/8th
+
+// NewChecksumStore returns a ChecksumStore rooted at root, creating the
+// directory if needed. A store laid out flat by NewChecksumFileGetter can be
+// read as it is, and moved to the fanned out layout with Migrate.
+func NewChecksumStore(root string) (*ChecksumStore, error) {
+	return NewChecksumStoreWithOptions(root, StoreOptions{})
+}
+
+// NewChecksumStoreWithOptions is NewChecksumStore, tuned by opts.
+func NewChecksumStoreWithOptions(root string, opts StoreOptions) (*ChecksumStore, error) {
+	cs := &ChecksumStore{root: root}
+	if opts.Compression != "" {
+		codec, err := lookupCodec(opts.Compression)
+		if err != nil {
+			return nil, err
+		}
+		cs.codec = &codec
+	}
+	if err := os.MkdirAll(filepath.Join(root, storeTempDir), 0o755); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Path returns where the payload with checksum is stored raw. Compressed, the
+// name of its codec is appended as an extension.
+func (cs *ChecksumStore) Path(checksum []byte) string {
+	return fanOut(cs.root, hex.EncodeToString(checksum))
+}
+
+// Get returns the payload of the FileType entry, by its checksum,
+// decompressed if need be.
+func (cs *ChecksumStore) Get(entry *Entry) (io.ReadCloser, error) {
+	r, err := cs.Open(entry.Payload)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := r.(*os.File)
+	if !ok {
+		// compressed, so the size is only known once read
+		return &sizeCheckReader{ReadCloser: r, size: entry.Size}, nil
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if entry.Size != stat.Size() {
+		_ = file.Close()
+		return nil, fmt.Errorf("checksum-addressed file has size %d but entry expects %d: %w", stat.Size(), entry.Size, ErrSizeMismatch)
+	}
+	return file, nil
+}
+
+// Open returns the payload with checksum, without checking its size. A
+// payload stored raw is returned as its *os.File.
+func (cs *ChecksumStore) Open(checksum []byte) (io.ReadCloser, error) {
+	path, err := cs.lookup(checksum)
+	if err != nil {
+		return nil, err
+	}
+	return openPayload(path)
+}
+
+// lookup returns the path of the payload with checksum, stored raw, in the
+// flat layout not migrated yet, or compressed by any codec.
+func (cs *ChecksumStore) lookup(checksum []byte) (string, error) {
+	path := cs.Path(checksum)
+	paths := []string{path, filepath.Join(cs.root, hex.EncodeToString(checksum))}
+	for _, name := range codecNames() {
+		paths = append(paths, path+"."+name)
+	}
+	for _, p := range paths {
+		_, err := os.Stat(p)
+		if err == nil {
+			return p, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+}
+
+// CheckPayload checks the store has the payload of entry at its size, from
+// the size of its file, or as recorded by its codec if it is compressed, so
+// without reading it. Compressed by a codec that does not record it, a
+// payload is taken to have the size of entry, as it has its checksum.
+func (cs *ChecksumStore) CheckPayload(entry *Entry) error {
+	path, err := cs.lookup(entry.Payload)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	match := fi.Size() == entry.Size
+	if _, ext, ok := strings.Cut(filepath.Base(path), "."); ok {
+		codec, err := lookupCodec(ext)
+		if err != nil {
+			return err
+		}
+		match = true
+		if codec.SizeMatches != nil {
+			if match, err = codec.SizeMatches(file, fi.Size(), entry.Size); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	if !match {
+		return fmt.Errorf("checksum-addressed file %s does not have the size %d the entry expects: %w", path, entry.Size, ErrSizeMismatch)
+	}
+	return nil
+}
+
+// Remove removes the payload with checksum, in whichever encoding it is
+// stored, such as one found to be corrupt. A payload not stored is no error.
+func (cs *ChecksumStore) Remove(checksum []byte) error {
+	for {
+		path, err := cs.lookup(checksum)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// Put stores the payload read from r, compressed if it is worth it, and
+// returns its size and checksum. A payload stored already, in any encoding,
+// is left as it is, rather than stored again, but its modification time is
+// refreshed, for GC to spare it as it would a payload just stored.
+func (cs *ChecksumStore) Put(_ string, r io.Reader) (int64, []byte, error) {
+	tmp, i, checksum, err := writeTemp(filepath.Join(cs.root, storeTempDir), "put-*", r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if stored, err := cs.refresh(checksum); err != nil || stored {
+		_ = os.Remove(tmp)
+		if err != nil {
+			return 0, nil, err
+		}
+		return i, checksum, nil
+	}
+	dst := cs.Path(checksum)
+	if cs.codec != nil {
+		compressed, err := cs.compress(tmp, i)
+		if err != nil {
+			_ = os.Remove(tmp)
+			return 0, nil, err
+		}
+		if compressed != "" {
+			_ = os.Remove(tmp)
+			tmp, dst = compressed, dst+"."+cs.codec.Name
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		_ = os.Remove(tmp)
+		return 0, nil, err
+	}
+	if err := publish(tmp, dst); err != nil {
+		return 0, nil, err
+	}
+	return i, checksum, nil
+}
+
+// PutFile is Put, with the payload being the next size bytes of src, a
+// regular file. Unless the store compresses payloads, they are copied by the
+// kernel rather than through a buffer: with copy_file_range on Linux, which
+// shares the blocks of src on copy-on-write filesystems such as btrfs and
+// XFS. Elsewhere, or across filesystems, they are copied as Put would. Either
+// way, the copy is read back for its checksum.
+func (cs *ChecksumStore) PutFile(name string, src *os.File, size int64) (int64, []byte, error) {
+	if cs.codec != nil {
+		n, checksum, err := cs.Put(name, io.LimitReader(src, size))
+		if err == nil && n != size {
+			return 0, nil, fmt.Errorf("%q: copied %d of %d bytes: %w", name, n, size, io.ErrUnexpectedEOF)
+		}
+		return n, checksum, err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(cs.root, storeTempDir), "put-*")
+	if err != nil {
+		return 0, nil, err
+	}
+	// os.File.ReadFrom only copies in the kernel from an *io.LimitedReader
+	// of an *os.File
+	n, err := tmp.ReadFrom(io.LimitReader(src, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("%q: copied %d of %d bytes: %w", name, n, size, io.ErrUnexpectedEOF)
+	}
+	hsh := NewHash()
+	if err == nil {
+		_, err = io.Copy(hsh, io.NewSectionReader(tmp, 0, n))
+	}
+	if err == nil {
+		err = syncCloser{tmp}.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return 0, nil, err
+	}
+	checksum := hsh.Sum(nil)
+	if stored, err := cs.refresh(checksum); err != nil || stored {
+		_ = os.Remove(tmp.Name())
+		if err != nil {
+			return 0, nil, err
+		}
+		return n, checksum, nil
+	}
+	dst := cs.Path(checksum)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		_ = os.Remove(tmp.Name())
+		return 0, nil, err
+	}
+	if err := publish(tmp.Name(), dst); err != nil {
+		return 0, nil, err
+	}
+	return n, checksum, nil
+}
+
+// refresh sets the modification time of the payload of checksum to now, if it
+// is stored, and returns whether it is.
+func (cs *ChecksumStore) refresh(checksum []byte) (bool, error) {
+	path, err := cs.lookup(checksum)
+	if err == nil {
+		now := time.Now()
+		err = os.Chtimes(path, now, now)
+	}
+	if os.IsNotExist(err) {
+		// collected since, if not before
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// compress writes the payload of size bytes at raw to a new temporary file,
+// compressed, and returns its path. If compressing does not save enough, it
+// returns an empty path.
+func (cs *ChecksumStore) compress(raw string, size int64) (string, error) {
+	src, err := os.Open(raw)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = src.Close() }()
+	tmp, err := os.CreateTemp(filepath.Join(cs.root, storeTempDir), "put-*")
+	if err != nil {
+		return "", err
+	}
+	cw := &countingWriter{w: tmp}
+	zw, err := cs.codec.NewWriter(cw)
+	if err == nil {
+		_, err = io.Copy(zw, src)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil && cw.n > size-size/minCompressionSaving {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return "", nil
+	}
+	if err == nil {
+		err = syncCloser{tmp}.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// openPayload opens the payload at path, decompressed by the codec named by
+// its extension, if any.
+func openPayload(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ext, ok := strings.Cut(filepath.Base(path), "."); ok {
+		return decompress(file, ext)
+	}
+	return file, nil
+}
+
+// decompress returns the content of file, decompressed by the codec name.
+// file is closed on error.
+func decompress(file *os.File, name string) (io.ReadCloser, error) {
+	codec, err := lookupCodec(name)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	r, err := codec.NewReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("%s: %w", file.Name(), err)
+	}
+	return codecReadCloser{ReadCloser: r, file: file}, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// fanOut returns the path of name in a directory of dir named by its first
+// two characters.
+func fanOut(dir, name string) string {
+	if len(name) < 2 {
+		return filepath.Join(dir, name)
+	}
+	return filepath.Join(dir, name[:2], name)
+}
+
+// CleanTemp removes the temporary files of Puts older than maxAge, such as
+// those left behind by a process that crashed. Puts still in progress in
+// other processes are spared, if maxAge is longer than any of them takes.
+// It returns the number of files removed.
+func (cs *ChecksumStore) CleanTemp(maxAge time.Duration) (int, error) {
+	dir := filepath.Join(cs.root, storeTempDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	for _, e := range entries {
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			continue // published in the meantime
+		}
+		if err != nil {
+			return removed, err
+		}
+		if time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Migrate moves the payloads of a store laid out flat by
+// NewChecksumFileGetter into the fanned out layout, and removes the temporary
+// files left behind by its Puts. It returns the number of payloads moved.
+//
+// It is safe to Get and Put while migrating.
+func (cs *ChecksumStore) Migrate() (int, error) {
+	entries, err := os.ReadDir(cs.root)
+	if err != nil {
+		return 0, err
+	}
+	var moved int
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		src := filepath.Join(cs.root, name)
+		if strings.HasPrefix(name, checksumTempPrefix) {
+			if err := os.Remove(src); err != nil && !os.IsNotExist(err) {
+				return moved, err
+			}
+			continue
+		}
+		checksum, err := hex.DecodeString(name)
+		if err != nil {
+			continue // not a payload
+		}
+		dst := cs.Path(checksum)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			if os.IsNotExist(err) {
+				continue // moved by a concurrent migration
+			}
+			return moved, err
+		}
+		if err := syncDir(filepath.Dir(dst)); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, syncDir(cs.root)
+}
+
+// writeTemp copies r to a new temporary file in dir, synced to disk, and
+// returns its path, size and checksum. The file is removed on error.
+func writeTemp(dir, pattern string, r io.Reader) (string, int64, []byte, error) {
+	tmp, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	i, checksum, err := copyWithChecksum(syncCloser{tmp}, r)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", 0, nil, err
+	}
+	return tmp.Name(), i, checksum, nil
+}
+
+// publish renames the temporary file tmp to dst, replacing any payload of
+// the same checksum, and syncs the directory of dst. The rename is atomic, so
+// concurrent readers see either payload in full. tmp is removed on error.
+func publish(tmp, dst string) error {
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// syncCloser syncs a file to disk before closing it.
+type syncCloser struct {
+	*os.File
+}
+
+func (sc syncCloser) Close() error {
+	if err := sc.File.Sync(); err != nil {
+		_ = sc.File.Close()
+		return err
+	}
+	return sc.File.Close()
+}
+
+// syncDir syncs the directory dir to disk, making renames into it durable.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// directories can not be opened for syncing
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
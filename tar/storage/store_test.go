@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestChecksumStore(t *testing.T) {
+	root := t.TempDir()
+	cs, err := NewChecksumStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := []string{"foo", "bar", "baz", "bif"}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(bodies)*8)
+	for i := 0; i < 8; i++ {
+		for _, body := range bodies {
+			wg.Add(1)
+			go func(body string) {
+				defer wg.Done()
+				if _, _, err := cs.Put(body, bytes.NewBufferString(body)); err != nil {
+					errs <- err
+				}
+			}(body)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for _, body := range bodies {
+		n, csum, err := NewDiscardFilePutter().Put(body, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := hex.EncodeToString(csum)
+		if cs.Path(csum) != filepath.Join(root, name[:2], name) {
+			t.Errorf("expected %q to be fanned out, got %q", body, cs.Path(csum))
+		}
+
+		r, err := cs.Get(&Entry{Type: FileType, Size: n, Payload: csum})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != body {
+			t.Errorf("expected %q, got %q", body, out)
+		}
+
+		if _, err := cs.Get(&Entry{Type: FileType, Size: n + 1, Payload: csum}); err == nil {
+			t.Errorf("expected a size mismatch for %q", body)
+		}
+	}
+
+	// a failed Put leaves nothing behind
+	errFailed := errors.New("read failed")
+	if _, _, err := cs.Put("bad", iotest.ErrReader(errFailed)); err != errFailed {
+		t.Errorf("expected %v, got %v", errFailed, err)
+	}
+	if tmps, _ := os.ReadDir(filepath.Join(root, storeTempDir)); len(tmps) != 0 {
+		t.Errorf("expected no temporary files, got %d", len(tmps))
+	}
+}
+
+func TestChecksumStoreCleanTemp(t *testing.T) {
+	root := t.TempDir()
+	cs, err := NewChecksumStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(root, storeTempDir, "put-stale")
+	fresh := filepath.Join(root, storeTempDir, "put-fresh")
+	for _, name := range []string{stale, fresh} {
+		if err := os.WriteFile(name, []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := cs.CleanTemp(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 file removed, got %d", n)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", stale)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("expected %s to be kept: %v", fresh, err)
+	}
+}
+
+func TestChecksumStoreMigrate(t *testing.T) {
+	root := t.TempDir()
+	flat := NewChecksumFileGetter(root)
+	var entries []Entry
+	for i := 0; i < 10; i++ {
+		body := fmt.Sprintf("payload %d", i)
+		n, csum, err := flat.Put(body, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, Entry{Type: FileType, Size: n, Payload: csum})
+	}
+	// left behind by a crashed Put
+	if err := os.WriteFile(filepath.Join(root, checksumTempPrefix+"123"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := NewChecksumStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the flat layout is read before migrating
+	for _, e := range entries[:1] {
+		r, err := cs.Get(&e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Close()
+	}
+
+	n, err := cs.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(entries) {
+		t.Errorf("expected %d payloads moved, got %d", len(entries), n)
+	}
+	for _, e := range entries {
+		if _, err := os.Stat(cs.Path(e.Payload)); err != nil {
+			t.Errorf("expected payload at %s: %v", cs.Path(e.Payload), err)
+		}
+	}
+	files, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			t.Errorf("expected only directories in the root, got %s", f.Name())
+		}
+	}
+}
+
+func TestChecksumStoreCompression(t *testing.T) {
+	if _, err := NewChecksumStoreWithOptions(t.TempDir(), StoreOptions{Compression: "nope"}); err == nil {
+		t.Error("expected an error for an unknown codec")
+	}
+	cs, err := NewChecksumStoreWithOptions(t.TempDir(), StoreOptions{Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressible := bytes.Repeat([]byte("all work and no play "), 1000)
+	incompressible := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+
+	for _, tc := range []struct {
+		body []byte
+		ext  string
+	}{
+		{compressible, ".gzip"},
+		{incompressible, ""},
+	} {
+		n, csum, err := cs.Put("", bytes.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// addressed by the uncompressed content, as any other store would
+		_, want, _ := NewDiscardFilePutter().Put("", bytes.NewReader(tc.body))
+		if !bytes.Equal(csum, want) {
+			t.Errorf("expected checksum %x, got %x", want, csum)
+		}
+		if _, err := os.Stat(cs.Path(csum) + tc.ext); err != nil {
+			t.Errorf("expected the payload to be stored as %q: %s", tc.ext, err)
+		}
+
+		r, err := cs.Get(&Entry{Type: FileType, Size: n, Payload: csum})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, tc.body) {
+			t.Errorf("payload of %d bytes did not round trip", len(tc.body))
+		}
+
+		r, err = cs.Get(&Entry{Type: FileType, Size: n + 1, Payload: csum})
+		if err == nil {
+			_, err = io.ReadAll(r)
+			_ = r.Close()
+		}
+		if err == nil {
+			t.Error("expected a size mismatch error")
+		}
+	}
+
+	stats, err := cs.Scrub(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Checked != 2 || len(stats.Corrupt) != 0 {
+		t.Errorf("unexpected scrub stats %+v", stats)
+	}
+
+	// a payload stored in one encoding is not stored again in another
+	raw, err := NewChecksumStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, csum, err := raw.Put("", bytes.NewReader(compressible))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := NewChecksumStoreWithOptions(raw.root, StoreOptions{Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := gz.Put("", bytes.NewReader(compressible)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(raw.Path(csum) + ".gzip"); !os.IsNotExist(err) {
+		t.Errorf("expected no compressed copy of a raw payload, got %v", err)
+	}
+	if err := os.Remove(raw.Path(csum)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := gz.Put("", bytes.NewReader(compressible)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := raw.Put("", bytes.NewReader(compressible)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(raw.Path(csum)); !os.IsNotExist(err) {
+		t.Errorf("expected no raw copy of a compressed payload, got %v", err)
+	}
+}
+
+func TestChecksumStorePutFile(t *testing.T) {
+	src, err := os.CreateTemp(t.TempDir(), "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, err := src.WriteString("headerpayload-bodytrailer"); err != nil {
+		t.Fatal(err)
+	}
+	_, expected, err := NewDiscardFilePutter().Put("", bytes.NewBufferString("payload-body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []string{"", "gzip"} {
+		cs, err := NewChecksumStoreWithOptions(t.TempDir(), StoreOptions{Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := src.Seek(6, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		n, csum, err := cs.PutFile("payload", src, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 12 || !bytes.Equal(csum, expected) {
+			t.Errorf("%q: expected 12 bytes with checksum %x, got %d with %x", compression, expected, n, csum)
+		}
+		if off, _ := src.Seek(0, io.SeekCurrent); off != 18 {
+			t.Errorf("%q: expected src at offset 18, got %d", compression, off)
+		}
+		r, err := cs.Get(&Entry{Type: FileType, Size: n, Payload: csum})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "payload-body" {
+			t.Errorf("%q: expected %q, got %q", compression, "payload-body", out)
+		}
+
+		// past the end of src
+		if _, _, err := cs.PutFile("short", src, 12); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+		}
+	}
+}
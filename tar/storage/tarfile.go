@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+)
+
+// NewTarFileGetter returns a FileGetter of the payloads of the regular files
+// in the tar archive read from ra, such as an archive with the same file
+// contents as the original, but other headers or ordering. The archive is
+// indexed by name once, reading only its headers, and Get returns sections
+// of it.
+//
+// A payload is looked up by the name of its entry first, provided its size
+// and checksum match. Otherwise, every payload of the archive is checksummed
+// once, and it is looked up by checksum. Sparse files are skipped, as their payload is
+// not stored contiguously.
+func NewTarFileGetter(ra io.ReaderAt) (FileGetter, error) {
+	tfg := &tarFileGetter{byName: map[string]*io.SectionReader{}}
+	sr := io.NewSectionReader(ra, 0, math.MaxInt64)
+	tr := tar.NewReader(sr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tfg, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) || isSparse(hdr) {
+			continue
+		}
+		// the Reader does not read ahead of the data of a member
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		tfg.byName[cleanName(hdr.Name)] = io.NewSectionReader(ra, offset, hdr.Size)
+	}
+}
+
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanName returns name as an absolute path, so "./a", "a" and "/a" match.
+func cleanName(name string) string {
+	return path.Clean("/" + name)
+}
+
+type tarFileGetter struct {
+	byName map[string]*io.SectionReader
+
+	once    sync.Once
+	byCsum  map[string]*io.SectionReader // by hex checksum
+	csumErr error
+}
+
+func (tfg *tarFileGetter) Get(entry *Entry) (io.ReadCloser, error) {
+	if section, ok := tfg.byName[cleanName(entry.GetName())]; ok && section.Size() == entry.Size {
+		// a SectionReader of its own, as they are not safe for concurrent use
+		section = io.NewSectionReader(section, 0, section.Size())
+		hsh := NewHash()
+		if _, err := io.Copy(hsh, section); err != nil {
+			return nil, err
+		}
+		if bytes.Equal(hsh.Sum(nil), entry.Payload) {
+			return io.NopCloser(io.NewSectionReader(section, 0, section.Size())), nil
+		}
+		// another file of the same name and size
+	}
+	tfg.once.Do(tfg.indexChecksums)
+	if tfg.csumErr != nil {
+		return nil, tfg.csumErr
+	}
+	key := hex.EncodeToString(entry.Payload)
+	section, ok := tfg.byCsum[key]
+	if !ok {
+		return nil, fmt.Errorf("%q (payload %s): %w", entry.GetName(), key, os.ErrNotExist)
+	}
+	if section.Size() != entry.Size {
+		return nil, fmt.Errorf("tar payload has size %d but entry expects %d: %w", section.Size(), entry.Size, ErrSizeMismatch)
+	}
+	return io.NopCloser(io.NewSectionReader(section, 0, section.Size())), nil
+}
+
+// indexChecksums checksums every payload, for those not found by name.
+func (tfg *tarFileGetter) indexChecksums() {
+	tfg.byCsum = make(map[string]*io.SectionReader, len(tfg.byName))
+	buf := make([]byte, 32*1024)
+	for _, section := range tfg.byName {
+		hsh := NewHash()
+		if _, err := io.CopyBuffer(hsh, io.NewSectionReader(section, 0, section.Size()), buf); err != nil {
+			tfg.csumErr = err
+			return
+		}
+		tfg.byCsum[hex.EncodeToString(hsh.Sum(nil))] = section
+	}
+}
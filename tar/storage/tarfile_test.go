@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/bmoylan/tar-split/archive/tar"
+)
+
+func TestTarFileGetter(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, f := range []struct {
+		name, body string
+	}{
+		{"a", "foo"},
+		{"dir/b", "barbaz"},
+		{"c", "foobaz"},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Size: int64(len(f.body)), Mode: 0o644}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, f.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0o755}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fg, err := NewTarFileGetter(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(name, body string) *Entry {
+		n, csum, err := NewDiscardFilePutter().Put(name, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Entry{Type: FileType, Name: name, Size: n, Payload: csum}
+	}
+	for _, tc := range []struct {
+		entry *Entry
+		body  string
+	}{
+		{entry("./a", "foo"), "foo"},           // by name
+		{entry("/dir/b", "barbaz"), "barbaz"},  // by name
+		{entry("renamed", "barbaz"), "barbaz"}, // by checksum
+		{entry("dir/b", "foobaz"), "foobaz"},   // by checksum, as the content differs
+		{entry("dir/b", "foo"), "foo"},         // by checksum, as the size differs
+	} {
+		r, err := fg.Get(tc.entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tc.body {
+			t.Errorf("%s: expected %q, got %q", tc.entry.GetName(), tc.body, out)
+		}
+	}
+
+	if _, err := fg.Get(entry("missing", "nope")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing payload to not exist, got %v", err)
+	}
+	// of the name and size of a member, but not its content
+	if _, err := fg.Get(entry("dir/b", "foobar")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a payload of another content to not exist, got %v", err)
+	}
+}